@@ -13,6 +13,7 @@ func Begin() {
 
 	router := api.GetRouter()
 	router.SetEndpoints()
+	router.ShutdownOnSIGTERM()
 	router.StartRouter()
 
 	log.Println("service started successfully")
@@ -2,21 +2,28 @@ package config
 
 import (
 	"os"
+	"runtime"
 	"strconv"
 	"time"
 )
 
 var (
 
-	// Directories where index files are stored
-	IndexDataDirectory    string
-	IndexDocListDirectory string
+	// Directory where segment files are stored, kept in memory when not set
+	IndexDataDirectory string
 
 	// service config
 	Port               string
 	ActiveSegmentCount int
 	CaseSensitivity    bool
 
+	// segments searched at once by a search, and how often the leader looks for segments to merge
+	SearchWorkers int           = runtime.NumCPU()
+	MergeInterval time.Duration = 10 * time.Second
+
+	// how often the leader looks for document bodies in Minio that nothing refers to anymore
+	BlobGCInterval time.Duration = time.Minute
+
 	MinioEndpoint  string
 	MinioAccessKey string
 	MinioSecretKey string
@@ -29,8 +36,16 @@ var (
 	RaftAddress         string
 	RaftDirectory       string
 	RaftSelfHTTPAddress string
+	// joins as a nonvoter, a replica serving searches without voting
+	RaftNonvoter bool
+	// leaves the cluster on SIGTERM rather than only shutting down, for nodes scaled away for good
+	LeaveOnShutdown bool
+
+	MinioDocPathPrefix  string = "/docs"
+	MinioBlobPathPrefix string = "/blobs"
 
-	MinioDocPathPrefix string = "/docs"
+	// docs up to this many bytes of JSON are carried in the Raft log, larger ones by reference
+	MaxInlineDocSize int = 256 << 10
 
 	RaftTimeout time.Duration = 10 * time.Second
 )
@@ -38,16 +53,27 @@ var (
 func LoadEnv() {
 
 	IndexDataDirectory = os.Getenv("IDX_DATA_DIR")
-	IndexDocListDirectory = os.Getenv("IDX_DOC_LIST_DIR")
 
 	Port = ":" + os.Getenv("PORT")
 	ActiveSegmentCount, _ = strconv.Atoi(os.Getenv("MAX_SEGMENT_DOC_COUNT"))
 	CaseSensitivity, _ = strconv.ParseBool(os.Getenv("CASE_SENSITIVITY"))
+	if n, err := strconv.Atoi(os.Getenv("SEARCH_WORKERS")); err == nil && n > 0 {
+		SearchWorkers = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("MERGE_INTERVAL")); err == nil && d > 0 {
+		MergeInterval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("BLOB_GC_INTERVAL")); err == nil && d > 0 {
+		BlobGCInterval = d
+	}
 
 	MinioEndpoint = os.Getenv("MINIO_ENDPOINT")
 	MinioAccessKey = os.Getenv("MINIO_ACCESS_KEY")
 	MinioSecretKey = os.Getenv("MINIO_SECRET_KEY")
 	MinioBucket = os.Getenv("MINIO_BUCKET")
+	if n, err := strconv.Atoi(os.Getenv("MAX_INLINE_DOC_SIZE")); err == nil && n >= 0 {
+		MaxInlineDocSize = n
+	}
 
 	RaftBootstrap, _ = strconv.ParseBool(os.Getenv("GOCENE_BOOTSTRAP"))
 	RaftJoinAddress = os.Getenv("RAFT_JOIN_ADDRESS")
@@ -55,5 +81,7 @@ func LoadEnv() {
 	RaftAddress = os.Getenv("RAFT_NODE_ADDRESS")
 	RaftDirectory = os.Getenv("RAFT_DIRECTORY")
 	RaftSelfHTTPAddress = os.Getenv("RAFT_SELF_HTTP_ADDRESS")
+	RaftNonvoter, _ = strconv.ParseBool(os.Getenv("RAFT_NONVOTER"))
+	LeaveOnShutdown, _ = strconv.ParseBool(os.Getenv("LEAVE_ON_SHUTDOWN"))
 
 }
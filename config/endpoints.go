@@ -4,7 +4,7 @@ const (
 	CreateIndexAPI = iota
 	GetIndicesAPI
 	AddDocumentAPI
-	// ModifyDocumentAPI
+	ModifyDocumentAPI
 	GetDocumentAPI
 	// GetAllDocumentsAPI
 	// GetIndexDetailsAPI
@@ -12,20 +12,36 @@ const (
 	// SearchTermAPI
 	JoinAPI
 	StatusAPI
+	DeleteDocumentAPI
+	BulkAddDocumentsAPI
+	OpenPITAPI
+	ClosePITAPI
+	RemoveNodeAPI
+	SetNodeRoleAPI
+	TransferLeaderAPI
+	NodeProgressAPI
 )
 
 var (
 	EndpointsMap map[int]string = map[int]string{
-		CreateIndexAPI: "/create_index",
-		GetIndicesAPI:  "/indices",
-		AddDocumentAPI: "/:idx_name/add_document",
-		// ModifyDocumentAPI:  "/:idx_name/modify_document",
-		GetDocumentAPI: "/:idx_name/get_document",
+		CreateIndexAPI:    "/create_index",
+		GetIndicesAPI:     "/indices",
+		AddDocumentAPI:    "/:idx_name/add_document",
+		ModifyDocumentAPI: "/:idx_name/documents/:id",
+		GetDocumentAPI:    "/:idx_name/get_document",
 		// GetAllDocumentsAPI: "/:idx_name/get_all",
 		// GetIndexDetailsAPI: "/:idx_name",
 		SearchFullTextAPI: "/:idx_name/search",
 		// SearchTermAPI:      "/:idx_name/search_term",
-		JoinAPI:   "/join",
-		StatusAPI: "/status",
+		JoinAPI:             "/join",
+		StatusAPI:           "/status",
+		DeleteDocumentAPI:   "/:idx_name/documents/:id",
+		BulkAddDocumentsAPI: "/:idx_name/bulk",
+		OpenPITAPI:          "/:idx_name/pit",
+		ClosePITAPI:         "/:idx_name/pit/:pit_id",
+		RemoveNodeAPI:       "/cluster/nodes/:id",
+		SetNodeRoleAPI:      "/cluster/nodes/:id/role",
+		TransferLeaderAPI:   "/cluster/leader/transfer",
+		NodeProgressAPI:     "/cluster/progress",
 	}
 )
@@ -1,9 +1,12 @@
 package api
 
 import (
+	"errors"
 	"gocene/internal/store"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
@@ -37,6 +40,10 @@ func (c *Controller) CreateIndex(ctx *gin.Context) (status int) {
 		if err == store.ErrIdxNameExists {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index name already exists"})
 			return http.StatusBadRequest
+		} else if errors.Is(err, store.ErrUnknownAnalyzer) || errors.Is(err, store.ErrUnknownTokenizer) || errors.Is(err, store.ErrUnknownTokenFilter) ||
+			errors.Is(err, store.ErrInvalidMapping) || errors.Is(err, ErrInvalidSettings) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return http.StatusBadRequest
 		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
 		return http.StatusInternalServerError
@@ -81,9 +88,48 @@ func (c *Controller) AddDocument(ctx *gin.Context) (status int) {
 	res, err := c.serv.AddDocument(idx, inp)
 	if err != nil {
 		log.Println("Error adding document: ", err.Error())
+		var merr *store.MappingError
+		if err == store.ErrIdxDoesNotExist {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index specified does not exist"})
+			return http.StatusBadRequest
+		} else if errors.As(err, &merr) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "document does not match the mapping", "reason": merr.Error()})
+			return http.StatusBadRequest
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
+			return http.StatusInternalServerError
+		}
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
+
+// Bulk Add Documents HTTP, body is NDJSON or a JSON array of documents
+func (c *Controller) BulkAddDocuments(ctx *gin.Context) (status int) {
+	log.Println("inside cont BulkAddDocuments()")
+
+	idx := ctx.Param("idx_name")
+	if idx == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "index not specified"})
+		return http.StatusBadRequest
+	}
+
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "could not read request body"})
+		return http.StatusBadRequest
+	}
+
+	res, err := c.serv.BulkAddDocuments(idx, body, ctx.ContentType())
+	if err != nil {
+		log.Println("Error bulk adding documents: ", err.Error())
 		if err == store.ErrIdxDoesNotExist {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index specified does not exist"})
 			return http.StatusBadRequest
+		} else if err == ErrBadBulkBody {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "incorrect input structure"})
+			return http.StatusBadRequest
 		} else {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
 			return http.StatusInternalServerError
@@ -117,8 +163,14 @@ func (c *Controller) GetDocument(ctx *gin.Context) (status int) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index specified does not exist"})
 			return http.StatusBadRequest
 		} else if err == store.ErrDocumentNotFound {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "document specified does not exist"})
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "document specified does not exist"})
+			return http.StatusNotFound
+		} else if err == ErrInvalidConsistency {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return http.StatusBadRequest
+		} else if err == store.ErrIndexNotApplied || err == store.ErrNoLeader {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return http.StatusServiceUnavailable
 		} else {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
 			return http.StatusInternalServerError
@@ -129,9 +181,9 @@ func (c *Controller) GetDocument(ctx *gin.Context) (status int) {
 	return http.StatusOK
 }
 
-// Search Full Text HTTP
-func (c *Controller) SearchFullText(ctx *gin.Context) (status int) {
-	log.Println("inside cont SearchFullText()")
+// Modify Document HTTP, PUT for full replacement and PATCH for a partial merge
+func (c *Controller) ModifyDocument(ctx *gin.Context) (status int) {
+	log.Println("inside cont ModifyDocument()")
 
 	idx := ctx.Param("idx_name")
 	if idx == "" {
@@ -139,18 +191,161 @@ func (c *Controller) SearchFullText(ctx *gin.Context) (status int) {
 		return http.StatusBadRequest
 	}
 
-	var inp SearchInput
+	docID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid document id"})
+		return http.StatusBadRequest
+	}
+
+	var inp ModifyDocumentInput
 	if err := ctx.BindJSON(&inp); err != nil {
 		//bind failed, return 400
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "incorrect input structure"})
 		return http.StatusBadRequest
 	}
 
+	partial := ctx.Request.Method == http.MethodPatch
+
+	res, err := c.serv.ModifyDocument(idx, docID, inp, partial)
+	if err != nil {
+		log.Println("Error modifying document: ", err.Error())
+		var merr *store.MappingError
+		if err == store.ErrIdxDoesNotExist {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index specified does not exist"})
+			return http.StatusBadRequest
+		} else if errors.As(err, &merr) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "document does not match the mapping", "reason": merr.Error()})
+			return http.StatusBadRequest
+		} else if err == store.ErrDocumentNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "document specified does not exist"})
+			return http.StatusNotFound
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
+			return http.StatusInternalServerError
+		}
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
+
+// Delete Document HTTP
+func (c *Controller) DeleteDocument(ctx *gin.Context) (status int) {
+	log.Println("inside cont DeleteDocument()")
+
+	idx := ctx.Param("idx_name")
+	if idx == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "index not specified"})
+		return http.StatusBadRequest
+	}
+
+	docID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid document id"})
+		return http.StatusBadRequest
+	}
+
+	res, err := c.serv.DeleteDocument(idx, docID)
+	if err != nil {
+		log.Println("Error deleting document: ", err.Error())
+		if err == store.ErrIdxDoesNotExist {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index specified does not exist"})
+			return http.StatusBadRequest
+		} else if err == store.ErrDocumentNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "document specified does not exist"})
+			return http.StatusNotFound
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
+			return http.StatusInternalServerError
+		}
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
+
+// Search Full Text HTTP
+func (c *Controller) SearchFullText(ctx *gin.Context) (status int) {
+	log.Println("inside cont SearchFullText()")
+
+	idx := ctx.Param("idx_name")
+	if idx == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "index not specified"})
+		return http.StatusBadRequest
+	}
+
+	// GET searches only take the query string from the URL
+	var inp SearchInput
+	if ctx.Request.Method != http.MethodGet {
+		if err := ctx.BindJSON(&inp); err != nil {
+			//bind failed, return 400
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "incorrect input structure"})
+			return http.StatusBadRequest
+		}
+	}
+
+	if q, ok := ctx.GetQuery("q"); ok {
+		inp.Q = q
+	}
+	if field, ok := ctx.GetQuery("default_field"); ok {
+		inp.DefaultField = field
+	}
+	if from, ok := ctx.GetQuery("from"); ok {
+		n, err := strconv.Atoi(from)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "from must be a number"})
+			return http.StatusBadRequest
+		}
+		inp.From = n
+	}
+	if size, ok := ctx.GetQuery("size"); ok {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "size must be a number"})
+			return http.StatusBadRequest
+		}
+		inp.Size = &n
+	}
+	if after, ok := ctx.GetQuery("search_after"); ok {
+		inp.SearchAfter = after
+	}
+	if consistency, ok := ctx.GetQuery("consistency"); ok {
+		inp.Consistency = consistency
+	}
+	if minIndex, ok := ctx.GetQuery("min_index"); ok {
+		n, err := strconv.ParseUint(minIndex, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "min_index must be a number"})
+			return http.StatusBadRequest
+		}
+		inp.MinIndex = n
+	}
+
 	res, err := c.serv.SearchFullText(idx, inp)
 	if err != nil {
+		var qerr *store.QueryError
 		if err == store.ErrIdxDoesNotExist {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index specified does not exist"})
 			return http.StatusBadRequest
+		} else if err == store.ErrPITNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return http.StatusNotFound
+		} else if err == store.ErrInvalidKeepAlive {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return http.StatusBadRequest
+		} else if err == ErrInvalidConsistency {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return http.StatusBadRequest
+		} else if err == store.ErrIndexNotApplied || err == store.ErrNoLeader {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return http.StatusServiceUnavailable
+		} else if errors.As(err, &qerr) {
+			body := gin.H{"error": "invalid query", "reason": qerr.Reason}
+			if qerr.Position > 0 {
+				body["position"] = qerr.Position
+			}
+			ctx.JSON(http.StatusBadRequest, body)
+			return http.StatusBadRequest
 		} else {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
 			return http.StatusInternalServerError
@@ -161,6 +356,60 @@ func (c *Controller) SearchFullText(ctx *gin.Context) (status int) {
 	return http.StatusOK
 }
 
+// Open Point In Time HTTP, keep_alive is a URL param like 5m
+func (c *Controller) OpenPointInTime(ctx *gin.Context) (status int) {
+	log.Println("inside cont OpenPointInTime()")
+
+	idx := ctx.Param("idx_name")
+	if idx == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "index not specified"})
+		return http.StatusBadRequest
+	}
+
+	res, err := c.serv.OpenPointInTime(idx, ctx.Query("keep_alive"))
+	if err != nil {
+		if err == store.ErrIdxDoesNotExist {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index specified does not exist"})
+			return http.StatusBadRequest
+		} else if err == store.ErrInvalidKeepAlive {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return http.StatusBadRequest
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
+		return http.StatusInternalServerError
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
+
+// Close Point In Time HTTP
+func (c *Controller) ClosePointInTime(ctx *gin.Context) (status int) {
+	log.Println("inside cont ClosePointInTime()")
+
+	idx := ctx.Param("idx_name")
+	if idx == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "index not specified"})
+		return http.StatusBadRequest
+	}
+
+	res, err := c.serv.ClosePointInTime(idx, ctx.Param("pit_id"))
+	if err != nil {
+		if err == store.ErrIdxDoesNotExist {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "index specified does not exist"})
+			return http.StatusBadRequest
+		} else if err == store.ErrPITNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return http.StatusNotFound
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
+		return http.StatusInternalServerError
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
+
 func (c *Controller) Join(ctx *gin.Context) (status int) {
 
 	var inp JoinInput
@@ -179,6 +428,79 @@ func (c *Controller) Join(ctx *gin.Context) (status int) {
 	return http.StatusOK
 }
 
+// Remove Node HTTP
+func (c *Controller) RemoveNode(ctx *gin.Context) (status int) {
+
+	res, err := c.serv.RemoveNode(ctx.Param("id"))
+	if err != nil {
+		if err == store.ErrNodeNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return http.StatusNotFound
+		} else if err == store.ErrLastVoter {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return http.StatusBadRequest
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return http.StatusInternalServerError
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
+
+// Promote or demote a node HTTP
+func (c *Controller) SetNodeRole(ctx *gin.Context) (status int) {
+
+	var inp SetNodeRoleInput
+	if err := ctx.BindJSON(&inp); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "incorrect role structure"})
+		return http.StatusBadRequest
+	}
+
+	res, err := c.serv.SetNodeRole(ctx.Param("id"), inp)
+	if err != nil {
+		if err == store.ErrNodeNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return http.StatusNotFound
+		} else if err == store.ErrLastVoter || err == store.ErrInvalidRole {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return http.StatusBadRequest
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return http.StatusInternalServerError
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
+
+// Leadership Transfer HTTP
+func (c *Controller) TransferLeadership(ctx *gin.Context) (status int) {
+
+	// the body is optional
+	var inp TransferLeadershipInput
+	if err := ctx.ShouldBindJSON(&inp); err != nil && err != io.EOF {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "incorrect transfer structure"})
+		return http.StatusBadRequest
+	}
+
+	res, err := c.serv.TransferLeadership(inp)
+	if err != nil {
+		if err == store.ErrNodeNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return http.StatusNotFound
+		} else if err == store.ErrNotVoter {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return http.StatusBadRequest
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return http.StatusInternalServerError
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
+
 func (c *Controller) Status(ctx *gin.Context) (status int) {
 
 	res, err := c.serv.Status()
@@ -190,3 +512,16 @@ func (c *Controller) Status(ctx *gin.Context) (status int) {
 	ctx.JSON(http.StatusOK, res)
 	return http.StatusOK
 }
+
+// Node Progress HTTP, asked by the leader
+func (c *Controller) NodeProgress(ctx *gin.Context) (status int) {
+
+	res, err := c.serv.NodeProgress()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return http.StatusInternalServerError
+	}
+
+	ctx.JSON(http.StatusOK, res)
+	return http.StatusOK
+}
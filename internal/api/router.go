@@ -2,8 +2,13 @@ package api
 
 import (
 	"gocene/config"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 type Router struct {
@@ -15,6 +20,10 @@ type Router struct {
 
 func GetRouter() *Router {
 
+	// docs keep their numbers as written, like when they are applied, so the leader
+	// validates a doc with the same types every node maps it to
+	binding.EnableDecoderUseNumber = true
+
 	// add configs and log options later
 	return &Router{
 		R:    gin.Default(),
@@ -26,6 +35,30 @@ func (r *Router) StartRouter() error {
 	return r.R.Run(config.Port)
 }
 
+// Shuts Raft down cleanly when the process gets SIGTERM, and the node stays a member of the
+// cluster to come back to when restarted. With LEAVE_ON_SHUTDOWN it leaves the cluster
+// instead, so scaling the cluster down does not leave dead peers behind.
+func (r *Router) ShutdownOnSIGTERM() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+
+	go func() {
+		<-sig
+		if config.LeaveOnShutdown {
+			log.Println("SIGTERM received, leaving the cluster")
+			if err := r.Cont.serv.Leave(); err != nil {
+				log.Println("could not leave the cluster, err: ", err.Error())
+			}
+		} else {
+			log.Println("SIGTERM received, shutting down")
+			if err := r.Cont.serv.Shutdown(); err != nil {
+				log.Println("could not shut down raft, err: ", err.Error())
+			}
+		}
+		os.Exit(0)
+	}()
+}
+
 // set endpoints()
 func (router *Router) SetEndpoints() {
 
@@ -45,6 +78,14 @@ func (router *Router) SetEndpoints() {
 			router.R.POST(endpoint, func(ctx *gin.Context) {
 				router.Cont.AddDocument(ctx)
 			})
+		} else if apiId == config.ModifyDocumentAPI {
+			// PUT replaces the whole document, PATCH merges into it
+			router.R.PUT(endpoint, func(ctx *gin.Context) {
+				router.Cont.ModifyDocument(ctx)
+			})
+			router.R.PATCH(endpoint, func(ctx *gin.Context) {
+				router.Cont.ModifyDocument(ctx)
+			})
 		} else if apiId == config.GetDocumentAPI {
 			router.R.POST(endpoint, func(ctx *gin.Context) {
 				router.Cont.GetDocument(ctx)
@@ -53,6 +94,10 @@ func (router *Router) SetEndpoints() {
 			router.R.POST(endpoint, func(ctx *gin.Context) {
 				router.Cont.SearchFullText(ctx)
 			})
+			// GET /<index>/search?q=... for query strings typed into a search box
+			router.R.GET(endpoint, func(ctx *gin.Context) {
+				router.Cont.SearchFullText(ctx)
+			})
 		} else if apiId == config.JoinAPI {
 			router.R.POST(endpoint, func(ctx *gin.Context) {
 				router.Cont.Join(ctx)
@@ -61,6 +106,38 @@ func (router *Router) SetEndpoints() {
 			router.R.GET(endpoint, func(ctx *gin.Context) {
 				router.Cont.Status(ctx)
 			})
+		} else if apiId == config.DeleteDocumentAPI {
+			router.R.DELETE(endpoint, func(ctx *gin.Context) {
+				router.Cont.DeleteDocument(ctx)
+			})
+		} else if apiId == config.BulkAddDocumentsAPI {
+			router.R.POST(endpoint, func(ctx *gin.Context) {
+				router.Cont.BulkAddDocuments(ctx)
+			})
+		} else if apiId == config.OpenPITAPI {
+			router.R.POST(endpoint, func(ctx *gin.Context) {
+				router.Cont.OpenPointInTime(ctx)
+			})
+		} else if apiId == config.ClosePITAPI {
+			router.R.DELETE(endpoint, func(ctx *gin.Context) {
+				router.Cont.ClosePointInTime(ctx)
+			})
+		} else if apiId == config.RemoveNodeAPI {
+			router.R.DELETE(endpoint, func(ctx *gin.Context) {
+				router.Cont.RemoveNode(ctx)
+			})
+		} else if apiId == config.SetNodeRoleAPI {
+			router.R.POST(endpoint, func(ctx *gin.Context) {
+				router.Cont.SetNodeRole(ctx)
+			})
+		} else if apiId == config.TransferLeaderAPI {
+			router.R.POST(endpoint, func(ctx *gin.Context) {
+				router.Cont.TransferLeadership(ctx)
+			})
+		} else if apiId == config.NodeProgressAPI {
+			router.R.GET(endpoint, func(ctx *gin.Context) {
+				router.Cont.NodeProgress(ctx)
+			})
 		}
 	}
 }
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"gocene/config"
 	"gocene/internal/store"
 	"gocene/internal/utils"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/minio/minio-go/v7"
@@ -17,6 +21,10 @@ import (
 
 // all service functions here
 
+var ErrBadBulkBody error = errors.New("bulk body is neither NDJSON nor a JSON array of documents")
+var ErrInvalidSettings error = errors.New("invalid index settings")
+var ErrInvalidConsistency error = errors.New("consistency must be stale, leader or linearizable")
+
 type Service struct {
 	st          *store.Store
 	minioClient *minio.Client
@@ -45,7 +53,25 @@ func NewService() *Service {
 // Creates a new index.
 func (s *Service) CreateIndex(inp CreateIndexInput) (res *CreateIndexResult, err error) {
 
-	err = s.st.CreateIndex(inp.Name, inp.CaseSensitivity)
+	settings := store.DefaultIndexSettings()
+	if inp.Analyzer != "" {
+		settings.Analyzer = inp.Analyzer
+	}
+	settings.FieldAnalyzers = inp.FieldAnalyzers
+	settings.Analysis = inp.Analysis
+	if inp.Mapping != nil {
+		settings.Mapping = *inp.Mapping
+	}
+	if inp.BM25 != nil {
+		if inp.BM25.K1 != nil {
+			settings.BM25.K1 = *inp.BM25.K1
+		}
+		if inp.BM25.B != nil {
+			settings.BM25.B = *inp.BM25.B
+		}
+	}
+
+	err = s.st.CreateIndex(inp.Name, inp.CaseSensitivity, settings)
 	if err != nil {
 		if err == store.ErrNotLeader {
 			return s.ForwardCreateIndexToLeader(inp)
@@ -71,7 +97,7 @@ func (s *Service) GetIndices() (res *GetIndicesResult, err error) {
 func (s *Service) AddDocument(idxName string, inp AddDocumentInput) (res *AddDocumentResult, err error) {
 	log.Println("inside service AddDocument()")
 
-	docId, err := s.st.AddDocument(idxName, inp.Data)
+	docId, index, err := s.st.AddDocument(idxName, inp.Data)
 	if err != nil {
 		if err == store.ErrNotLeader {
 			// forward request to leader.
@@ -80,17 +106,214 @@ func (s *Service) AddDocument(idxName string, inp AddDocumentInput) (res *AddDoc
 	}
 
 	return &AddDocumentResult{
-		DocID:   docId,
-		Success: err == nil,
+		DocID:     docId,
+		Success:   err == nil,
+		RaftIndex: index,
+	}, err
+
+}
+
+// Adds a batch of documents to the specified index if node is leader. Else, forwards it to the leader.
+func (s *Service) BulkAddDocuments(idxName string, body []byte, contentType string) (res *BulkAddDocumentsResult, err error) {
+	log.Println("inside service BulkAddDocuments()")
+
+	docs, parseErrs, err := parseBulkBody(body, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the docs that parsed are sent to the store
+	var valid []map[string]interface{}
+	for i, doc := range docs {
+		if parseErrs[i] == nil {
+			valid = append(valid, doc)
+		}
+	}
+
+	stRes, index, err := s.st.BulkAddDocuments(idxName, valid)
+	if err != nil {
+		if err == store.ErrNotLeader {
+			// forward request to leader.
+			return s.ForwardBulkAddDocumentsToLeader(idxName, body, contentType)
+		}
+		return nil, err
+	}
+
+	res = &BulkAddDocumentsResult{
+		Items:     make([]BulkItemResult, len(docs)),
+		Count:     len(docs),
+		RaftIndex: index,
+	}
+
+	j := 0
+	for i := range docs {
+		item := &res.Items[i]
+		if parseErrs[i] != nil {
+			item.Error = parseErrs[i].Error()
+		} else {
+			if stRes[j].Err != nil {
+				item.Error = stRes[j].Err.Error()
+			} else {
+				docID := stRes[j].DocID
+				item.DocID = &docID
+				item.Success = true
+			}
+			j++
+		}
+
+		if !item.Success {
+			res.Errors = true
+		}
+	}
+
+	return res, nil
+}
+
+// Splits a bulk body into documents. A JSON array holds one document per element,
+// anything else is read as NDJSON with one document per line. A document that does not
+// parse gets its own error, so the rest of the batch can still be indexed.
+func parseBulkBody(body []byte, contentType string) (docs []map[string]interface{}, errs []error, err error) {
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, nil, ErrBadBulkBody
+	}
+
+	var items [][]byte
+	if contentType != "application/x-ndjson" && trimmed[0] == '[' {
+		var raw []json.RawMessage
+		if err = json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, nil, ErrBadBulkBody
+		}
+		for _, r := range raw {
+			items = append(items, r)
+		}
+	} else {
+		for _, line := range bytes.Split(trimmed, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+			items = append(items, line)
+		}
+	}
+
+	docs = make([]map[string]interface{}, len(items))
+	errs = make([]error, len(items))
+	for i, item := range items {
+		dec := json.NewDecoder(bytes.NewReader(item))
+		dec.UseNumber()
+		if lerr := dec.Decode(&docs[i]); lerr != nil || dec.More() || docs[i] == nil {
+			errs[i] = errors.New("document is not a JSON object")
+		}
+	}
+
+	return docs, errs, nil
+}
+
+// Replaces or partially updates a document if node is leader. Else, forwards it to the leader.
+func (s *Service) ModifyDocument(idxName string, docID int, inp ModifyDocumentInput, partial bool) (res *ModifyDocumentResult, err error) {
+	log.Println("inside service ModifyDocument()")
+
+	index, err := s.st.ModifyDocument(idxName, docID, inp.Data, partial)
+	if err != nil {
+		if err == store.ErrNotLeader {
+			// forward request to leader.
+			return s.ForwardModifyDocumentToLeader(idxName, docID, inp, partial)
+		}
+	}
+
+	return &ModifyDocumentResult{
+		DocID:     docID,
+		Success:   err == nil,
+		RaftIndex: index,
+	}, err
+}
+
+// Deletes a document from the specified index if node is leader. Else, forwards it to the leader.
+func (s *Service) DeleteDocument(idxName string, docID int) (res *DeleteDocumentResult, err error) {
+	log.Println("inside service DeleteDocument()")
+
+	index, err := s.st.DeleteDocument(idxName, docID)
+	if err != nil {
+		if err == store.ErrNotLeader {
+			// forward request to leader.
+			return s.ForwardDeleteDocumentToLeader(idxName, docID)
+		}
+	}
+
+	return &DeleteDocumentResult{
+		DocID:     docID,
+		Success:   err == nil,
+		RaftIndex: index,
 	}, err
+}
+
+// Makes this node ready to serve a read at the consistency asked for, once it applied
+// minIndex. Returns store.ErrNotLeader when the read has to be served by the leader.
+func (s *Service) prepareRead(consistency string, minIndex uint64) error {
+
+	switch consistency {
+	case "", ConsistencyStale:
+	case ConsistencyLeader:
+		if s.st.Raft.State() != raft.Leader {
+			return store.ErrNotLeader
+		}
+	case ConsistencyLinearizable:
+		if err := s.st.ReadBarrier(); err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidConsistency
+	}
 
+	if minIndex > 0 {
+		return s.st.WaitForIndex(minIndex)
+	}
+	return nil
 }
 
-// does nothing
+// Gets a stored document by its ID from the specified index, on the leader if the
+// consistency asks for it.
 func (s *Service) GetDocument(idxName string, inp GetDocumentInput) (res *GetDocumentResult, err error) {
 
 	log.Println("inside service GetDocument()")
-	return
+
+	if err = s.prepareRead(inp.Consistency, inp.MinIndex); err == store.ErrNotLeader {
+		return s.ForwardGetDocumentToLeader(idxName, inp)
+	} else if err != nil {
+		return nil, err
+	}
+
+	idx, ok := s.st.GetIndex(idxName)
+	if !ok {
+		return nil, store.ErrIdxDoesNotExist
+	}
+
+	// the body of an add is stored before it is committed, and stays behind when the add
+	// fails, so only a doc the index holds is served
+	if inp.DocID < 0 || inp.DocID >= idx.GetNextDocID() || !idx.HasDocument(inp.DocID) {
+		return nil, store.ErrDocumentNotFound
+	}
+
+	docStr, err := idx.DocumentJSON(inp.DocID)
+	if err != nil {
+		if err == utils.ErrObjectNotFound {
+			return nil, store.ErrDocumentNotFound
+		}
+		return nil, err
+	}
+
+	// fields mapped with "store": false are not returned
+	var doc map[string]interface{}
+	if err = json.Unmarshal(idx.StoredSource([]byte(docStr)), &doc); err != nil {
+		return nil, err
+	}
+
+	return &GetDocumentResult{
+		DocID:    inp.DocID,
+		Document: doc,
+	}, nil
 }
 
 // Performs full text search on specified index with given terms.
@@ -98,6 +321,15 @@ func (s *Service) SearchFullText(idxName string, inp SearchInput) (res *SearchRe
 
 	log.Println("inside service SearchFullText()")
 
+	// a point in time only exists on the node that opened it
+	if inp.PIT == nil {
+		if err = s.prepareRead(inp.Consistency, inp.MinIndex); err == store.ErrNotLeader {
+			return s.ForwardSearchToLeader(idxName, inp)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
 	idx, ok := s.st.GetIndex(idxName)
 
 	if !ok {
@@ -106,9 +338,30 @@ func (s *Service) SearchFullText(idxName string, inp SearchInput) (res *SearchRe
 		return nil, store.ErrIdxDoesNotExist
 	}
 
-	terms := store.GetTermsFromPhrase(inp.SearchField, inp.SearchPhrase)
+	q, err := searchQuery(idx, inp)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := store.SearchOptions{From: inp.From, Size: store.DefaultSearchSize}
+	if inp.Size != nil {
+		opts.Size = *inp.Size
+	}
+	if inp.SearchAfter != "" {
+		if opts.After, err = store.ParseSearchCursor(inp.SearchAfter); err != nil {
+			return nil, err
+		}
+	}
+	if inp.PIT != nil {
+		opts.PIT = inp.PIT.ID
+		if inp.PIT.KeepAlive != "" {
+			if opts.KeepAlive, err = time.ParseDuration(inp.PIT.KeepAlive); err != nil {
+				return nil, store.ErrInvalidKeepAlive
+			}
+		}
+	}
 
-	rankedDocs, err := idx.SearchFullText(terms)
+	rankedDocs, total, err := idx.SearchFullText(q, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -116,11 +369,82 @@ func (s *Service) SearchFullText(idxName string, inp SearchInput) (res *SearchRe
 	res = &SearchResult{
 		Results: rankedDocs,
 		Count:   len(rankedDocs),
+		Total:   total,
+		PITID:   opts.PIT,
+	}
+	if len(rankedDocs) > 0 {
+		last := rankedDocs[len(rankedDocs)-1]
+		res.SearchAfter = store.SearchCursor{Score: last.Score, DocID: last.DocID}.String()
 	}
 
 	return
 }
 
+// Opens a point in time view of the index on this node. Searches using it have to be sent
+// to the same node.
+func (s *Service) OpenPointInTime(idxName string, keepAlive string) (res *OpenPITResult, err error) {
+
+	idx, ok := s.st.GetIndex(idxName)
+	if !ok {
+		return nil, store.ErrIdxDoesNotExist
+	}
+
+	d := store.DefaultPITKeepAlive
+	if keepAlive != "" {
+		if d, err = time.ParseDuration(keepAlive); err != nil {
+			return nil, store.ErrInvalidKeepAlive
+		}
+	}
+
+	id, err := idx.OpenPointInTime(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OpenPITResult{
+		PITID:     id,
+		KeepAlive: d.String(),
+	}, nil
+}
+
+// Closes a point in time view before its keep alive runs out.
+func (s *Service) ClosePointInTime(idxName string, pitID string) (res *ClosePITResult, err error) {
+
+	idx, ok := s.st.GetIndex(idxName)
+	if !ok {
+		return nil, store.ErrIdxDoesNotExist
+	}
+
+	if !idx.ClosePointInTime(pitID) {
+		return nil, store.ErrPITNotFound
+	}
+
+	return &ClosePITResult{Success: true}, nil
+}
+
+// Builds the query to run from the search input, the JSON DSL query taking precedence over q.
+// Query text is analyzed like the values of the index's fields.
+func searchQuery(idx *store.Index, inp SearchInput) (store.Query, error) {
+
+	if len(inp.Query) > 0 {
+		return store.ParseQueryDSL(inp.Query, idx)
+	}
+
+	if inp.Q != "" {
+		return store.ParseQueryString(inp.Q, inp.DefaultField, idx)
+	}
+
+	if inp.SearchField == "" || inp.SearchPhrase == "" {
+		return nil, &store.QueryError{Reason: "either query, q, or search_field and search_phrase are required"}
+	}
+
+	if inp.QueryType == "phrase" {
+		terms, positions := store.GetPhraseTerms(idx, inp.SearchField, inp.SearchPhrase)
+		return store.NewPhraseQuery(terms, positions, inp.Slop), nil
+	}
+	return store.NewMatchQuery(store.GetTermsFromPhrase(idx, inp.SearchField, inp.SearchPhrase)), nil
+}
+
 // Add the requesting node to the cluster if leader, and forwards the request to the leader if not.
 func (s *Service) Join(inp JoinInput) (res *JoinResult, err error) {
 	if s.st.Raft.State() != raft.Leader {
@@ -128,7 +452,7 @@ func (s *Service) Join(inp JoinInput) (res *JoinResult, err error) {
 		return s.ForwardJoinToLeader(inp)
 	}
 
-	err = s.st.Join(inp.NodeID, inp.Address, inp.HTTPAddress)
+	err = s.st.Join(inp.NodeID, inp.Address, inp.HTTPAddress, inp.Nonvoter)
 	if err != nil {
 		return nil, err
 	}
@@ -138,17 +462,85 @@ func (s *Service) Join(inp JoinInput) (res *JoinResult, err error) {
 	}, nil
 }
 
+// Removes a node from the cluster if leader, and forwards the request to the leader if not.
+func (s *Service) RemoveNode(nodeID string) (res *RemoveNodeResult, err error) {
+	if s.st.Raft.State() != raft.Leader {
+		log.Println("not leader, forwarding...")
+		return s.ForwardRemoveNodeToLeader(nodeID)
+	}
+
+	if err = s.st.RemoveNode(nodeID); err != nil {
+		return nil, err
+	}
+
+	return &RemoveNodeResult{
+		NodeID:  nodeID,
+		Success: true,
+	}, nil
+}
+
+// Promotes or demotes a node if leader, and forwards the request to the leader if not.
+func (s *Service) SetNodeRole(nodeID string, inp SetNodeRoleInput) (res *SetNodeRoleResult, err error) {
+	if s.st.Raft.State() != raft.Leader {
+		log.Println("not leader, forwarding...")
+		return s.ForwardSetNodeRoleToLeader(nodeID, inp)
+	}
+
+	if err = s.st.SetNodeRole(nodeID, inp.Role); err != nil {
+		return nil, err
+	}
+
+	return &SetNodeRoleResult{
+		NodeID:  nodeID,
+		Role:    inp.Role,
+		Success: true,
+	}, nil
+}
+
+// Transfers leadership if leader, and forwards the request to the leader if not.
+func (s *Service) TransferLeadership(inp TransferLeadershipInput) (res *TransferLeadershipResult, err error) {
+	if s.st.Raft.State() != raft.Leader {
+		log.Println("not leader, forwarding...")
+		return s.ForwardTransferLeadershipToLeader(inp)
+	}
+
+	if err = s.st.TransferLeadership(inp.NodeID); err != nil {
+		return nil, err
+	}
+
+	return &TransferLeadershipResult{
+		NodeID:  inp.NodeID,
+		Success: true,
+	}, nil
+}
+
+// Takes this node out of the cluster before the process exits.
+func (s *Service) Leave() error {
+	return s.st.Leave()
+}
+
+// Stops this node's Raft before the process exits, keeping it in the cluster.
+func (s *Service) Shutdown() error {
+	return s.st.Shutdown()
+}
+
 // Returns the Raft status of the node.
 func (s *Service) Status() (res StatusResult, err error) {
 	t, err := s.st.Status()
 	return StatusResult(t), err
 }
 
+// Returns how far this node has got, for the leader.
+func (s *Service) NodeProgress() (res NodeProgressResult, err error) {
+	p, err := s.st.Progress()
+	return NodeProgressResult(p), err
+}
+
 // service functions that do the forwarding to leader
 
 // Forwards the add doc request to the leader.
 func (s *Service) ForwardAddDocumentToLeader(idxName string, inp AddDocumentInput) (res *AddDocumentResult, err error) {
-	leaderAddr, _ := s.st.Raft.LeaderWithID()
+	leaderAddr := s.st.WaitForLeader()
 	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
 
 	// leader does exist, forward request to it
@@ -185,6 +577,165 @@ func (s *Service) ForwardAddDocumentToLeader(idxName string, inp AddDocumentInpu
 
 		if resp.StatusCode == http.StatusBadRequest && finalRes.Error == "index specified does not exist" {
 			return &finalRes, store.ErrIdxDoesNotExist
+		} else if resp.StatusCode == http.StatusBadRequest && finalRes.Error == "document does not match the mapping" {
+			return &finalRes, &store.MappingError{Reason: finalRes.Reason}
+		} else if resp.StatusCode == http.StatusInternalServerError {
+			return &finalRes, errors.New("something went wrong")
+		}
+
+		return &finalRes, nil
+	}
+
+	return nil, errors.New("no leader detected")
+}
+
+// Forwards the bulk add request to the leader as is, so it can report per-item parse errors itself.
+func (s *Service) ForwardBulkAddDocumentsToLeader(idxName string, body []byte, contentType string) (res *BulkAddDocumentsResult, err error) {
+	leaderAddr := s.st.WaitForLeader()
+	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
+
+	// leader does exist, forward request to it
+	if leaderAddr != "" {
+
+		if contentType == "" {
+			contentType = "application/json"
+		}
+
+		resp, lerr := http.Post(
+			"http://"+string(leaderHTTPAddr)+"/"+idxName+"/bulk",
+			contentType,
+			bytes.NewBuffer(body),
+		)
+
+		if lerr != nil {
+			log.Println("could not forward bulk add to leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		defer resp.Body.Close()
+
+		respBody, _ := io.ReadAll(resp.Body)
+		var finalRes BulkAddDocumentsResult
+		lerr = json.Unmarshal(respBody, &finalRes)
+		if lerr != nil {
+			log.Println("could not unmarshal bulk add result from leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		if resp.StatusCode == http.StatusBadRequest && finalRes.Error == "index specified does not exist" {
+			return &finalRes, store.ErrIdxDoesNotExist
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return &finalRes, ErrBadBulkBody
+		} else if resp.StatusCode == http.StatusInternalServerError {
+			return &finalRes, errors.New("something went wrong")
+		}
+
+		return &finalRes, nil
+	}
+
+	return nil, errors.New("no leader detected")
+}
+
+// Forwards the modify doc request to the leader, keeping the PUT/PATCH method.
+func (s *Service) ForwardModifyDocumentToLeader(idxName string, docID int, inp ModifyDocumentInput, partial bool) (res *ModifyDocumentResult, err error) {
+	leaderAddr := s.st.WaitForLeader()
+	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
+
+	// leader does exist, forward request to it
+	if leaderAddr != "" {
+
+		data, lerr := json.Marshal(inp)
+		if lerr != nil {
+			log.Println("could not marshal json in fwd to leader modify doc, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		method := http.MethodPut
+		if partial {
+			method = http.MethodPatch
+		}
+
+		req, lerr := http.NewRequest(
+			method,
+			"http://"+string(leaderHTTPAddr)+"/"+idxName+"/documents/"+strconv.Itoa(docID),
+			bytes.NewBuffer(data),
+		)
+		if lerr != nil {
+			log.Println("could not create modify doc request for leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, lerr := http.DefaultClient.Do(req)
+		if lerr != nil {
+			log.Println("could not forward modify doc to leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		var finalRes ModifyDocumentResult
+		lerr = json.Unmarshal(body, &finalRes)
+		if lerr != nil {
+			log.Println("could not unmarshal modify doc result from leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		if resp.StatusCode == http.StatusBadRequest && finalRes.Error == "index specified does not exist" {
+			return &finalRes, store.ErrIdxDoesNotExist
+		} else if resp.StatusCode == http.StatusBadRequest && finalRes.Error == "document does not match the mapping" {
+			return &finalRes, &store.MappingError{Reason: finalRes.Reason}
+		} else if resp.StatusCode == http.StatusNotFound {
+			return &finalRes, store.ErrDocumentNotFound
+		} else if resp.StatusCode == http.StatusInternalServerError {
+			return &finalRes, errors.New("something went wrong")
+		}
+
+		return &finalRes, nil
+	}
+
+	return nil, errors.New("no leader detected")
+}
+
+// Forwards the delete doc request to the leader.
+func (s *Service) ForwardDeleteDocumentToLeader(idxName string, docID int) (res *DeleteDocumentResult, err error) {
+	leaderAddr := s.st.WaitForLeader()
+	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
+
+	// leader does exist, forward request to it
+	if leaderAddr != "" {
+
+		req, lerr := http.NewRequest(
+			http.MethodDelete,
+			"http://"+string(leaderHTTPAddr)+"/"+idxName+"/documents/"+strconv.Itoa(docID),
+			nil,
+		)
+		if lerr != nil {
+			log.Println("could not create delete doc request for leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		resp, lerr := http.DefaultClient.Do(req)
+		if lerr != nil {
+			log.Println("could not forward delete doc to leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		var finalRes DeleteDocumentResult
+		lerr = json.Unmarshal(body, &finalRes)
+		if lerr != nil {
+			log.Println("could not unmarshal delete doc result from leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		if resp.StatusCode == http.StatusBadRequest && finalRes.Error == "index specified does not exist" {
+			return &finalRes, store.ErrIdxDoesNotExist
+		} else if resp.StatusCode == http.StatusNotFound {
+			return &finalRes, store.ErrDocumentNotFound
 		} else if resp.StatusCode == http.StatusInternalServerError {
 			return &finalRes, errors.New("something went wrong")
 		}
@@ -195,9 +746,120 @@ func (s *Service) ForwardAddDocumentToLeader(idxName string, inp AddDocumentInpu
 	return nil, errors.New("no leader detected")
 }
 
+// Forwards the get doc request to the leader, which serves it at the same consistency.
+func (s *Service) ForwardGetDocumentToLeader(idxName string, inp GetDocumentInput) (res *GetDocumentResult, err error) {
+	leaderAddr := s.st.WaitForLeader()
+	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
+
+	// leader does exist, forward request to it
+	if leaderAddr != "" {
+
+		data, lerr := json.Marshal(inp)
+		if lerr != nil {
+			log.Println("could not marshal json in fwd to leader get doc, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		resp, lerr := http.Post(
+			"http://"+string(leaderHTTPAddr)+"/"+idxName+"/get_document",
+			"application/json",
+			bytes.NewBuffer(data),
+		)
+		if lerr != nil {
+			log.Println("could not forward get doc to leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return nil, leaderReadError(resp.StatusCode, body)
+		}
+
+		var finalRes GetDocumentResult
+		if lerr = json.Unmarshal(body, &finalRes); lerr != nil {
+			log.Println("could not unmarshal get doc result from leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		return &finalRes, nil
+	}
+
+	return nil, store.ErrNoLeader
+}
+
+// Forwards the search to the leader, which serves it at the same consistency.
+func (s *Service) ForwardSearchToLeader(idxName string, inp SearchInput) (res *SearchResult, err error) {
+	leaderAddr := s.st.WaitForLeader()
+	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
+
+	// leader does exist, forward request to it
+	if leaderAddr != "" {
+
+		data, lerr := json.Marshal(inp)
+		if lerr != nil {
+			log.Println("could not marshal json in fwd to leader search, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		resp, lerr := http.Post(
+			"http://"+string(leaderHTTPAddr)+"/"+idxName+"/search",
+			"application/json",
+			bytes.NewBuffer(data),
+		)
+		if lerr != nil {
+			log.Println("could not forward search to leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return nil, leaderReadError(resp.StatusCode, body)
+		}
+
+		var finalRes SearchResult
+		if lerr = json.Unmarshal(body, &finalRes); lerr != nil {
+			log.Println("could not unmarshal search result from leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		return &finalRes, nil
+	}
+
+	return nil, store.ErrNoLeader
+}
+
+// Error of a read the leader failed to serve, from its status and body.
+func leaderReadError(status int, body []byte) error {
+	var e ErrorResult
+	if err := json.Unmarshal(body, &e); err != nil {
+		log.Println("could not unmarshal error from leader, err: ", err.Error())
+		return err
+	}
+
+	switch {
+	case status == http.StatusBadRequest && e.Error == "index specified does not exist":
+		return store.ErrIdxDoesNotExist
+	case status == http.StatusBadRequest && e.Error == "invalid query":
+		return &store.QueryError{Reason: e.Reason, Position: e.Position}
+	case status == http.StatusBadRequest && e.Error == ErrInvalidConsistency.Error():
+		return ErrInvalidConsistency
+	case status == http.StatusNotFound:
+		return store.ErrDocumentNotFound
+	case status == http.StatusServiceUnavailable && e.Error == store.ErrIndexNotApplied.Error():
+		return store.ErrIndexNotApplied
+	case status == http.StatusServiceUnavailable:
+		return store.ErrNoLeader
+	}
+	return errors.New("something went wrong")
+}
+
 func (s *Service) ForwardCreateIndexToLeader(inp CreateIndexInput) (res *CreateIndexResult, err error) {
 
-	leaderAddr, _ := s.st.Raft.LeaderWithID()
+	leaderAddr := s.st.WaitForLeader()
 	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
 
 	// leader does exist, forward request to it
@@ -232,6 +894,9 @@ func (s *Service) ForwardCreateIndexToLeader(inp CreateIndexInput) (res *CreateI
 
 		if resp.StatusCode == http.StatusBadRequest && finalRes.Error == "index name already exists" {
 			return &finalRes, store.ErrIdxNameExists
+		} else if resp.StatusCode == http.StatusBadRequest {
+			// invalid settings, the leader's message is passed on
+			return &finalRes, fmt.Errorf("%w: %s", ErrInvalidSettings, finalRes.Error)
 		} else if resp.StatusCode == http.StatusInternalServerError {
 			return &finalRes, errors.New("something went wrong")
 		}
@@ -242,9 +907,155 @@ func (s *Service) ForwardCreateIndexToLeader(inp CreateIndexInput) (res *CreateI
 	return nil, errors.New("no leader detected")
 }
 
+// Forwards the remove node request to the leader.
+func (s *Service) ForwardRemoveNodeToLeader(nodeID string) (res *RemoveNodeResult, err error) {
+	leaderAddr := s.st.WaitForLeader()
+	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
+
+	// leader does exist, forward request to it
+	if leaderAddr != "" {
+
+		req, lerr := http.NewRequest(
+			http.MethodDelete,
+			"http://"+string(leaderHTTPAddr)+"/cluster/nodes/"+url.PathEscape(nodeID),
+			nil,
+		)
+		if lerr != nil {
+			log.Println("could not create remove node request for leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		resp, lerr := http.DefaultClient.Do(req)
+		if lerr != nil {
+			log.Println("could not forward remove node to leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		var finalRes RemoveNodeResult
+		lerr = json.Unmarshal(body, &finalRes)
+		if lerr != nil {
+			log.Println("could not unmarshal remove node result from leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			return &finalRes, store.ErrNodeNotFound
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return &finalRes, store.ErrLastVoter
+		} else if resp.StatusCode != http.StatusOK {
+			return &finalRes, errors.New(finalRes.Error)
+		}
+
+		return &finalRes, nil
+	}
+
+	return nil, errors.New("no leader detected")
+}
+
+// Forwards the promote or demote node request to the leader.
+func (s *Service) ForwardSetNodeRoleToLeader(nodeID string, inp SetNodeRoleInput) (res *SetNodeRoleResult, err error) {
+	leaderAddr := s.st.WaitForLeader()
+	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
+
+	// leader does exist, forward request to it
+	if leaderAddr != "" {
+
+		data, lerr := json.Marshal(inp)
+		if lerr != nil {
+			log.Println("could not marshal json in fwd to leader set node role, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		resp, lerr := http.Post(
+			"http://"+string(leaderHTTPAddr)+"/cluster/nodes/"+url.PathEscape(nodeID)+"/role",
+			"application/json",
+			bytes.NewBuffer(data),
+		)
+		if lerr != nil {
+			log.Println("could not forward set node role to leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		var finalRes SetNodeRoleResult
+		lerr = json.Unmarshal(body, &finalRes)
+		if lerr != nil {
+			log.Println("could not unmarshal set node role result from leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			return &finalRes, store.ErrNodeNotFound
+		} else if resp.StatusCode == http.StatusBadRequest && finalRes.Error == store.ErrInvalidRole.Error() {
+			return &finalRes, store.ErrInvalidRole
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return &finalRes, store.ErrLastVoter
+		} else if resp.StatusCode != http.StatusOK {
+			return &finalRes, errors.New(finalRes.Error)
+		}
+
+		return &finalRes, nil
+	}
+
+	return nil, errors.New("no leader detected")
+}
+
+// Forwards the leadership transfer request to the leader.
+func (s *Service) ForwardTransferLeadershipToLeader(inp TransferLeadershipInput) (res *TransferLeadershipResult, err error) {
+	leaderAddr := s.st.WaitForLeader()
+	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
+
+	// leader does exist, forward request to it
+	if leaderAddr != "" {
+
+		data, lerr := json.Marshal(inp)
+		if lerr != nil {
+			log.Println("could not marshal json in fwd to leader transfer leadership, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		resp, lerr := http.Post(
+			"http://"+string(leaderHTTPAddr)+config.EndpointsMap[config.TransferLeaderAPI],
+			"application/json",
+			bytes.NewBuffer(data),
+		)
+		if lerr != nil {
+			log.Println("could not forward transfer leadership to leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		var finalRes TransferLeadershipResult
+		lerr = json.Unmarshal(body, &finalRes)
+		if lerr != nil {
+			log.Println("could not unmarshal transfer leadership result from leader, err: ", lerr.Error())
+			return nil, lerr
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			return &finalRes, store.ErrNodeNotFound
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return &finalRes, store.ErrNotVoter
+		} else if resp.StatusCode != http.StatusOK {
+			return &finalRes, errors.New(finalRes.Error)
+		}
+
+		return &finalRes, nil
+	}
+
+	return nil, errors.New("no leader detected")
+}
+
 func (s *Service) ForwardJoinToLeader(inp JoinInput) (res *JoinResult, err error) {
 
-	leaderAddr, _ := s.st.Raft.LeaderWithID()
+	leaderAddr := s.st.WaitForLeader()
 	leaderHTTPAddr := s.st.PeerHTTPAddr(string(leaderAddr))
 
 	// leader does exist, forward request to it
@@ -1,14 +1,28 @@
 package api
 
 import (
+	"encoding/json"
 	"gocene/internal/store"
 )
 
 // All the HTTP types here
 
 type CreateIndexInput struct {
-	Name            string `json:"name" binding:"required"`
-	CaseSensitivity bool   `json:"case_sensitivity"`
+	Name            string     `json:"name" binding:"required"`
+	CaseSensitivity bool       `json:"case_sensitivity"`
+	BM25            *BM25Input `json:"bm25,omitempty"`
+	// standard (the default), simple, whitespace, keyword, english or a custom one
+	Analyzer       string                          `json:"analyzer,omitempty"`
+	FieldAnalyzers map[string]string               `json:"field_analyzers,omitempty"`
+	Analysis       map[string]store.AnalyzerConfig `json:"analysis,omitempty"`
+	// field types, fields missing from it are mapped dynamically
+	Mapping *store.Mapping `json:"mapping,omitempty"`
+}
+
+// unset parameters keep their defaults (k1 = 1.2, b = 0.75)
+type BM25Input struct {
+	K1 *float64 `json:"k1,omitempty" binding:"omitempty,min=0"`
+	B  *float64 `json:"b,omitempty" binding:"omitempty,min=0,max=1"`
 }
 
 type AddDocumentInput struct {
@@ -16,6 +30,10 @@ type AddDocumentInput struct {
 	Data map[string]interface{}
 }
 
+type ModifyDocumentInput struct {
+	Data map[string]interface{} `json:"data" binding:"required"`
+}
+
 type CreateIndexResult struct {
 	Success bool   `json:"success,omitempty"`
 	Error   string `json:"error,omitempty"`
@@ -25,14 +43,35 @@ type GetIndicesResult struct {
 	IndicesList []string `json:"indices"`
 }
 
+// raft_index is the log index of the write, a read given it as min_index sees the write
 type AddDocumentResult struct {
-	DocID   int    `json:"doc_id,omitempty"`
+	DocID     int    `json:"doc_id,omitempty"`
+	Success   bool   `json:"success"`
+	RaftIndex uint64 `json:"raft_index,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type BulkItemResult struct {
+	DocID   *int   `json:"doc_id,omitempty"`
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
 }
 
+type BulkAddDocumentsResult struct {
+	Items     []BulkItemResult `json:"items"`
+	Count     int              `json:"count"`
+	Errors    bool             `json:"errors"`
+	RaftIndex uint64           `json:"raft_index,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// doc_id is not "required", that would reject the first document (ID 0)
 type GetDocumentInput struct {
-	DocID int `json:"doc_id" binding:"required"`
+	DocID int `json:"doc_id" binding:"min=0"`
+
+	Consistency string `json:"consistency,omitempty"`
+	MinIndex    uint64 `json:"min_index,omitempty"`
 }
 
 type GetDocumentResult struct {
@@ -40,24 +79,132 @@ type GetDocumentResult struct {
 	Document map[string]interface{} `json:"document"`
 }
 
+type ModifyDocumentResult struct {
+	DocID     int    `json:"doc_id"`
+	Success   bool   `json:"success"`
+	RaftIndex uint64 `json:"raft_index,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type DeleteDocumentResult struct {
+	DocID     int    `json:"doc_id"`
+	Success   bool   `json:"success"`
+	RaftIndex uint64 `json:"raft_index,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Read consistency of searches and gets. stale (the default) reads what this node has,
+// leader reads what the leader has, and linearizable what the leader has once it made sure
+// it is still the leader and applied every committed write. Any of them can also wait for
+// the node serving the read to apply the log index given as min_index.
+const (
+	ConsistencyStale        = "stale"
+	ConsistencyLeader       = "leader"
+	ConsistencyLinearizable = "linearizable"
+)
+
+// Body of a request that failed on the leader.
+type ErrorResult struct {
+	Error    string `json:"error"`
+	Reason   string `json:"reason,omitempty"`
+	Position int    `json:"position,omitempty"`
+}
+
+// Either a query in the JSON DSL, a Lucene query string q, or a single field search with
+// search_field and search_phrase. Terms of q without a field search default_field.
+// query_type "match" (the default) finds docs with any of the words,
+// "phrase" only the ones with all of them next to each other, give or take slop moves
 type SearchInput struct {
-	SearchField  string `json:"search_field" binding:"required"`
-	SearchPhrase string `json:"search_phrase" binding:"required"`
+	Query json.RawMessage `json:"query,omitempty"`
+
+	Q            string `json:"q"`
+	DefaultField string `json:"default_field"`
+
+	SearchField  string `json:"search_field"`
+	SearchPhrase string `json:"search_phrase"`
+	QueryType    string `json:"query_type" binding:"omitempty,oneof=match phrase"`
+	Slop         int    `json:"slop" binding:"min=0"`
+
+	// page of the results, 10 hits from the first one when unset
+	From int  `json:"from" binding:"min=0"`
+	Size *int `json:"size,omitempty" binding:"omitempty,min=0"`
+
+	// cursor of the previous page, for pages past from + size's limit
+	SearchAfter string    `json:"search_after,omitempty"`
+	PIT         *PITInput `json:"pit,omitempty"`
+
+	// a point in time is searched on the node that opened it whatever the consistency
+	Consistency string `json:"consistency,omitempty"`
+	MinIndex    uint64 `json:"min_index,omitempty"`
 }
 
+// point in time view to search, its keep alive is extended by keep_alive when given
+type PITInput struct {
+	ID        string `json:"id" binding:"required"`
+	KeepAlive string `json:"keep_alive,omitempty"`
+}
+
+// count is the number of results returned, total the number of docs matching.
+// search_after is the cursor for the next page, when there were results.
 type SearchResult struct {
-	Results []store.RankedResultDoc `json:"results"`
-	Count   int                     `json:"count"`
+	Results     []store.RankedResultDoc `json:"results"`
+	Count       int                     `json:"count"`
+	Total       int                     `json:"total"`
+	SearchAfter string                  `json:"search_after,omitempty"`
+	PITID       string                  `json:"pit_id,omitempty"`
+}
+
+type OpenPITResult struct {
+	PITID     string `json:"pit_id"`
+	KeepAlive string `json:"keep_alive"`
+}
+
+type ClosePITResult struct {
+	Success bool `json:"success"`
 }
 
 type JoinInput struct {
 	NodeID      string `json:"node_id"`
 	Address     string `json:"node_address"`
 	HTTPAddress string `json:"http_address"`
+	// joins without voting, as a search replica
+	Nonvoter bool `json:"nonvoter,omitempty"`
 }
 
 type JoinResult struct {
 	LeaderHTTPAddress string `json:"leader_http_address"`
 }
 
+type RemoveNodeResult struct {
+	NodeID  string `json:"node_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Role to give a node, voter or nonvoter.
+type SetNodeRoleInput struct {
+	Role string `json:"role"`
+}
+
+type SetNodeRoleResult struct {
+	NodeID  string `json:"node_id"`
+	Role    string `json:"role"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Node to hand leadership over to, any up to date voter when empty.
+type TransferLeadershipInput struct {
+	NodeID string `json:"node_id,omitempty"`
+}
+
+type TransferLeadershipResult struct {
+	NodeID  string `json:"node_id,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
 type StatusResult store.StatusResult
+
+type NodeProgressResult store.NodeProgress
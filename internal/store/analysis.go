@@ -0,0 +1,436 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Text analysis, like Lucene's: char filters clean up the raw text, a tokenizer splits it
+// into tokens, and token filters change, drop or add tokens. The same analyzer runs on
+// field values at index time and on query text at search time, so both produce the same terms.
+
+// A token and its position in the field, stop words removed later leave gaps.
+type Token struct {
+	Text     string
+	Position int
+}
+
+type Analyzer interface {
+	// tokens of a field value or of query text
+	Analyze(text string) []Token
+	// text of a term the query parser does not tokenize (prefix, fuzzy), only normalized
+	// by the char filters and the token filters that work on single terms, like lowercasing
+	Normalize(text string) string
+}
+
+type CharFilter interface {
+	Filter(text string) string
+}
+
+type Tokenizer interface {
+	Tokenize(text string) []Token
+}
+
+type TokenFilter interface {
+	Filter(tokens []Token) []Token
+}
+
+// Token filters that change single terms without looking at their neighbours, also
+// applied to the terms of multi term queries.
+type normalizingFilter interface {
+	normalize(text string) string
+}
+
+// Picks the analyzer of a field.
+type FieldAnalyzers interface {
+	FieldAnalyzer(field string) Analyzer
+}
+
+// Analyzer made of char filters, a tokenizer and token filters, applied in that order.
+type PipelineAnalyzer struct {
+	CharFilters  []CharFilter
+	Tokenizer    Tokenizer
+	TokenFilters []TokenFilter
+}
+
+func (a *PipelineAnalyzer) Analyze(text string) []Token {
+	for _, cf := range a.CharFilters {
+		text = cf.Filter(text)
+	}
+
+	tokens := a.Tokenizer.Tokenize(text)
+	for _, tf := range a.TokenFilters {
+		tokens = tf.Filter(tokens)
+	}
+	return tokens
+}
+
+func (a *PipelineAnalyzer) Normalize(text string) string {
+	for _, cf := range a.CharFilters {
+		text = cf.Filter(text)
+	}
+
+	for _, tf := range a.TokenFilters {
+		if nf, ok := tf.(normalizingFilter); ok {
+			text = nf.normalize(text)
+		}
+	}
+	return text
+}
+
+const DefaultAnalyzer = "standard"
+
+// Built in analyzers, by name:
+//
+//	standard    words split on Unicode word boundaries, lowercased
+//	simple      runs of letters, lowercased
+//	whitespace  split on whitespace, as is
+//	keyword     the whole value as a single term
+//	english     standard, without English stop words, Porter stemmed
+//
+// Case sensitive indices skip the lowercasing.
+func NewAnalyzer(name string, caseSensitive bool) (Analyzer, error) {
+
+	var filters []TokenFilter
+	if !caseSensitive {
+		filters = append(filters, LowercaseFilter{})
+	}
+
+	switch name {
+	case "", DefaultAnalyzer:
+		return &PipelineAnalyzer{Tokenizer: StandardTokenizer{}, TokenFilters: filters}, nil
+	case "simple":
+		return &PipelineAnalyzer{Tokenizer: LetterTokenizer{}, TokenFilters: filters}, nil
+	case "whitespace":
+		return &PipelineAnalyzer{Tokenizer: WhitespaceTokenizer{}}, nil
+	case "keyword":
+		return &PipelineAnalyzer{Tokenizer: KeywordTokenizer{}}, nil
+	case "english":
+		filters = append(filters, NewStopFilter(EnglishStopWords), PorterStemFilter{})
+		return &PipelineAnalyzer{Tokenizer: StandardTokenizer{}, TokenFilters: filters}, nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownAnalyzer, name)
+	}
+}
+
+// A custom analyzer, given in the index settings:
+//
+//	{"tokenizer": "standard", "filter": ["lowercase", "asciifolding", "stop", "porter_stem"]}
+//
+// Tokenizers are standard, whitespace, letter and keyword. Filters are lowercase,
+// stop (StopWords, the English ones if empty), porter_stem, asciifolding and nfkc.
+// Mappings replace text before it is tokenized.
+type AnalyzerConfig struct {
+	Mappings  map[string]string `json:"mappings,omitempty"`
+	Tokenizer string            `json:"tokenizer"`
+	Filters   []string          `json:"filter,omitempty"`
+	StopWords []string          `json:"stopwords,omitempty"`
+}
+
+// Builds the index's analyzer and the ones of the fields having their own. Custom
+// analyzers are looked up before the built in ones.
+func (s IndexSettings) buildAnalyzers(caseSensitive bool) (def Analyzer, fields map[string]Analyzer, err error) {
+
+	custom := make(map[string]Analyzer, len(s.Analysis))
+	for name, c := range s.Analysis {
+		if custom[name], err = c.build(); err != nil {
+			return nil, nil, fmt.Errorf("analyzer %q: %w", name, err)
+		}
+	}
+
+	byName := func(name string) (Analyzer, error) {
+		if a, ok := custom[name]; ok {
+			return a, nil
+		}
+		return NewAnalyzer(name, caseSensitive)
+	}
+
+	if def, err = byName(s.Analyzer); err != nil {
+		return nil, nil, err
+	}
+
+	fields = make(map[string]Analyzer, len(s.FieldAnalyzers))
+	for field, name := range s.FieldAnalyzers {
+		if fields[field], err = byName(name); err != nil {
+			return nil, nil, fmt.Errorf("field %q: %w", field, err)
+		}
+	}
+
+	// an analyzer in the mapping wins over field_analyzers
+	for field, fm := range s.Mapping.Properties {
+		if fm.Analyzer == "" {
+			continue
+		}
+		if fields[field], err = byName(fm.Analyzer); err != nil {
+			return nil, nil, fmt.Errorf("field %q: %w", field, err)
+		}
+	}
+
+	return def, fields, nil
+}
+
+func (c AnalyzerConfig) build() (Analyzer, error) {
+
+	a := &PipelineAnalyzer{}
+	if len(c.Mappings) > 0 {
+		a.CharFilters = append(a.CharFilters, NewMappingCharFilter(c.Mappings))
+	}
+
+	switch c.Tokenizer {
+	case "", "standard":
+		a.Tokenizer = StandardTokenizer{}
+	case "whitespace":
+		a.Tokenizer = WhitespaceTokenizer{}
+	case "letter":
+		a.Tokenizer = LetterTokenizer{}
+	case "keyword":
+		a.Tokenizer = KeywordTokenizer{}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownTokenizer, c.Tokenizer)
+	}
+
+	for _, name := range c.Filters {
+		switch name {
+		case "lowercase":
+			a.TokenFilters = append(a.TokenFilters, LowercaseFilter{})
+		case "stop":
+			words := c.StopWords
+			if len(words) == 0 {
+				words = EnglishStopWords
+			}
+			a.TokenFilters = append(a.TokenFilters, NewStopFilter(words))
+		case "porter_stem":
+			a.TokenFilters = append(a.TokenFilters, PorterStemFilter{})
+		case "asciifolding":
+			a.TokenFilters = append(a.TokenFilters, ASCIIFoldingFilter{})
+		case "nfkc":
+			a.TokenFilters = append(a.TokenFilters, NFKCFilter{})
+		default:
+			return nil, fmt.Errorf("%w %q", ErrUnknownTokenFilter, name)
+		}
+	}
+
+	return a, nil
+}
+
+// Replaces every occurrence of the keys with their values, longest keys first.
+type MappingCharFilter struct {
+	r *strings.Replacer
+}
+
+func NewMappingCharFilter(mappings map[string]string) *MappingCharFilter {
+	oldnew := make([]string, 0, 2*len(mappings))
+	for k, v := range mappings {
+		oldnew = append(oldnew, k, v)
+	}
+	return &MappingCharFilter{r: strings.NewReplacer(oldnew...)}
+}
+
+func (f *MappingCharFilter) Filter(text string) string {
+	return f.r.Replace(text)
+}
+
+// Splits text on Unicode word boundaries (a simplified UAX #29), dropping punctuation,
+// so "steel," and "steel" are the same term. Apostrophes and dots inside a word ("don't",
+// "U.S.A") and dots and commas inside a number ("3.14", "1,000") do not split it.
+type StandardTokenizer struct{}
+
+func (StandardTokenizer) Tokenize(text string) []Token {
+	runes := []rune(text)
+	var tokens []Token
+
+	isWordChar := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || r == '_'
+	}
+
+	start := -1
+	for i := 0; i <= len(runes); i++ {
+		if i < len(runes) && isWordChar(runes[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+
+		// a joining character between two word characters of the same kind
+		if start >= 0 && i > 0 && i+1 < len(runes) && isWordChar(runes[i+1]) {
+			prev, next := runes[i-1], runes[i+1]
+			switch runes[i] {
+			case '\'', '’':
+				if unicode.IsLetter(prev) && unicode.IsLetter(next) {
+					continue
+				}
+			case '.':
+				if unicode.IsLetter(prev) == unicode.IsLetter(next) {
+					continue
+				}
+			case ',':
+				if unicode.IsDigit(prev) && unicode.IsDigit(next) {
+					continue
+				}
+			}
+		}
+
+		if start >= 0 {
+			tokens = append(tokens, Token{Text: string(runes[start:i]), Position: len(tokens)})
+			start = -1
+		}
+	}
+
+	return tokens
+}
+
+// Splits text on whitespace, keeping punctuation.
+type WhitespaceTokenizer struct{}
+
+func (WhitespaceTokenizer) Tokenize(text string) []Token {
+	return splitTokens(text, unicode.IsSpace)
+}
+
+// Splits text on anything that is not a letter.
+type LetterTokenizer struct{}
+
+func (LetterTokenizer) Tokenize(text string) []Token {
+	return splitTokens(text, func(r rune) bool { return !unicode.IsLetter(r) })
+}
+
+// The whole text as a single token, for identifiers, tags and the like.
+type KeywordTokenizer struct{}
+
+func (KeywordTokenizer) Tokenize(text string) []Token {
+	if text == "" {
+		return nil
+	}
+	return []Token{{Text: text, Position: 0}}
+}
+
+func splitTokens(text string, sep func(rune) bool) []Token {
+	words := strings.FieldsFunc(text, sep)
+	tokens := make([]Token, len(words))
+	for i, w := range words {
+		tokens[i] = Token{Text: w, Position: i}
+	}
+	return tokens
+}
+
+type LowercaseFilter struct{}
+
+func (LowercaseFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Text = strings.ToLower(tokens[i].Text)
+	}
+	return tokens
+}
+
+func (LowercaseFilter) normalize(text string) string {
+	return strings.ToLower(text)
+}
+
+// Lucene's English stop words.
+var EnglishStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in", "into", "is",
+	"it", "no", "not", "of", "on", "or", "such", "that", "the", "their", "then", "there",
+	"these", "they", "this", "to", "was", "will", "with",
+}
+
+// Drops stop words. The tokens after them keep their positions, so a phrase
+// search for "sword of steel" does not match "sword steel".
+type StopFilter struct {
+	words map[string]struct{}
+}
+
+func NewStopFilter(words []string) *StopFilter {
+	f := &StopFilter{words: make(map[string]struct{}, len(words))}
+	for _, w := range words {
+		f.words[w] = struct{}{}
+	}
+	return f
+}
+
+func (f *StopFilter) Filter(tokens []Token) []Token {
+	kept := tokens[:0]
+	for _, t := range tokens {
+		if _, stop := f.words[t.Text]; !stop {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// Reduces English words to their stem, so "swords" and "sword" are the same term.
+type PorterStemFilter struct{}
+
+func (PorterStemFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Text = porterStem(tokens[i].Text)
+	}
+	return tokens
+}
+
+// Letters without a decomposition into a base letter and diacritics.
+var asciiFoldings = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "TH",
+	'ı': "i", 'ŋ': "n", 'Ŋ': "N",
+	'‘': "'", '’': "'", '‚': "'", '“': "\"", '”': "\"", '„': "\"", '–': "-", '—': "-",
+}
+
+// Folds letters with diacritics to their ASCII base letter, so "café" is "cafe".
+// Covers the Latin letters, not the whole of Lucene's table.
+type ASCIIFoldingFilter struct{}
+
+func (ASCIIFoldingFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Text = asciiFold(tokens[i].Text)
+	}
+	return tokens
+}
+
+func (ASCIIFoldingFilter) normalize(text string) string {
+	return asciiFold(text)
+}
+
+func asciiFold(text string) string {
+	ascii := true
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return text
+	}
+
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(text) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if folded, ok := asciiFoldings[r]; ok {
+			sb.WriteString(folded)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return norm.NFC.String(sb.String())
+}
+
+// Unicode NFKC normalization, so compatibility forms like "ﬁ" ligatures, full width
+// letters and superscripts are the same terms as their plain versions.
+type NFKCFilter struct{}
+
+func (NFKCFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Text = norm.NFKC.String(tokens[i].Text)
+	}
+	return tokens
+}
+
+func (NFKCFilter) normalize(text string) string {
+	return norm.NFKC.String(text)
+}
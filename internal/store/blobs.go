@@ -0,0 +1,245 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"gocene/config"
+	"gocene/internal/utils"
+	"log"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Doc bodies are stored in Minio as blobs named by their SHA-256, the only copy of a body, which
+// log entries carry or refer to and docs are read from. A blob is removed once no doc has it as
+// its body anymore and every node has compacted away every log entry referring to it, since a
+// node replaying or catching up on such an entry reads the blob again, and nodes compact their
+// logs on their own schedule. Segments keep the blob of each of their docs, see docvalues.go,
+// and the index keeps the orphans, the blobs a doc stopped having or whose doc was not indexed,
+// with the last log entry referring to each. Both are replicated state. Every BLOB_GC_INTERVAL
+// the leader asks every node how far it has compacted, drops the orphans no live doc has from
+// the state with a DropBlobs command, and removes them from Minio once committed.
+
+// Blob of the i-th doc of a command, "" for entries from before docs were carried in the log.
+func payloadBlob(payloads []DocumentPayload, i int) string {
+	if i < len(payloads) {
+		return payloads[i].SHA256
+	}
+	return ""
+}
+
+// Notes what the log entry at logIndex did with blobs once it is applied: the blobs of the
+// docs it indexed have a doc again, while the blobs of the payloads it did not index and the
+// old blobs of the docs it replaced or deleted may have none anymore. Indexed blobs win over
+// orphaned ones, and a blob orphaned again is referred to by the later entry. Only called
+// when applying to the FSM.
+func (idx *Index) referBlobs(logIndex uint64, indexed, orphaned []string) {
+	idx.blobMu.Lock()
+	defer idx.blobMu.Unlock()
+
+	for _, sha := range orphaned {
+		if sha != "" {
+			idx.orphanBlobs[sha] = logIndex
+		}
+	}
+	for _, sha := range indexed {
+		delete(idx.orphanBlobs, sha)
+	}
+}
+
+// Blob of the live copy of the doc, "" if it has none or there is no live copy.
+func (idx *Index) docBlob(docID int) string {
+	idx.Mutex.RLock()
+	defer idx.Mutex.RUnlock()
+
+	for _, seg := range idx.Segments {
+		if seg.HasLiveDocument(docID) {
+			return seg.docBlob(docID)
+		}
+	}
+
+	if idx.As.Seg == nil {
+		return ""
+	}
+	idx.As.Mutex.RLock()
+	defer idx.As.Mutex.RUnlock()
+	if idx.As.Seg.HasLiveDocument(docID) {
+		return idx.As.Seg.docBlob(docID)
+	}
+	return ""
+}
+
+// Orphans no live doc has, last referred to by a log entry up to compactedIndex, with that
+// entry. The orphans are read before the segments, so a doc indexed with one of them in
+// between is either seen here or makes dropBlobs keep the blob.
+func (idx *Index) unusedBlobs(compactedIndex uint64) map[string]uint64 {
+	unused := make(map[string]uint64)
+	idx.blobMu.Lock()
+	for sha, logIndex := range idx.orphanBlobs {
+		if logIndex <= compactedIndex {
+			unused[sha] = logIndex
+		}
+	}
+	idx.blobMu.Unlock()
+
+	if len(unused) == 0 {
+		return unused
+	}
+
+	idx.Mutex.RLock()
+	defer idx.Mutex.RUnlock()
+
+	for _, seg := range idx.Segments {
+		fd := seg.fileDocs()
+		if fd == nil {
+			continue
+		}
+		for ord := 0; ord < fd.count; ord++ {
+			if sha := fd.blob(ord); sha != "" && !seg.isDeleted(fd.docID(ord)) {
+				delete(unused, sha)
+			}
+		}
+	}
+
+	if idx.As.Seg != nil {
+		idx.As.Mutex.RLock()
+		defer idx.As.Mutex.RUnlock()
+		for docID, sha := range idx.As.Seg.Blobs {
+			if !idx.As.Seg.isDeleted(docID) {
+				delete(unused, sha)
+			}
+		}
+	}
+	return unused
+}
+
+// Forgets the orphans that no log entry referred to again since, and returns them.
+// Only called when applying to the FSM.
+func (idx *Index) dropBlobs(blobs map[string]uint64) []string {
+	idx.blobMu.Lock()
+	defer idx.blobMu.Unlock()
+
+	dropped := make([]string, 0, len(blobs))
+	for sha, logIndex := range blobs {
+		if last, ok := idx.orphanBlobs[sha]; ok && last == logIndex {
+			delete(idx.orphanBlobs, sha)
+			dropped = append(dropped, sha)
+		}
+	}
+	return dropped
+}
+
+// Copy of the orphans for a snapshot.
+func (idx *Index) orphanState() map[string]uint64 {
+	idx.blobMu.Lock()
+	defer idx.blobMu.Unlock()
+
+	orphans := make(map[string]uint64, len(idx.orphanBlobs))
+	for sha, logIndex := range idx.orphanBlobs {
+		orphans[sha] = logIndex
+	}
+	return orphans
+}
+
+// Restores the orphans from a snapshot.
+func (idx *Index) loadOrphanState(orphans map[string]uint64) {
+	for sha, logIndex := range orphans {
+		idx.orphanBlobs[sha] = logIndex
+	}
+}
+
+// Runs on every node, which drops the cached bodies its log no longer needs, and only the
+// leader removes blobs.
+func (s *Store) blobLoop() {
+	tick := time.NewTicker(config.BlobGCInterval)
+	defer tick.Stop()
+
+	for range tick.C {
+		if snapshotIndex, err := latestSnapshotIndex(s.snapshots); err != nil {
+			log.Println("could not read latest snapshot index, err: ", err.Error())
+		} else {
+			s.bodies.prune(snapshotIndex)
+		}
+
+		if s.Raft.State() != raft.Leader {
+			continue
+		}
+
+		// entries every node has compacted away, each compacts its log on its own schedule, and
+		// what a node has not reported cannot be assumed
+		progress, failed, err := s.clusterProgress()
+		if err == nil && len(failed) > 0 {
+			err = failed[0]
+		}
+		if err != nil {
+			log.Println("could not get the progress of every node, not removing blobs, err: ", err.Error())
+			continue
+		}
+		compactedIndex := progress[0].CompactedIndex
+		for _, p := range progress {
+			compactedIndex = min(compactedIndex, p.CompactedIndex)
+		}
+
+		for _, idxName := range s.IndexNames() {
+			idx, ok := s.GetIndex(idxName)
+			if !ok {
+				continue
+			}
+
+			if err := s.removeUnusedBlobs(idx, compactedIndex); err != nil {
+				log.Printf("could not remove unused blobs of index %s, err: %v\n", idxName, err)
+			}
+		}
+	}
+}
+
+// Drops the index's unused blobs from the replicated state, then removes them from Minio.
+// Takes writeMu, so no write stores one of them again until they are gone.
+func (s *Store) removeUnusedBlobs(idx *Index, compactedIndex uint64) error {
+
+	blobs := idx.unusedBlobs(compactedIndex)
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	c := Command{
+		CmdId:   CmdDropBlobs,
+		IdxName: idx.Name,
+		Blobs:   blobs,
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f := s.Raft.Apply(b, config.RaftTimeout)
+	if f.Error() != nil {
+		return f.Error()
+	}
+
+	var dropped []string
+	switch resp := f.Response().(type) {
+	case error:
+		return resp
+	case []string:
+		dropped = resp
+	default:
+		return fmt.Errorf("unexpected response from FSM: %T", resp)
+	}
+
+	for _, sha := range dropped {
+		if err := utils.DeleteBlobFromMinio(s.mc, sha, idx.Name); err != nil {
+			log.Printf("could not remove blob %s of index %s, err: %v\n", sha, idx.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestUnusedBlobs(t *testing.T) {
+	idx := NewIndex("test", false, DefaultIndexSettings(), nil)
+	a, b, c, d := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64), strings.Repeat("d", 64)
+	add := func(docID int, sha string) {
+		if _, err := idx.AddDocument(&Document{ID: docID, Blob: sha}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// doc 1 is added with blob a and replaced by blob b, doc 2 has a too, doc 3 is rejected
+	// but its entry still refers to c, and doc 4 has d
+	add(1, a)
+	idx.referBlobs(10, []string{a}, nil)
+	add(2, a)
+	idx.referBlobs(11, []string{a}, nil)
+	idx.referBlobs(12, nil, []string{c})
+	add(4, d)
+	idx.referBlobs(13, []string{d}, nil)
+	old := idx.docBlob(1)
+	if _, err := idx.ModifyDocument(&Document{ID: 1, Blob: b}); err != nil {
+		t.Fatal(err)
+	}
+	idx.referBlobs(14, []string{b}, []string{old})
+
+	unused := func(compactedIndex uint64) []string {
+		var shas []string
+		for sha := range idx.unusedBlobs(compactedIndex) {
+			shas = append(shas, sha)
+		}
+		sort.Strings(shas)
+		return shas
+	}
+
+	if got := unused(100); !reflect.DeepEqual(got, []string{c}) {
+		t.Errorf("got %v unused, want [c]", got)
+	}
+
+	old = idx.docBlob(2)
+	if err := idx.DeleteDocument(2); err != nil {
+		t.Fatal(err)
+	}
+	idx.referBlobs(15, nil, []string{old})
+	if got := unused(14); !reflect.DeepEqual(got, []string{c}) {
+		t.Errorf("got %v unused with entry 15 still in the log, want [c]", got)
+	}
+	if got := unused(15); !reflect.DeepEqual(got, []string{a, c}) {
+		t.Errorf("got %v unused, want [a c]", got)
+	}
+
+	// a is referred to again before the drop is applied, so only c goes
+	blobs := idx.unusedBlobs(100)
+	add(5, a)
+	idx.referBlobs(20, []string{a}, nil)
+	if dropped := idx.dropBlobs(blobs); !reflect.DeepEqual(dropped, []string{c}) {
+		t.Errorf("got %v dropped, want [c]", dropped)
+	}
+
+	// the blobs of immutable segments are used too, b is orphaned by a rejected doc but doc 1
+	// still has it
+	if err := idx.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	idx.referBlobs(21, nil, []string{b})
+	if got := unused(100); got != nil {
+		t.Errorf("got %v unused, want none", got)
+	}
+	if got := idx.docBlob(1); got != b {
+		t.Errorf("doc 1 has blob %q, want %q", got, b)
+	}
+
+	// the orphans survive a snapshot
+	restored := NewIndex("test", false, DefaultIndexSettings(), nil)
+	restored.loadOrphanState(idx.orphanState())
+	if !reflect.DeepEqual(restored.orphanBlobs, map[string]uint64{b: 21}) {
+		t.Errorf("got %v orphans after restoring", restored.orphanBlobs)
+	}
+}
@@ -6,17 +6,41 @@ const (
 	CmdCreateIndex = iota
 	CmdAddDocument
 	CmdAddNode
-	// CmdRemoveNode
+	CmdDeleteDocument
+	CmdModifyDocument
+	CmdBulkAddDocuments
+	CmdRemoveNode
+	CmdStartMerge
+	CmdCommitMerge
+	CmdDropBlobs
 )
 
 // Param stores case sensitivity if the command is CreateIndex,
-// or the Document ID if the command is AddDocument
+// or the Document ID if the command is AddDocument, DeleteDocument or ModifyDocument
 type Command struct {
 	CmdId   int
 	IdxName string
 	Param   int
 
-	// peer info when new node joins
+	// Document IDs of a BulkAddDocuments batch
+	DocIDs []int `json:",omitempty"`
+
+	// docs an AddDocument, ModifyDocument or BulkAddDocuments indexes, in the order of their IDs
+	Docs []DocumentPayload `json:",omitempty"`
+
+	// names of the segments a StartMerge merges into one
+	Segments []string `json:",omitempty"`
+
+	// name of the merged segment a CommitMerge swaps in
+	Segment string `json:",omitempty"`
+
+	// blobs a DropBlobs forgets, with the last log entry that referred to each
+	Blobs map[string]uint64 `json:",omitempty"`
+
+	// settings of the index being created
+	Settings *IndexSettings `json:",omitempty"`
+
+	// peer info when new node joins, or the address of a node being removed
 	NodeAddress     string
 	NodeHTTPAddress string
 }
@@ -4,11 +4,13 @@ type Document struct {
 	ID     int
 	Fields []Field
 	DocMap map[string]interface{} // for fast retrieval
+	// SHA-256 of the body it was indexed from, "" for docs from before bodies were stored by it
+	Blob string
 }
 
 type RankedDoc struct {
-	Score int `json:"score"`
-	DocID int `json:"doc_id"`
+	Score float64 `json:"score"`
+	DocID int     `json:"doc_id"`
 }
 
 func NewDocument() *Document {
@@ -0,0 +1,402 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+)
+
+// Immutable segments keep the values of their docs in their segment file, as columns like
+// Lucene's doc values, so the OS pages in what searches read instead of every doc's values
+// living on the heap. The active segment keeps them in memory, and writes them to its file
+// when it is sealed or snapshotted.
+//
+// Layout of the docs section of a segment file, see segfile.go:
+//
+//	docs     doc count (uvarint), the ID of each doc in ascending order (uint64), then the
+//	         SHA-256 of each doc's body in the same order (32 bytes), zeros when it has none
+//	lengths  field count (uvarint), per field in ascending order: name length, name, doc
+//	         count, sum of lengths (uvarints), then the length of each doc plus one (uint32),
+//	         0 for the docs without the field
+//	numeric  field count (uvarint), per field in ascending order: name length, name, value
+//	         count (uvarints), then the key (int64) and doc ID (uint64) of each value, sorted
+//	         by key, then doc ID
+//
+// A doc's values are at its ordinal, its position among the doc IDs.
+
+const (
+	docIDSize       = 8
+	blobSize        = 32
+	fieldLengthSize = 4
+	numericSize     = 16
+)
+
+// Values of the docs of a segment as they are written, in ascending doc ID order.
+type docColumns struct {
+	docIDs []int
+	// hex SHA-256 of each doc's body, "" for the docs without one
+	blobs []string
+	// length of the field of each doc, -1 for the docs without the field
+	lengths map[string][]int
+	stats   map[string]FieldStats
+	numeric map[string]NumericValues
+}
+
+func writeDocColumns(sw *segmentWriter, dc docColumns) {
+	var buf []byte
+
+	buf = binary.AppendUvarint(buf[:0], uint64(len(dc.docIDs)))
+	for _, docID := range dc.docIDs {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(docID))
+	}
+	sw.write(buf)
+
+	zeros := make([]byte, blobSize)
+	for _, sha := range dc.blobs {
+		b, err := hex.DecodeString(sha)
+		if err != nil || len(b) != blobSize {
+			b = zeros
+		}
+		sw.write(b)
+	}
+
+	fields := sortedKeys(dc.lengths)
+	buf = binary.AppendUvarint(buf[:0], uint64(len(fields)))
+	sw.write(buf)
+	for _, field := range fields {
+		fs := dc.stats[field]
+		buf = appendName(buf[:0], field)
+		buf = binary.AppendUvarint(buf, uint64(fs.DocCount))
+		buf = binary.AppendUvarint(buf, uint64(fs.SumLength))
+		for _, length := range dc.lengths[field] {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(length+1))
+		}
+		sw.write(buf)
+	}
+
+	fields = sortedKeys(dc.numeric)
+	buf = binary.AppendUvarint(buf[:0], uint64(len(fields)))
+	sw.write(buf)
+	for _, field := range fields {
+		nv := dc.numeric[field]
+		buf = appendName(buf[:0], field)
+		buf = binary.AppendUvarint(buf, uint64(len(nv)))
+		for _, p := range nv {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(p.Key))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(p.DocID))
+		}
+		sw.write(buf)
+	}
+}
+
+func appendName(b []byte, name string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(name)))
+	return append(b, name...)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Docs section of a segment file, the columns are slices of the file's data.
+type fileDocs struct {
+	count   int
+	docIDs  []byte
+	blobs   []byte
+	lengths map[string]lengthColumn
+	numeric map[string][]byte
+}
+
+type lengthColumn struct {
+	stats FieldStats
+	data  []byte
+}
+
+// Reads the docs section, false if it does not fit in data.
+func parseDocs(data []byte) (fd fileDocs, ok bool) {
+
+	off := 0
+	uvarint := func() (int, bool) {
+		v, n := binary.Uvarint(data[off:])
+		if n <= 0 || v > uint64(len(data)) {
+			return 0, false
+		}
+		off += n
+		return int(v), true
+	}
+	take := func(n int) ([]byte, bool) {
+		if n < 0 || n > len(data)-off {
+			return nil, false
+		}
+		off += n
+		return data[off-n : off], true
+	}
+	name := func() (string, bool) {
+		n, ok := uvarint()
+		if !ok {
+			return "", false
+		}
+		b, ok := take(n)
+		return string(b), ok
+	}
+
+	if fd.count, ok = uvarint(); !ok {
+		return fd, false
+	}
+	if fd.docIDs, ok = take(fd.count * docIDSize); !ok {
+		return fd, false
+	}
+	if fd.blobs, ok = take(fd.count * blobSize); !ok {
+		return fd, false
+	}
+
+	fields, ok := uvarint()
+	if !ok {
+		return fd, false
+	}
+	fd.lengths = make(map[string]lengthColumn, fields)
+	for i := 0; i < fields; i++ {
+		var c lengthColumn
+		field, ok1 := name()
+		docCount, ok2 := uvarint()
+		sumLength, ok3 := binary.Uvarint(data[off:])
+		if !ok1 || !ok2 || ok3 <= 0 {
+			return fd, false
+		}
+		off += ok3
+		c.stats = FieldStats{DocCount: docCount, SumLength: int(sumLength)}
+		if c.data, ok = take(fd.count * fieldLengthSize); !ok {
+			return fd, false
+		}
+		fd.lengths[field] = c
+	}
+
+	if fields, ok = uvarint(); !ok {
+		return fd, false
+	}
+	fd.numeric = make(map[string][]byte, fields)
+	for i := 0; i < fields; i++ {
+		field, ok1 := name()
+		n, ok2 := uvarint()
+		if !ok1 || !ok2 {
+			return fd, false
+		}
+		if fd.numeric[field], ok = take(n * numericSize); !ok {
+			return fd, false
+		}
+	}
+
+	return fd, off == len(data)
+}
+
+func (fd *fileDocs) docID(ord int) int {
+	return int(binary.LittleEndian.Uint64(fd.docIDs[ord*docIDSize:]))
+}
+
+// Ordinal of the doc, -1 if the segment does not have it.
+func (fd *fileDocs) ord(docID int) int {
+	i := sort.Search(fd.count, func(i int) bool { return fd.docID(i) >= docID })
+	if i < fd.count && fd.docID(i) == docID {
+		return i
+	}
+	return -1
+}
+
+func (fd *fileDocs) blob(ord int) string {
+	b := fd.blobs[ord*blobSize : (ord+1)*blobSize]
+	for _, c := range b {
+		if c != 0 {
+			return hex.EncodeToString(b)
+		}
+	}
+	return ""
+}
+
+// Length of the field of the doc at ord, -1 if it does not have the field.
+func (c lengthColumn) length(ord int) int {
+	return int(binary.LittleEndian.Uint32(c.data[ord*fieldLengthSize:])) - 1
+}
+
+func (fd *fileDocs) fieldStats() map[string]FieldStats {
+	stats := make(map[string]FieldStats, len(fd.lengths))
+	for field, c := range fd.lengths {
+		stats[field] = c.stats
+	}
+	return stats
+}
+
+// Number of values in a numeric column, and the value at i.
+func numericCount(column []byte) int {
+	return len(column) / numericSize
+}
+
+func numericAt(column []byte, i int) NumericPoint {
+	return NumericPoint{
+		Key:   int64(binary.LittleEndian.Uint64(column[i*numericSize:])),
+		DocID: int(binary.LittleEndian.Uint64(column[i*numericSize+8:])),
+	}
+}
+
+// The segment's values of the numeric field, decoded from its file.
+func (fd *fileDocs) numericValues(field string) NumericValues {
+	column := fd.numeric[field]
+	nv := make(NumericValues, numericCount(column))
+	for i := range nv {
+		nv[i] = numericAt(column, i)
+	}
+	return nv
+}
+
+// Token counts of a field of a segment's docs.
+type fieldLengths struct {
+	// the active segment's
+	lengths map[int]int
+	// an immutable segment's
+	docs   *fileDocs
+	column lengthColumn
+}
+
+func (fl fieldLengths) get(docID int) int {
+	if fl.docs == nil {
+		return fl.lengths[docID]
+	}
+	if fl.column.data == nil {
+		return 0
+	}
+	ord := fl.docs.ord(docID)
+	if ord < 0 {
+		return 0
+	}
+	return max(fl.column.length(ord), 0)
+}
+
+// Immutable segments read their docs from their file.
+func (seg *Segment) fileDocs() *fileDocs {
+	if seg.TermDict.file == nil {
+		return nil
+	}
+	return &seg.TermDict.file.docs
+}
+
+// Returns true if the doc was indexed into the segment, deleted or not. Needs tombMu.
+func (seg *Segment) hasDoc(docID int) bool {
+	if fd := seg.fileDocs(); fd != nil {
+		return fd.ord(docID) >= 0
+	}
+	_, ok := seg.DocIDs[docID]
+	return ok
+}
+
+// IDs of the docs indexed into the segment, in ascending order.
+func (seg *Segment) docIDs() []int {
+	if fd := seg.fileDocs(); fd != nil {
+		docIDs := make([]int, fd.count)
+		for ord := range docIDs {
+			docIDs[ord] = fd.docID(ord)
+		}
+		return docIDs
+	}
+
+	seg.tombMu.RLock()
+	defer seg.tombMu.RUnlock()
+	return sortedIDs(seg.DocIDs)
+}
+
+// Blob of the doc's body, "" if it has none. Needs the active segment's lock.
+func (seg *Segment) docBlob(docID int) string {
+	if fd := seg.fileDocs(); fd != nil {
+		if ord := fd.ord(docID); ord >= 0 {
+			return fd.blob(ord)
+		}
+		return ""
+	}
+	return seg.Blobs[docID]
+}
+
+func (seg *Segment) fieldLengths(field string) fieldLengths {
+	if fd := seg.fileDocs(); fd != nil {
+		return fieldLengths{docs: fd, column: fd.lengths[field]}
+	}
+	return fieldLengths{lengths: seg.FieldLengths[field]}
+}
+
+// Docs with a value of the field between min and max, both included.
+func (seg *Segment) docsInRange(field string, min, max int64) []int {
+	fd := seg.fileDocs()
+	if fd == nil {
+		return seg.Numeric[field].docsInRange(min, max)
+	}
+
+	column := fd.numeric[field]
+	n := numericCount(column)
+	start := sort.Search(n, func(i int) bool { return numericAt(column, i).Key >= min })
+
+	var docIDs []int
+	for i := start; i < n; i++ {
+		p := numericAt(column, i)
+		if p.Key > max {
+			break
+		}
+		docIDs = append(docIDs, p.DocID)
+	}
+	return docIDs
+}
+
+// The active segment's values as columns, for writing its file. Needs the active segment's
+// lock, or a segment that no longer changes.
+func (seg *Segment) columns() docColumns {
+	dc := docColumns{
+		docIDs:  seg.docIDs(),
+		lengths: make(map[string][]int, len(seg.FieldLengths)),
+		stats:   seg.FieldStats,
+		numeric: seg.Numeric,
+	}
+
+	dc.blobs = make([]string, len(dc.docIDs))
+	for ord, docID := range dc.docIDs {
+		dc.blobs[ord] = seg.Blobs[docID]
+	}
+
+	for field, lengths := range seg.FieldLengths {
+		column := make([]int, len(dc.docIDs))
+		for ord, docID := range dc.docIDs {
+			if length, ok := lengths[docID]; ok {
+				column[ord] = length
+			} else {
+				column[ord] = -1
+			}
+		}
+		dc.lengths[field] = column
+	}
+	return dc
+}
+
+// Loads the values of a segment file into the active segment, restored from a snapshot.
+func (seg *Segment) loadDocs(fd *fileDocs) {
+	seg.tombMu.Lock()
+	for ord := 0; ord < fd.count; ord++ {
+		docID := fd.docID(ord)
+		seg.DocIDs[docID] = struct{}{}
+		if sha := fd.blob(ord); sha != "" {
+			seg.Blobs[docID] = sha
+		}
+	}
+	seg.tombMu.Unlock()
+
+	for field, c := range fd.lengths {
+		for ord := 0; ord < fd.count; ord++ {
+			if length := c.length(ord); length >= 0 {
+				seg.addFieldLength(field, fd.docID(ord), length)
+			}
+		}
+	}
+
+	for field := range fd.numeric {
+		seg.Numeric[field] = fd.numericValues(field)
+	}
+}
@@ -0,0 +1,416 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON query DSL, a subset of Elasticsearch's:
+//
+//	{"match": {"field": "text"}}
+//	{"match": {"field": {"query": "text", "operator": "and"}}}
+//	{"match_phrase": {"field": {"query": "text", "slop": 1}}}
+//	{"term": {"field": "value"}}
+//	{"terms": {"field": ["value1", "value2"]}}
+//	{"range": {"field": {"gte": 10, "lt": 20}}}
+//	{"prefix": {"field": "val"}}
+//	{"wildcard": {"field": "v?l*e"}}
+//	{"regexp": {"field": "v[a-z]+e"}}
+//	{"fuzzy": {"field": {"value": "vlaue", "fuzziness": "AUTO", "prefix_length": 1, "max_expansions": 50}}}
+//	{"match_all": {}}
+//	{"bool": {"must": [...], "should": [...], "must_not": [...], "filter": [...], "minimum_should_match": 1}}
+
+// Parses a JSON query into the query tree the index runs per segment. Query text is
+// analyzed with the analyzer of the field it searches.
+func ParseQueryDSL(raw []byte, analyzers FieldAnalyzers) (Query, error) {
+
+	var clause map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &clause); err != nil {
+		return nil, &QueryError{Reason: "a query clause must be a JSON object"}
+	}
+
+	if len(clause) != 1 {
+		return nil, &QueryError{Reason: "a query clause must have exactly one query type"}
+	}
+
+	for typ, body := range clause {
+		switch typ {
+		case "match":
+			return parseMatchDSL(body, analyzers)
+		case "match_phrase":
+			return parseMatchPhraseDSL(body, analyzers)
+		case "term":
+			return parseTermDSL(body, analyzers)
+		case "terms":
+			return parseTermsDSL(body, analyzers)
+		case "range":
+			return parseRangeDSL(body, analyzers)
+		case "prefix", "wildcard", "regexp":
+			return parseMultiTermDSL(typ, body, analyzers)
+		case "fuzzy":
+			return parseFuzzyDSL(body, analyzers)
+		case "match_all":
+			return &MatchAllQuery{}, nil
+		case "bool":
+			return parseBoolDSL(body, analyzers)
+		default:
+			return nil, &QueryError{Reason: fmt.Sprintf("unknown query type %q", typ)}
+		}
+	}
+
+	return nil, nil
+}
+
+// Field level queries look like {"field": value}.
+func singleField(typ string, body json.RawMessage) (field string, val json.RawMessage, err error) {
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil || len(m) != 1 {
+		return "", nil, &QueryError{Reason: typ + " needs an object with exactly one field"}
+	}
+
+	for field, val := range m {
+		return field, val, nil
+	}
+	return "", nil, nil
+}
+
+// A field's value is either the bare query text, or an object holding it with options.
+func isObject(val json.RawMessage) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(val), []byte("{"))
+}
+
+func parseMatchDSL(body json.RawMessage, analyzers FieldAnalyzers) (Query, error) {
+
+	field, val, err := singleField("match", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts struct {
+		Query              string          `json:"query"`
+		Operator           string          `json:"operator"`
+		MinimumShouldMatch json.RawMessage `json:"minimum_should_match"`
+	}
+
+	if isObject(val) {
+		err = json.Unmarshal(val, &opts)
+	} else {
+		err = json.Unmarshal(val, &opts.Query)
+	}
+	if err != nil {
+		return nil, &QueryError{Reason: "match query on " + field + " must be a string or an object with a query"}
+	}
+
+	q := NewMatchQuery(GetTermsFromPhrase(analyzers, field, opts.Query))
+
+	switch strings.ToLower(opts.Operator) {
+	case "", "or":
+	case "and":
+		q.MinimumShouldMatch = len(q.Terms)
+	default:
+		return nil, &QueryError{Reason: "match operator must be \"and\" or \"or\""}
+	}
+
+	if opts.MinimumShouldMatch != nil {
+		q.MinimumShouldMatch, err = parseMinimumShouldMatch(opts.MinimumShouldMatch, len(q.Terms))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func parseMatchPhraseDSL(body json.RawMessage, analyzers FieldAnalyzers) (Query, error) {
+
+	field, val, err := singleField("match_phrase", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts struct {
+		Query string `json:"query"`
+		Slop  int    `json:"slop"`
+	}
+
+	if isObject(val) {
+		err = json.Unmarshal(val, &opts)
+	} else {
+		err = json.Unmarshal(val, &opts.Query)
+	}
+	if err != nil || opts.Slop < 0 {
+		return nil, &QueryError{Reason: "match_phrase query on " + field + " must be a string or an object with a query and a non negative slop"}
+	}
+
+	terms, positions := GetPhraseTerms(analyzers, field, opts.Query)
+	return NewPhraseQuery(terms, positions, opts.Slop), nil
+}
+
+// Term values are not split into words, only normalized like the field's values
+// (lowercased, or the canonical form of a number or date).
+func parseTermDSL(body json.RawMessage, analyzers FieldAnalyzers) (Query, error) {
+
+	field, val, err := singleField("term", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts struct {
+		Value interface{} `json:"value"`
+	}
+
+	if isObject(val) {
+		err = json.Unmarshal(val, &opts)
+	} else {
+		err = json.Unmarshal(val, &opts.Value)
+	}
+	if err != nil || opts.Value == nil {
+		return nil, &QueryError{Reason: "term query on " + field + " needs a value"}
+	}
+
+	value := analyzers.FieldAnalyzer(field).Normalize(fmt.Sprint(opts.Value))
+	return NewMatchQuery([]Term{NewTerm(field, value)}), nil
+}
+
+// Matches docs having any of the values.
+func parseTermsDSL(body json.RawMessage, analyzers FieldAnalyzers) (Query, error) {
+
+	field, val, err := singleField("terms", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+	if err = json.Unmarshal(val, &values); err != nil {
+		return nil, &QueryError{Reason: "terms query on " + field + " needs an array of values"}
+	}
+
+	terms := make([]Term, 0, len(values))
+	for _, v := range values {
+		terms = append(terms, NewTerm(field, analyzers.FieldAnalyzer(field).Normalize(fmt.Sprint(v))))
+	}
+
+	return NewMatchQuery(terms), nil
+}
+
+// Bounds are numbers, or strings for dates. A missing bound leaves that side open.
+func parseRangeDSL(body json.RawMessage, analyzers FieldAnalyzers) (Query, error) {
+
+	field, val, err := singleField("range", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var bounds map[string]json.RawMessage
+	if err = json.Unmarshal(val, &bounds); err != nil || len(bounds) == 0 {
+		return nil, &QueryError{Reason: "range query on " + field + " needs an object with gt, gte, lt or lte"}
+	}
+
+	var from, to string
+	var includeFrom, includeTo bool
+	for op, raw := range bounds {
+		var bound string
+		if err := json.Unmarshal(raw, &bound); err != nil {
+			// numbers are kept as written
+			bound = string(bytes.TrimSpace(raw))
+		}
+
+		switch op {
+		case "gt", "gte":
+			if from != "" {
+				return nil, &QueryError{Reason: "range query on " + field + " has both gt and gte"}
+			}
+			from, includeFrom = bound, op == "gte"
+		case "lt", "lte":
+			if to != "" {
+				return nil, &QueryError{Reason: "range query on " + field + " has both lt and lte"}
+			}
+			to, includeTo = bound, op == "lte"
+		default:
+			return nil, &QueryError{Reason: fmt.Sprintf("unknown range parameter %q", op)}
+		}
+
+		if bound == "" || bound == "null" {
+			return nil, &QueryError{Reason: "range query on " + field + " needs a value for " + op}
+		}
+	}
+
+	return NewRangeQuery(analyzers, field, from, to, includeFrom, includeTo)
+}
+
+// Values are strings, bare or as {"value": "..."}. Prefixes and wildcard patterns are
+// normalized like the field's values, regular expressions are used as written.
+func parseMultiTermDSL(typ string, body json.RawMessage, analyzers FieldAnalyzers) (Query, error) {
+
+	field, val, err := singleField(typ, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts struct {
+		Value string `json:"value"`
+	}
+
+	if isObject(val) {
+		err = json.Unmarshal(val, &opts)
+	} else {
+		err = json.Unmarshal(val, &opts.Value)
+	}
+	if err != nil || opts.Value == "" {
+		return nil, &QueryError{Reason: typ + " query on " + field + " needs a string value"}
+	}
+
+	switch typ {
+	case "prefix":
+		return &PrefixQuery{Field: field, Prefix: analyzers.FieldAnalyzer(field).Normalize(opts.Value)}, nil
+	case "wildcard":
+		return NewWildcardQuery(field, analyzers.FieldAnalyzer(field).Normalize(opts.Value)), nil
+	default:
+		return NewRegexpQuery(field, opts.Value)
+	}
+}
+
+// The value is normalized like the field's values. fuzziness is 0, 1, 2 or "AUTO", the
+// default, which allows more edits for longer values.
+func parseFuzzyDSL(body json.RawMessage, analyzers FieldAnalyzers) (Query, error) {
+
+	field, val, err := singleField("fuzzy", body)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := struct {
+		Value          string          `json:"value"`
+		Fuzziness      json.RawMessage `json:"fuzziness"`
+		PrefixLength   int             `json:"prefix_length"`
+		MaxExpansions  int             `json:"max_expansions"`
+		Transpositions bool            `json:"transpositions"`
+	}{MaxExpansions: DefaultFuzzyMaxExpansions, Transpositions: true}
+
+	if isObject(val) {
+		err = json.Unmarshal(val, &opts)
+	} else {
+		err = json.Unmarshal(val, &opts.Value)
+	}
+	if err != nil || opts.Value == "" {
+		return nil, &QueryError{Reason: "fuzzy query on " + field + " needs a string value"}
+	}
+	if opts.PrefixLength < 0 || opts.MaxExpansions <= 0 {
+		return nil, &QueryError{Reason: "fuzzy query on " + field + " needs a non negative prefix_length and a positive max_expansions"}
+	}
+
+	value := analyzers.FieldAnalyzer(field).Normalize(opts.Value)
+
+	edits := autoFuzziness(value)
+	if opts.Fuzziness != nil {
+		var fuzziness string
+		if err := json.Unmarshal(opts.Fuzziness, &fuzziness); err != nil {
+			fuzziness = string(bytes.TrimSpace(opts.Fuzziness))
+		}
+		if !strings.EqualFold(fuzziness, "auto") {
+			n, err := strconv.Atoi(fuzziness)
+			if err != nil || n < 0 || n > MaxFuzzyEdits {
+				return nil, &QueryError{Reason: fmt.Sprintf("fuzziness must be \"AUTO\" or between 0 and %d", MaxFuzzyEdits)}
+			}
+			edits = n
+		}
+	}
+
+	q := NewFuzzyQuery(field, value, edits)
+	q.PrefixLength = opts.PrefixLength
+	q.MaxExpansions = opts.MaxExpansions
+	q.Transpositions = opts.Transpositions
+	return q, nil
+}
+
+func parseBoolDSL(body json.RawMessage, analyzers FieldAnalyzers) (Query, error) {
+
+	var opts struct {
+		Must               json.RawMessage `json:"must"`
+		Should             json.RawMessage `json:"should"`
+		MustNot            json.RawMessage `json:"must_not"`
+		Filter             json.RawMessage `json:"filter"`
+		MinimumShouldMatch json.RawMessage `json:"minimum_should_match"`
+	}
+
+	if err := json.Unmarshal(body, &opts); err != nil {
+		return nil, &QueryError{Reason: "bool query must be an object"}
+	}
+
+	q := &BoolQuery{}
+	var err error
+
+	if q.Must, err = parseClauses("must", opts.Must, analyzers); err != nil {
+		return nil, err
+	}
+	if q.Should, err = parseClauses("should", opts.Should, analyzers); err != nil {
+		return nil, err
+	}
+	if q.MustNot, err = parseClauses("must_not", opts.MustNot, analyzers); err != nil {
+		return nil, err
+	}
+	if q.Filter, err = parseClauses("filter", opts.Filter, analyzers); err != nil {
+		return nil, err
+	}
+
+	// like Elasticsearch, should clauses are optional once something else is required
+	if len(q.Must) == 0 && len(q.Filter) == 0 {
+		q.MinimumShouldMatch = 1
+	}
+
+	if opts.MinimumShouldMatch != nil {
+		q.MinimumShouldMatch, err = parseMinimumShouldMatch(opts.MinimumShouldMatch, len(q.Should))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// Bool clauses take a single query or an array of them.
+func parseClauses(occur string, raw json.RawMessage, analyzers FieldAnalyzers) (queries []Query, err error) {
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	var list []json.RawMessage
+	if isObject(raw) {
+		list = []json.RawMessage{raw}
+	} else if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, &QueryError{Reason: occur + " must be a query or an array of queries"}
+	}
+
+	for _, clause := range list {
+		q, err := ParseQueryDSL(clause, analyzers)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+
+	return queries, nil
+}
+
+// minimum_should_match is a count, or a percentage of the optional clauses like "75%".
+func parseMinimumShouldMatch(raw json.RawMessage, optional int) (int, error) {
+
+	var n int
+	if err := json.Unmarshal(raw, &n); err == nil && n >= 0 {
+		return n, nil
+	}
+
+	var pct string
+	if err := json.Unmarshal(raw, &pct); err == nil {
+		if p, err := strconv.Atoi(strings.TrimSuffix(pct, "%")); err == nil && p >= 0 && p <= 100 {
+			return optional * p / 100, nil
+		}
+	}
+
+	return 0, &QueryError{Reason: "minimum_should_match must be a non negative count or a percentage"}
+}
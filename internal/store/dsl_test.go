@@ -0,0 +1,111 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestBoolQueryDSL(t *testing.T) {
+	f, idx := newTestFSM(t)
+
+	// docs 0 to 2 are read from a segment file, the others from the active segment
+	docs := []struct {
+		title string
+		price int
+	}{
+		{"iron sword", 5},
+		{"steel sword", 20},
+		{"steel axe", 30},
+		{"wooden sword", 1},
+		{"steel shield", 50},
+		{"bronze axe", 15},
+	}
+	for docID, d := range docs {
+		applyTestAdd(t, f, docID, fmt.Sprintf(`{"title": %q, "price": %d}`, d.title, d.price), uint64(docID+1))
+		if docID == 2 {
+			if err := idx.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		q    string
+		want []int
+	}{
+		{`{"bool": {"must": {"match": {"title": "sword"}}}}`, []int{0, 1, 3}},
+		{`{"bool": {"must": {"match": {"title": "sword"}}, "filter": {"range": {"price": {"gte": 10}}}}}`, []int{1}},
+		{`{"bool": {"filter": [{"range": {"price": {"lt": 20}}}]}}`, []int{0, 3, 5}},
+		{`{"bool": {"must": {"match": {"title": "steel"}}, "must_not": {"match": {"title": "axe"}}}}`, []int{1, 4}},
+		{`{"bool": {"must_not": {"match": {"title": "sword"}}}}`, []int{2, 4, 5}},
+		{`{"bool": {"should": [{"match": {"title": "sword"}}, {"match": {"title": "axe"}}]}}`, []int{0, 1, 2, 3, 5}},
+		// should clauses are optional next to a must clause, unless minimum_should_match says otherwise
+		{`{"bool": {"must": {"match": {"title": "steel"}}, "should": {"match": {"title": "sword"}}}}`, []int{1, 2, 4}},
+		{`{"bool": {"must": {"match": {"title": "steel"}}, "should": {"match": {"title": "sword"}}, "minimum_should_match": 1}}`, []int{1}},
+		{`{"bool": {"should": [{"match": {"title": "steel"}}, {"match": {"title": "sword"}}, {"match": {"title": "axe"}}], "minimum_should_match": 2}}`, []int{1, 2}},
+		{`{"bool": {"should": [{"match": {"title": "steel"}}, {"match": {"title": "sword"}}, {"match": {"title": "axe"}}], "minimum_should_match": "67%"}}`, []int{1, 2}},
+		{`{"bool": {"should": [{"bool": {"must": {"match": {"title": "steel"}}, "must_not": {"match": {"title": "sword"}}}}, {"term": {"title": "wooden"}}]}}`, []int{2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		q, err := ParseQueryDSL([]byte(tt.q), idx)
+		if err != nil {
+			t.Errorf("%s: %v", tt.q, err)
+			continue
+		}
+		if got := searchIDs(t, idx, q, SearchOptions{}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.q, got, tt.want)
+		}
+	}
+
+	// filter clauses do not score
+	scores := func(raw string) map[int]float64 {
+		q, err := ParseQueryDSL([]byte(raw), idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranked, _, err := idx.rank(q, SearchOptions{}, MaxResultWindow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scores := make(map[int]float64)
+		for _, d := range ranked {
+			scores[d.DocID] = d.Score
+		}
+		return scores
+	}
+	filtered := scores(`{"bool": {"must": {"match": {"title": "steel"}}, "filter": {"match": {"title": "sword"}}}}`)
+	if got, want := filtered[1], scores(`{"match": {"title": "steel"}}`)[1]; got != want {
+		t.Errorf("doc 1 scores %v with a filter, want %v", got, want)
+	}
+}
+
+func TestBoolQueryDSLErrors(t *testing.T) {
+	idx := newQueryTestIndex()
+
+	tests := []struct {
+		q      string
+		reason string
+	}{
+		{`{"bool": []}`, "bool query must be an object"},
+		{`{"bool": {"must": 1}}`, "must must be a query or an array of queries"},
+		{`{"bool": {"filter": [{}]}}`, "a query clause must have exactly one query type"},
+		{`{"bool": {"must_not": ["sword"]}}`, "a query clause must be a JSON object"},
+		{`{"bool": {"should": {"match": {"title": "sword"}}, "minimum_should_match": "most"}}`, "minimum_should_match must be a non negative count or a percentage"},
+		{`{"bool": {"should": {"match": {"title": "sword"}}, "minimum_should_match": -1}}`, "minimum_should_match must be a non negative count or a percentage"},
+		{`{"bool": {"should": {"match": {"title": "sword"}}, "minimum_should_match": "150%"}}`, "minimum_should_match must be a non negative count or a percentage"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseQueryDSL([]byte(tt.q), idx)
+		qerr, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("%s: got %v, want a query error", tt.q, err)
+			continue
+		}
+		if qerr.Reason != tt.reason {
+			t.Errorf("%s: got %q, want %q", tt.q, qerr.Reason, tt.reason)
+		}
+	}
+}
@@ -1,14 +1,68 @@
 package store
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrDocumentNotFound error = errors.New("document not found")
 	ErrCannotEncodeDoc  error = errors.New("could not encode given document")
 	ErrDocFileWrite     error = errors.New("error writing doc bytes to segment file")
+	ErrTermNotFound     error = errors.New("no documents contain given term")
+	ErrSegmentNotFound  error = errors.New("segment to merge not found")
+	ErrMergeInProgress  error = errors.New("another merge of the index is in progress")
+	ErrMergeNotFound    error = errors.New("merge to commit not found")
+	ErrCorruptSegment   error = errors.New("segment file is corrupt")
+	ErrSegmentVersion   error = errors.New("unsupported segment file version")
+	ErrCorruptSnapshot  error = errors.New("snapshot is corrupt")
+	ErrDocumentChecksum error = errors.New("document does not match its checksum")
+
+	ErrUnknownAnalyzer    error = errors.New("unknown analyzer")
+	ErrUnknownTokenizer   error = errors.New("unknown tokenizer")
+	ErrUnknownTokenFilter error = errors.New("unknown token filter")
+	ErrInvalidMapping     error = errors.New("invalid mapping")
+
+	ErrPITNotFound      error = errors.New("point in time not found or expired")
+	ErrInvalidKeepAlive error = errors.New("keep alive must be positive and at most 24h")
 
 	ErrIdxNameExists   error = errors.New("index name already exists")
 	ErrIdxDoesNotExist error = errors.New("index with specified name does not exist")
 
 	ErrNotLeader error = errors.New("node not a leader")
+	ErrNoLeader  error = errors.New("no leader detected")
+
+	ErrIndexNotApplied error = errors.New("log index not applied on this node in time")
+
+	ErrNodeNotFound error = errors.New("node is not a member of the cluster")
+	ErrLastVoter    error = errors.New("cannot remove or demote the last voter of the cluster")
+	ErrInvalidRole  error = errors.New("role must be voter or nonvoter")
+	ErrNotVoter     error = errors.New("leadership can only be transferred to a voter")
 )
+
+// Returned for a search query that cannot be parsed.
+type QueryError struct {
+	Reason string
+	// column (starting at 1) of a query string the error was found at, 0 for JSON queries
+	Position int
+}
+
+func (e *QueryError) Error() string {
+	if e.Position > 0 {
+		return fmt.Sprintf("invalid query: %s at position %d", e.Reason, e.Position)
+	}
+	return "invalid query: " + e.Reason
+}
+
+// Returned for a document that does not match the index's mapping.
+type MappingError struct {
+	Field  string
+	Reason string
+}
+
+func (e *MappingError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("field %q: %s", e.Field, e.Reason)
+}
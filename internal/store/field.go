@@ -3,15 +3,19 @@ package store
 type FieldType int
 
 const (
-	StringField FieldType = iota
-	IntField
+	TextField FieldType = iota
+	KeywordField
+	IntegerField
+	FloatField
+	BooleanField
+	DateField
 )
 
-// Currently only single level. For multilevel fields, value can be another doc?
+// Nested fields are flattened into dotted names, and a multi-valued field is one Field per value.
+// Value is the text of text fields, and the canonical form of the value for the other types.
 type Field struct {
-	ID              int
-	Name            string
-	Type            FieldType
-	TokenizerString string
-	Value           string
+	ID    int
+	Name  string
+	Type  FieldType
+	Value string
 }
@@ -0,0 +1,218 @@
+package store
+
+import (
+	"sort"
+	"strings"
+)
+
+// Matches docs having a term of the field within MaxEdits edits of Value. Like Lucene,
+// a closer term scores more: 1 - edits / length of the shorter term.
+//
+// Terms have to start with the first PrefixLength characters of Value as they are, and only
+// the MaxExpansions closest terms of a segment are searched. The segment's sorted terms are
+// read through a Levenshtein automaton of the rest of Value, which skips every term starting
+// with characters that are already too far from it.
+type FuzzyQuery struct {
+	Field         string
+	Value         string
+	MaxEdits      int
+	PrefixLength  int
+	MaxExpansions int
+	// swapping two adjacent characters counts as one edit rather than two
+	Transpositions bool
+}
+
+// Lucene does not go further than 2 edits either, past that almost everything matches
+const MaxFuzzyEdits = 2
+
+// Like Elasticsearch's max_expansions
+const DefaultFuzzyMaxExpansions = 50
+
+func NewFuzzyQuery(field, value string, maxEdits int) *FuzzyQuery {
+	return &FuzzyQuery{
+		Field:          field,
+		Value:          value,
+		MaxEdits:       maxEdits,
+		MaxExpansions:  DefaultFuzzyMaxExpansions,
+		Transpositions: true,
+	}
+}
+
+// Edits allowed for a value by Elasticsearch's AUTO fuzziness: none for up to 2
+// characters, 1 for up to 5 and 2 for longer ones.
+func autoFuzziness(value string) int {
+	switch n := len([]rune(value)); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return MaxFuzzyEdits
+	}
+}
+
+func (q *FuzzyQuery) ScoringTerms() []Term {
+	return nil
+}
+
+type fuzzyExpansion struct {
+	text     string
+	edits    int
+	postings func() TermData
+}
+
+func (q *FuzzyQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+	hits := make(map[int]float64)
+	value := []rune(q.Value)
+
+	prefixLen := min(max(q.PrefixLength, 0), len(value))
+	a := newLevenshteinAutomaton(value[prefixLen:], q.MaxEdits, q.Transpositions)
+
+	// the terms starting with the prefix are next to each other in the sorted dictionary,
+	// the automaton reads the rest of them
+	termPrefix := NewTerm(q.Field, string(value[:prefixLen]))
+
+	var expansions []fuzzyExpansion
+	states := []levenshteinState{a.start()}
+	var prevRest []rune
+
+	it := seg.TermDict.iterator()
+	for ok := it.seekCeil(termPrefix); ok; {
+		t, postings := it.current()
+		text, found := strings.CutPrefix(string(t), string(termPrefix))
+		if !found {
+			break
+		}
+		rest := []rune(text)
+
+		// states of the characters the term shares with the one before are kept
+		common := 0
+		for common < min(len(rest), len(prevRest)) && rest[common] == prevRest[common] {
+			common++
+		}
+		states = states[:common+1]
+
+		dead := -1
+		for i := common; i < len(rest); i++ {
+			s := a.step(states[i], rest[i])
+			if !a.canMatch(s) {
+				dead = i
+				break
+			}
+			states = append(states, s)
+		}
+
+		if dead >= 0 {
+			// no term starting with rest[:dead+1] is close enough, go past all of them
+			prevRest = rest[:dead]
+			end, more := prefixEnd(string(rest[:dead+1]))
+			ok = more && it.seekCeil(termPrefix+Term(end))
+			continue
+		}
+
+		prevRest = rest
+		if edits := a.distance(states[len(rest)]); edits <= q.MaxEdits {
+			expansions = append(expansions, fuzzyExpansion{text: text, edits: edits, postings: postings})
+		}
+		ok = it.next()
+	}
+
+	// closest terms first, like Lucene's top terms rewrite
+	sort.SliceStable(expansions, func(i, j int) bool {
+		return expansions[i].edits < expansions[j].edits
+	})
+	if q.MaxExpansions > 0 && len(expansions) > q.MaxExpansions {
+		expansions = expansions[:q.MaxExpansions]
+	}
+
+	for _, e := range expansions {
+		score := 1.0
+		if shorter := min(len(value), prefixLen+len([]rune(e.text))); shorter > 0 {
+			score = max(1-float64(e.edits)/float64(shorter), 0)
+		}
+
+		for docID := range e.postings() {
+			if !seg.isDeleted(docID) && score >= hits[docID] {
+				hits[docID] = score
+			}
+		}
+	}
+
+	return hits, nil
+}
+
+// Levenshtein automaton of a term, accepting the strings within maxEdits edits of it. It
+// is run a character at a time rather than built: a state is the row of the edit distance
+// matrix between the term and the characters read so far, with the row before it and the
+// last character for transpositions.
+type levenshteinAutomaton struct {
+	term           []rune
+	maxEdits       int
+	transpositions bool
+}
+
+type levenshteinState struct {
+	row, prev []int
+	last      rune
+}
+
+func newLevenshteinAutomaton(term []rune, maxEdits int, transpositions bool) *levenshteinAutomaton {
+	return &levenshteinAutomaton{term: term, maxEdits: maxEdits, transpositions: transpositions}
+}
+
+func (a *levenshteinAutomaton) start() levenshteinState {
+	row := make([]int, len(a.term)+1)
+	for j := range row {
+		row[j] = min(j, a.maxEdits+1)
+	}
+	return levenshteinState{row: row}
+}
+
+func (a *levenshteinAutomaton) step(s levenshteinState, c rune) levenshteinState {
+	row := make([]int, len(a.term)+1)
+	row[0] = min(s.row[0]+1, a.maxEdits+1)
+
+	for j := 1; j <= len(a.term); j++ {
+		cost := 1
+		if a.term[j-1] == c {
+			cost = 0
+		}
+		row[j] = min(s.row[j]+1, row[j-1]+1, s.row[j-1]+cost)
+
+		if a.transpositions && s.prev != nil && j > 1 && a.term[j-1] == s.last && a.term[j-2] == c {
+			row[j] = min(row[j], s.prev[j-2]+1)
+		}
+		// every distance past maxEdits is as bad, capping them keeps the states few
+		row[j] = min(row[j], a.maxEdits+1)
+	}
+
+	return levenshteinState{row: row, prev: s.row, last: c}
+}
+
+// Edit distance between the term and what was read.
+func (a *levenshteinAutomaton) distance(s levenshteinState) int {
+	return s.row[len(a.term)]
+}
+
+// False once no string starting with what was read can be within maxEdits. A transposition
+// can only bring the distance back to what the row already allows, so the row is enough.
+func (a *levenshteinAutomaton) canMatch(s levenshteinState) bool {
+	for _, d := range s.row {
+		if d <= a.maxEdits {
+			return true
+		}
+	}
+	return false
+}
+
+// Smallest string after every string starting with prefix, false if there is none.
+func prefixEnd(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Edit distance by the full matrix, counting a swap of adjacent characters as one edit
+// with transpositions (optimal string alignment, like Lucene).
+func editDistance(a, b []rune, transpositions bool) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if transpositions && i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func randomWord(r *rand.Rand, alphabet []rune, maxLen int) []rune {
+	w := make([]rune, r.Intn(maxLen+1))
+	for i := range w {
+		w[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return w
+}
+
+func TestLevenshteinAutomaton(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	alphabet := []rune("abcé")
+
+	for i := 0; i < 20000; i++ {
+		term, word := randomWord(r, alphabet, 6), randomWord(r, alphabet, 8)
+		maxEdits := r.Intn(MaxFuzzyEdits + 1)
+		transpositions := r.Intn(2) == 0
+
+		a := newLevenshteinAutomaton(term, maxEdits, transpositions)
+		s := a.start()
+		dead := false
+		for _, c := range word {
+			if s = a.step(s, c); !a.canMatch(s) {
+				dead = true
+				break
+			}
+		}
+
+		want := editDistance(term, word, transpositions)
+		if dead {
+			if want <= maxEdits {
+				t.Fatalf("%q %q with %d edits: stopped early, distance is %d", string(term), string(word), maxEdits, want)
+			}
+		} else if got := a.distance(s); got != min(want, maxEdits+1) {
+			t.Fatalf("%q %q with %d edits: got %d, want %d", string(term), string(word), maxEdits, got, want)
+		}
+	}
+}
+
+func TestFuzzyQueryMatchesEditDistance(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	alphabet := []rune("abcdé")
+
+	// one doc per distinct word, its ID the word's position
+	var words []string
+	seen := make(map[string]bool)
+	for len(words) < 2000 {
+		w := string(randomWord(r, alphabet, 7))
+		if w != "" && !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	sort.Strings(words)
+
+	terms := make([]Term, len(words))
+	for i, w := range words {
+		terms[i] = NewTerm("content", w)
+	}
+	var buf bytes.Buffer
+	writeSegmentFile(&buf, terms, func(t Term) TermData {
+		i := sort.Search(len(terms), func(i int) bool { return terms[i] >= t })
+		return TermData{i: {0}}
+	}, docColumns{})
+	sf, err := parseSegmentFile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := NewIndex("test", false, DefaultIndexSettings(), nil)
+	fileSeg, _ := NewSegment("seg_1", idx)
+	fileSeg.TermDict = TermDictionary{file: sf}
+	memSeg, _ := NewSegment("seg_2", idx)
+	memSeg.TermDict = sf.inMemory()
+
+	for i := 0; i < 300; i++ {
+		value := randomWord(r, alphabet, 7)
+		q := NewFuzzyQuery("content", string(value), r.Intn(MaxFuzzyEdits+1))
+		q.PrefixLength = r.Intn(3)
+		q.Transpositions = r.Intn(2) == 0
+		q.MaxExpansions = 0
+
+		prefixLen := min(q.PrefixLength, len(value))
+		want := make(map[int]float64)
+		for docID, w := range words {
+			word := []rune(w)
+			if len(word) < prefixLen || string(word[:prefixLen]) != string(value[:prefixLen]) {
+				continue
+			}
+			edits := editDistance(value[prefixLen:], word[prefixLen:], q.Transpositions)
+			if edits > q.MaxEdits {
+				continue
+			}
+			want[docID] = 1.0
+			if shorter := min(len(value), len(word)); shorter > 0 {
+				want[docID] = max(1-float64(edits)/float64(shorter), 0)
+			}
+		}
+
+		for _, seg := range []*Segment{fileSeg, memSeg} {
+			got, err := q.Search(seg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s %+v: got %d hits, want %d", seg.Name, *q, len(got), len(want))
+			}
+		}
+	}
+}
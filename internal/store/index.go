@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"gocene/config"
 	"log"
-	"os"
 	"sync"
 
 	"github.com/minio/minio-go/v7"
@@ -14,28 +13,151 @@ type Index struct {
 	Name     string
 	Segments []*Segment
 
-	DocList *os.File
-	// separate counter will make merging segments in the future easier
-	SegCount  int
+	// separate counter, merged segments get new names from it too
+	SegCount int
+	// one past the highest doc ID applied, guarded by reserveMu
 	NextDocID int
 
 	CaseSensitivity bool
-	Mutex           sync.RWMutex
-	As              ActiveSegment
+	// Settings.Mapping changes with dynamic mapping, guarded by mappingMu
+	Settings       IndexSettings
+	mappingMu      sync.RWMutex
+	analyzer       Analyzer
+	fieldAnalyzers map[string]Analyzer
+	Mutex          sync.RWMutex
+	As             ActiveSegment
+
+	// merge started but not swapped in yet, guarded by Mutex
+	merge *pendingMerge
+
+	// blobs no doc may have anymore, with the last log entry referring to each, see blobs.go
+	orphanBlobs map[string]uint64
+	blobMu      sync.Mutex
+
+	// point in time views opened on this node, by ID
+	pits  map[string]*pointInTime
+	pitMu sync.Mutex
+
+	// leader only, next doc ID not yet handed out to an add in flight, guarded by reserveMu
+	reservedDocID int
+	reserveMu     sync.Mutex
 
 	mc *minio.Client
 }
 
-func NewIndex(name string, cs bool, mc *minio.Client) *Index {
+func NewIndex(name string, cs bool, settings IndexSettings, mc *minio.Client) *Index {
 	temp := &Index{
 		Name:            name,
 		Segments:        nil,
 		CaseSensitivity: cs,
+		Settings:        settings,
+		orphanBlobs:     make(map[string]uint64),
 		mc:              mc,
 	}
+
+	// settings are validated before they are replicated, fall back to the default just in case
+	var err error
+	if temp.analyzer, temp.fieldAnalyzers, err = settings.buildAnalyzers(cs); err != nil {
+		log.Printf("index %s: %v, using the %s analyzer\n", name, err, DefaultAnalyzer)
+		temp.analyzer, _ = NewAnalyzer(DefaultAnalyzer, cs)
+	}
+
+	// start with an empty active segment so a fresh index can be snapshotted
+	temp.As, _ = NewActiveSegment("seg_0", temp)
 	return temp
 }
 
+// Analyzer of the field's values, also used for the query text searching it.
+// Fields of types other than text are a single term in their canonical form.
+func (idx *Index) FieldAnalyzer(field string) Analyzer {
+	idx.mappingMu.RLock()
+	fm, mapped := idx.Settings.Mapping.Properties[field]
+	idx.mappingMu.RUnlock()
+
+	if mapped && fm.Type != TypeText {
+		return typedAnalyzer{fieldType: fm.Type}
+	}
+	if a, ok := idx.fieldAnalyzers[field]; ok {
+		return a
+	}
+	return idx.analyzer
+}
+
+// Builds a document from its JSON with the index's mapping, adding the fields dynamic
+// mapping infers for it. Only called when applying to the FSM, so every node maps new
+// fields the same way.
+func (idx *Index) CreateDocumentFromJSON(jsonString string) (*Document, error) {
+
+	obj, err := decodeDocument(jsonString)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mappingMu.Lock()
+	defer idx.mappingMu.Unlock()
+
+	doc, newFields, err := idx.Settings.Mapping.createDocument(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(newFields) > 0 && idx.Settings.Mapping.Properties == nil {
+		idx.Settings.Mapping.Properties = make(map[string]FieldMapping, len(newFields))
+	}
+	for field, fm := range newFields {
+		idx.Settings.Mapping.Properties[field] = fm
+	}
+
+	return doc, nil
+}
+
+// Checks a document against the current mapping before it is written, without mapping
+// any new fields.
+func (idx *Index) ValidateDocument(obj map[string]any) error {
+	idx.mappingMu.RLock()
+	defer idx.mappingMu.RUnlock()
+
+	_, _, err := idx.Settings.Mapping.createDocument(obj)
+	return err
+}
+
+// The document as returned to clients, without the fields that are not stored.
+func (idx *Index) StoredSource(source []byte) []byte {
+	idx.mappingMu.RLock()
+	defer idx.mappingMu.RUnlock()
+
+	return idx.Settings.Mapping.storedSource(source)
+}
+
+// Settings with a copy of the mapping, which keeps changing after a snapshot is taken.
+func (idx *Index) settingsCopy() IndexSettings {
+	idx.mappingMu.RLock()
+	defer idx.mappingMu.RUnlock()
+
+	settings := idx.Settings
+	settings.Mapping = idx.Settings.Mapping.copy()
+	return settings
+}
+
+// One past the highest doc ID applied, no doc was ever indexed under an ID from it on.
+func (idx *Index) GetNextDocID() int {
+	idx.reserveMu.Lock()
+	defer idx.reserveMu.Unlock()
+	return idx.NextDocID
+}
+
+// Hands out n consecutive doc IDs on the leader. NextDocID only moves once an add is
+// applied, so concurrent adds reading it directly would be given the same IDs.
+func (idx *Index) ReserveDocIDs(n int) (start int) {
+	idx.reserveMu.Lock()
+	defer idx.reserveMu.Unlock()
+
+	start = max(idx.NextDocID, idx.reservedDocID)
+	idx.reservedDocID = start + n
+	return start
+}
+
+// Indexes the doc under doc.ID, which was reserved by the leader.
 // Needs to use mutex to handle concurrent events for index.
 func (idx *Index) AddDocument(doc *Document) (id int, err error) {
 
@@ -48,8 +170,10 @@ func (idx *Index) AddDocument(doc *Document) (id int, err error) {
 		}
 	}
 
-	doc.ID = idx.NextDocID
-	id, err = idx.As.AddDocument(doc)
+	if _, err = idx.As.AddDocument(doc); err != nil {
+		return
+	}
+	id = doc.ID
 
 	// add to segments if active segment full
 	if idx.As.Seg.DocCount >= config.ActiveSegmentCount {
@@ -60,10 +184,65 @@ func (idx *Index) AddDocument(doc *Document) (id int, err error) {
 		}
 	}
 
-	idx.NextDocID++
+	// reserved IDs can be applied out of order
+	idx.reserveMu.Lock()
+	idx.NextDocID = max(idx.NextDocID, doc.ID+1)
+	idx.reserveMu.Unlock()
 	return
 }
 
+// Replaces a doc with a new version under the same ID. The old postings are tombstoned
+// in whichever immutable segment holds them, or dropped if they are still in the active
+// segment, and the new version is indexed into the active segment.
+func (idx *Index) ModifyDocument(doc *Document) (id int, err error) {
+
+	idx.Mutex.RLock()
+	found := false
+	for _, seg := range idx.Segments {
+		if seg.Tombstone(doc.ID) {
+			found = true
+		}
+	}
+	if !found && idx.As.Seg != nil && idx.As.RemoveDocument(doc.ID) {
+		found = true
+	}
+	idx.Mutex.RUnlock()
+
+	if !found {
+		return 0, ErrDocumentNotFound
+	}
+
+	if _, err = idx.As.AddDocument(doc); err != nil {
+		return
+	}
+
+	// add to segments if active segment full
+	if idx.As.Seg.DocCount >= config.ActiveSegmentCount {
+		err = idx.Refresh()
+		if err != nil {
+			log.Println("could not refresh() index ", idx.Name)
+			return
+		}
+	}
+
+	return doc.ID, nil
+}
+
+// Returns true if a live (not deleted) copy of the doc is held by any segment.
+func (idx *Index) HasDocument(docID int) bool {
+
+	idx.Mutex.RLock()
+	defer idx.Mutex.RUnlock()
+
+	for _, seg := range idx.Segments {
+		if seg.HasLiveDocument(docID) {
+			return true
+		}
+	}
+
+	return idx.As.Seg != nil && idx.As.Seg.HasLiveDocument(docID)
+}
+
 // Loading existing documents, without appending
 func (idx *Index) LoadDocument(doc *Document) (id int, err error) {
 
@@ -90,21 +269,70 @@ func (idx *Index) LoadDocument(doc *Document) (id int, err error) {
 	return
 }
 
+// Releases the index's segments once a snapshot restore replaced it. Their files stay in the
+// data directory, where the restored index may have written its own under the same names.
+func (idx *Index) close() {
+	idx.Mutex.Lock()
+	for _, seg := range idx.Segments {
+		seg.close()
+	}
+	idx.Segments = nil
+	pm := idx.merge
+	idx.merge = nil
+	idx.Mutex.Unlock()
+
+	if pm != nil {
+		go func() {
+			<-pm.done
+			pm.merged.close()
+		}()
+	}
+
+	idx.pitMu.Lock()
+	for id, pit := range idx.pits {
+		pit.close()
+		delete(idx.pits, id)
+	}
+	idx.pitMu.Unlock()
+}
+
 // Flushes active segment to segments list to be immutable and search efficient.
 func (idx *Index) Refresh() (err error) {
 
+	// written before locking, only applying to the FSM changes the active segment
+	sealed := idx.As.Seg.sealed()
+
 	idx.Mutex.Lock()
 	defer idx.Mutex.Unlock()
 
-	idx.Segments = append(idx.Segments, idx.As.Seg)
+	idx.Segments = append(idx.Segments, sealed)
 	idx.SegCount++
 	idx.As, err = NewActiveSegment("seg_"+fmt.Sprint(idx.SegCount), idx)
 
 	return
 }
 
-// finish later
+// Tombstones the doc in every segment holding a live copy of it.
+// The postings stay in the segments until they are merged.
 func (idx *Index) DeleteDocument(docID int) (err error) {
 
-	return
+	idx.Mutex.RLock()
+	defer idx.Mutex.RUnlock()
+
+	found := false
+	for _, seg := range idx.Segments {
+		if seg.Tombstone(docID) {
+			found = true
+		}
+	}
+
+	if idx.As.Seg != nil && idx.As.Seg.Tombstone(docID) {
+		found = true
+	}
+
+	if !found {
+		return ErrDocumentNotFound
+	}
+
+	return nil
 }
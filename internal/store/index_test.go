@@ -0,0 +1,169 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gocene/config"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// A node's FSM with one index of the query test mapping, whose active segment is only
+// sealed by Refresh, and segment files in a temporary data directory.
+func newTestFSM(t *testing.T) (*fsm, *Index) {
+	activeSegmentCount, dataDir := config.ActiveSegmentCount, config.IndexDataDirectory
+	config.ActiveSegmentCount, config.IndexDataDirectory = 1000, t.TempDir()
+	t.Cleanup(func() {
+		config.ActiveSegmentCount, config.IndexDataDirectory = activeSegmentCount, dataDir
+	})
+
+	idx := newQueryTestIndex()
+	return &fsm{ActiveIndices: map[string]*Index{idx.Name: idx}}, idx
+}
+
+// A payload carrying the body inline, like the leader replicates small docs.
+func testPayload(body string) []DocumentPayload {
+	sum := sha256.Sum256([]byte(body))
+	return []DocumentPayload{{Data: json.RawMessage(body), SHA256: hex.EncodeToString(sum[:])}}
+}
+
+// Applies adding the doc at log entry logIndex.
+func applyTestAdd(t *testing.T, f *fsm, docID int, body string, logIndex uint64) {
+	if err, ok := f.ApplyAddDocument("test", docID, testPayload(body), logIndex).(error); ok {
+		t.Fatalf("adding doc %d: %v", docID, err)
+	}
+}
+
+func titleQuery(word string) Query {
+	return NewMatchQuery([]Term{NewTerm("title", word)})
+}
+
+// IDs of the docs matching the query, in ascending order.
+func searchIDs(t *testing.T, idx *Index, q Query, opts SearchOptions) []int {
+	ranked, _, err := idx.rank(q, opts, MaxResultWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, d := range ranked {
+		ids = append(ids, d.DocID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestDeleteDocument(t *testing.T) {
+	f, idx := newTestFSM(t)
+
+	titles := []string{"iron sword", "steel sword", "wooden sword", "steel axe", "bronze sword", "sword"}
+	for docID, title := range titles {
+		applyTestAdd(t, f, docID, `{"title": "`+title+`"}`, uint64(docID+1))
+		if docID == 3 {
+			if err := idx.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		docID int
+		err   error
+		// docs matching sword once it is applied
+		want []int
+	}{
+		{"in an immutable segment", 1, nil, []int{0, 2, 4, 5}},
+		{"in the active segment", 4, nil, []int{0, 2, 5}},
+		{"already deleted", 1, ErrDocumentNotFound, []int{0, 2, 5}},
+		{"never added", 42, ErrDocumentNotFound, []int{0, 2, 5}},
+	}
+
+	logIndex := uint64(len(titles))
+	for _, tt := range tests {
+		logIndex++
+		if err := f.ApplyDeleteDocument("test", tt.docID, logIndex); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+		if got := searchIDs(t, idx, titleQuery("sword"), SearchOptions{}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sword matches %v, want %v", tt.name, got, tt.want)
+		}
+		if idx.HasDocument(tt.docID) {
+			t.Errorf("%s: doc %d is still there", tt.name, tt.docID)
+		}
+		if tt.err != nil {
+			continue
+		}
+		// the body is left without a doc once the entry is compacted
+		sha := testPayload(`{"title": "` + titles[tt.docID] + `"}`)[0].SHA256
+		if got := idx.orphanBlobs[sha]; got != logIndex {
+			t.Errorf("%s: body orphaned at entry %d, want %d", tt.name, got, logIndex)
+		}
+	}
+}
+
+func TestModifyDocument(t *testing.T) {
+	f, idx := newTestFSM(t)
+
+	titles := []string{"iron sword", "steel sword", "wooden sword", "steel axe", "bronze sword", "sword"}
+	for docID, title := range titles {
+		applyTestAdd(t, f, docID, `{"title": "`+title+`"}`, uint64(docID+1))
+		if docID == 3 {
+			if err := idx.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		docID int
+		title string
+		err   error
+		// docs matching sword and shield once it is applied
+		sword, shield []int
+	}{
+		{"in an immutable segment", 1, "steel shield", nil, []int{0, 2, 4, 5}, []int{1}},
+		{"in the active segment", 4, "bronze shield", nil, []int{0, 2, 5}, []int{1, 4}},
+		{"modified again", 1, "steel sword", nil, []int{0, 1, 2, 5}, []int{4}},
+		{"same body", 0, "iron sword", nil, []int{0, 1, 2, 5}, []int{4}},
+		{"never added", 42, "shield", ErrDocumentNotFound, []int{0, 1, 2, 5}, []int{4}},
+	}
+
+	logIndex := uint64(len(titles))
+	for _, tt := range tests {
+		logIndex++
+		body := `{"title": "` + tt.title + `"}`
+		old := idx.docBlob(tt.docID)
+
+		res := f.ApplyModifyDocument("test", tt.docID, testPayload(body), logIndex)
+		if err, _ := res.(error); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, res, tt.err)
+		}
+		if got := searchIDs(t, idx, titleQuery("sword"), SearchOptions{}); !reflect.DeepEqual(got, tt.sword) {
+			t.Errorf("%s: sword matches %v, want %v", tt.name, got, tt.sword)
+		}
+		if got := searchIDs(t, idx, titleQuery("shield"), SearchOptions{}); !reflect.DeepEqual(got, tt.shield) {
+			t.Errorf("%s: shield matches %v, want %v", tt.name, got, tt.shield)
+		}
+
+		// the new body is read from now on, and the old one is left without a doc
+		sha := testPayload(body)[0].SHA256
+		if tt.err != nil {
+			if idx.HasDocument(tt.docID) {
+				t.Errorf("%s: doc %d was added", tt.name, tt.docID)
+			}
+			continue
+		}
+		if got := idx.docBlob(tt.docID); got != sha {
+			t.Errorf("%s: doc %d has blob %s, want %s", tt.name, tt.docID, got, sha)
+		}
+		if _, ok := idx.orphanBlobs[sha]; ok {
+			t.Errorf("%s: the new body is orphaned", tt.name)
+		}
+		if got := idx.orphanBlobs[old]; old != sha && got != logIndex {
+			t.Errorf("%s: old body orphaned at entry %d, want %d", tt.name, got, logIndex)
+		}
+	}
+}
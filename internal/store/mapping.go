@@ -0,0 +1,437 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field types of a mapping. Text is analyzed into words, the other types are indexed as a
+// single term in a canonical form, so "5", 5 and 5.0 are the same integer.
+const (
+	TypeText    = "text"
+	TypeKeyword = "keyword"
+	TypeInteger = "integer"
+	TypeFloat   = "float"
+	TypeBoolean = "boolean"
+	TypeDate    = "date"
+)
+
+var fieldTypes = map[string]FieldType{
+	TypeText:    TextField,
+	TypeKeyword: KeywordField,
+	TypeInteger: IntegerField,
+	TypeFloat:   FloatField,
+	TypeBoolean: BooleanField,
+	TypeDate:    DateField,
+}
+
+type FieldMapping struct {
+	Type string `json:"type"`
+	// text fields only, the index's analyzer when empty
+	Analyzer string `json:"analyzer,omitempty"`
+	// searchable, true when unset
+	Index *bool `json:"index,omitempty"`
+	// returned with the document, true when unset
+	Store *bool `json:"store,omitempty"`
+}
+
+func (fm FieldMapping) indexed() bool {
+	return fm.Index == nil || *fm.Index
+}
+
+func (fm FieldMapping) stored() bool {
+	return fm.Store == nil || *fm.Store
+}
+
+// What happens to fields missing from the mapping, like Elasticsearch's dynamic setting:
+// "true" (the default) adds them with an inferred type, "false" keeps them in the document
+// without indexing them, and "strict" rejects the document.
+type DynamicMapping string
+
+const (
+	DynamicTrue   DynamicMapping = "true"
+	DynamicFalse  DynamicMapping = "false"
+	DynamicStrict DynamicMapping = "strict"
+)
+
+// Accepts true and false as well as the strings.
+func (d *DynamicMapping) UnmarshalJSON(b []byte) error {
+	var flag bool
+	if err := json.Unmarshal(b, &flag); err == nil {
+		*d = DynamicMapping(strconv.FormatBool(flag))
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("%w: dynamic must be true, false or \"strict\"", ErrInvalidMapping)
+	}
+	*d = DynamicMapping(s)
+	return nil
+}
+
+// Field types of an index. Dynamically mapped fields are added when a document using them
+// is applied to the FSM, so every node adds them in the same order.
+type Mapping struct {
+	Dynamic    DynamicMapping          `json:"dynamic,omitempty"`
+	Properties map[string]FieldMapping `json:"properties,omitempty"`
+}
+
+func (m Mapping) validate() error {
+	switch m.Dynamic {
+	case "", DynamicTrue, DynamicFalse, DynamicStrict:
+	default:
+		return fmt.Errorf("%w: dynamic must be true, false or \"strict\"", ErrInvalidMapping)
+	}
+
+	for field, fm := range m.Properties {
+		if _, ok := fieldTypes[fm.Type]; !ok {
+			return fmt.Errorf("%w: field %q has unknown type %q", ErrInvalidMapping, field, fm.Type)
+		}
+		if fm.Analyzer != "" && fm.Type != TypeText {
+			return fmt.Errorf("%w: field %q is not text, only text fields have an analyzer", ErrInvalidMapping, field)
+		}
+	}
+	return nil
+}
+
+func (m Mapping) copy() Mapping {
+	props := make(map[string]FieldMapping, len(m.Properties))
+	for field, fm := range m.Properties {
+		props[field] = fm
+	}
+	return Mapping{Dynamic: m.Dynamic, Properties: props}
+}
+
+// Builds the typed fields of a document, adding the fields dynamic mapping infers to
+// newFields. Nothing is added when the document does not match the mapping.
+// Nested objects are flattened into dotted field names like author.name, and every value
+// of an array is a value of the same field.
+func (m Mapping) createDocument(obj map[string]any) (doc *Document, newFields map[string]FieldMapping, err error) {
+
+	b := &docBuilder{mapping: m, doc: NewDocument()}
+	b.doc.DocMap = obj
+
+	if err = b.addObject("", obj); err != nil {
+		return nil, nil, err
+	}
+
+	return b.doc, b.newFields, nil
+}
+
+type docBuilder struct {
+	mapping   Mapping
+	doc       *Document
+	newFields map[string]FieldMapping
+}
+
+// Keys are gone through in order, so the first value of a new field is the same on every node.
+func (b *docBuilder) addObject(prefix string, obj map[string]any) error {
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := b.addValue(prefix+key, obj[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *docBuilder) addValue(field string, val any) error {
+
+	switch v := val.(type) {
+	// like a missing field
+	case nil:
+		return nil
+
+	case []any:
+		if _, known := b.fieldMapping(field); !known {
+			b.inferArrayType(field, v)
+		}
+		for _, elem := range v {
+			if err := b.addValue(field, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case map[string]any:
+		if _, mapped := b.fieldMapping(field); mapped {
+			return &MappingError{Field: field, Reason: "is an object, but mapped to a single value"}
+		}
+		return b.addObject(field+".", v)
+	}
+
+	fm, known := b.fieldMapping(field)
+	if !known {
+		switch b.mapping.Dynamic {
+		case DynamicStrict:
+			return &MappingError{Field: field, Reason: "not in the mapping, and dynamic mapping is strict"}
+		case DynamicFalse:
+			return nil
+		}
+
+		fm = FieldMapping{Type: inferFieldType(val)}
+		if b.newFields == nil {
+			b.newFields = make(map[string]FieldMapping)
+		}
+		b.newFields[field] = fm
+	}
+
+	if !fm.indexed() {
+		return nil
+	}
+
+	value, err := fieldValue(fm.Type, val)
+	if err != nil {
+		return &MappingError{Field: field, Reason: err.Error()}
+	}
+
+	b.doc.AddField(Field{
+		ID:    len(b.doc.Fields),
+		Name:  field,
+		Type:  fieldTypes[fm.Type],
+		Value: value,
+	})
+	return nil
+}
+
+// Maps a new field from all the values of an array rather than the first one, so [1, 2.5]
+// is a float field.
+func (b *docBuilder) inferArrayType(field string, values []any) {
+
+	if b.mapping.Dynamic == DynamicStrict || b.mapping.Dynamic == DynamicFalse {
+		return
+	}
+
+	typ := ""
+	for _, val := range values {
+		switch val.(type) {
+		case nil, []any, map[string]any:
+			continue
+		}
+
+		t := inferFieldType(val)
+		if typ == "" || (typ == TypeInteger && t == TypeFloat) {
+			typ = t
+		}
+	}
+
+	if typ != "" {
+		if b.newFields == nil {
+			b.newFields = make(map[string]FieldMapping)
+		}
+		b.newFields[field] = FieldMapping{Type: typ}
+	}
+}
+
+// Mapped fields, and the ones mapped earlier in the same document.
+func (b *docBuilder) fieldMapping(field string) (FieldMapping, bool) {
+	if fm, ok := b.mapping.Properties[field]; ok {
+		return fm, true
+	}
+	fm, ok := b.newFields[field]
+	return fm, ok
+}
+
+// Type of a field missing from the mapping, from its first value. Like Elasticsearch,
+// strings that look like dates are dates.
+func inferFieldType(val any) string {
+	switch v := val.(type) {
+	case bool:
+		return TypeBoolean
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return TypeInteger
+		}
+		return TypeFloat
+	case string:
+		// numeric strings are not taken for epoch millis here
+		for _, layout := range dateLayouts {
+			if _, err := time.Parse(layout, v); err == nil {
+				return TypeDate
+			}
+		}
+	}
+	return TypeText
+}
+
+// Converts a JSON value to the text indexed for a field of the given type.
+func fieldValue(fieldType string, val any) (string, error) {
+
+	if fieldType == TypeText {
+		return fmt.Sprint(val), nil
+	}
+
+	switch v := val.(type) {
+	case string:
+		return canonicalValue(fieldType, v)
+	case json.Number:
+		return canonicalValue(fieldType, v.String())
+	case bool:
+		return canonicalValue(fieldType, strconv.FormatBool(v))
+	default:
+		return "", fmt.Errorf("%s fields do not take %T values", fieldType, val)
+	}
+}
+
+// Canonical form of a value of a typed field, so the same value is always the same term.
+func canonicalValue(fieldType, s string) (string, error) {
+	switch fieldType {
+	case TypeText, TypeKeyword:
+		return s, nil
+
+	case TypeInteger:
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return strconv.FormatInt(n, 10), nil
+		}
+		// 5.0 is an integer, 5.5 is not
+		if f, err := strconv.ParseFloat(s, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return strconv.FormatInt(int64(f), 10), nil
+		}
+		return "", fmt.Errorf("%q is not an integer", s)
+
+	case TypeFloat:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", fmt.Errorf("%q is not a number", s)
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+
+	case TypeBoolean:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a boolean", s)
+		}
+		return strconv.FormatBool(b), nil
+
+	case TypeDate:
+		t, err := parseDate(s)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a date", s)
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+	}
+
+	return "", fmt.Errorf("unknown field type %q", fieldType)
+}
+
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// Dates are RFC 3339 timestamps, dates without a time or time zone (UTC),
+// or milliseconds since the epoch.
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+
+	return time.Time{}, fmt.Errorf("unknown date format")
+}
+
+// Analyzer of a field of a type other than text, the value in its canonical form as a
+// single term. Query values that are not of the type match nothing.
+type typedAnalyzer struct {
+	fieldType string
+}
+
+func (a typedAnalyzer) Analyze(text string) []Token {
+	value, err := canonicalValue(a.fieldType, text)
+	if err != nil {
+		return nil
+	}
+	return []Token{{Text: value, Position: 0}}
+}
+
+func (a typedAnalyzer) Normalize(text string) string {
+	if value, err := canonicalValue(a.fieldType, text); err == nil {
+		return value
+	}
+	return text
+}
+
+// Decodes a document, keeping numbers as written so integers stay exact, and 5.0 stays
+// a float like it was sent.
+func decodeDocument(jsonString string) (obj map[string]any, err error) {
+	dec := json.NewDecoder(strings.NewReader(jsonString))
+	dec.UseNumber()
+	if err = dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Removes the fields mapped with "store": false from a document returned to a client.
+func (m Mapping) storedSource(source []byte) []byte {
+
+	unstored := false
+	for _, fm := range m.Properties {
+		if !fm.stored() {
+			unstored = true
+			break
+		}
+	}
+	if !unstored {
+		return source
+	}
+
+	obj, err := decodeDocument(string(source))
+	if err != nil {
+		return source
+	}
+	for field, fm := range m.Properties {
+		if !fm.stored() {
+			removeField(obj, field)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(obj); err != nil {
+		return source
+	}
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+// Removes a dotted field from a document, from nested objects and arrays of them too.
+func removeField(obj map[string]any, field string) {
+	delete(obj, field)
+
+	for i := 0; i < len(field); i++ {
+		if field[i] == '.' {
+			removeNestedField(obj[field[:i]], field[i+1:])
+		}
+	}
+}
+
+func removeNestedField(val any, field string) {
+	switch v := val.(type) {
+	case map[string]any:
+		removeField(v, field)
+	case []any:
+		for _, elem := range v {
+			removeNestedField(elem, field)
+		}
+	}
+}
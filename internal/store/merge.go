@@ -0,0 +1,535 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"gocene/config"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Tiered merge policy, a simpler take on Lucene's TieredMergePolicy. Segments are put in
+// tiers by their live doc count, each tier segmentsPerTier times bigger than the one below,
+// and once a tier holds segmentsPerTier segments its smallest ones are merged into one of
+// the next tier. Segments with most of their docs deleted are merged on their own, which
+// drops the deleted docs.
+//
+// The leader decides what to merge and replicates it as a StartMerge command, so every node
+// merges the same segments at the same point of the log. The merged segment is built off
+// the apply path, and once the nodes report it built a CommitMerge command swaps it in.
+// A node that did not answer, or replays the commit after a restart, finishes building it
+// when applying the commit.
+const (
+	segmentsPerTier = 10
+	maxMergeAtOnce  = 10
+	maxDeletedRatio = 0.5
+)
+
+// Names of the segments to merge next, nil when there is nothing to merge.
+func (idx *Index) planMerge() []string {
+
+	idx.Mutex.RLock()
+	segs := append([]*Segment(nil), idx.Segments...)
+	idx.Mutex.RUnlock()
+
+	// segments smaller than a flushed active segment count as one
+	floor := max(config.ActiveSegmentCount, 1)
+
+	type segSize struct {
+		name           string
+		live, docCount int
+	}
+
+	tiers := make(map[int][]segSize)
+	var expunge []string
+	for _, seg := range segs {
+		live, docCount := seg.liveDocCount()
+		s := segSize{name: seg.Name, live: live, docCount: docCount}
+
+		tier := 0
+		for bound := floor * segmentsPerTier; max(live, floor) >= bound; bound *= segmentsPerTier {
+			tier++
+		}
+		tiers[tier] = append(tiers[tier], s)
+
+		if docCount > 0 && float64(docCount-live)/float64(docCount) > maxDeletedRatio {
+			expunge = append(expunge, seg.Name)
+		}
+	}
+
+	tierNums := make([]int, 0, len(tiers))
+	for t := range tiers {
+		tierNums = append(tierNums, t)
+	}
+	sort.Ints(tierNums)
+
+	for _, t := range tierNums {
+		tier := tiers[t]
+		if len(tier) < segmentsPerTier {
+			continue
+		}
+
+		sort.Slice(tier, func(i, j int) bool {
+			if tier[i].live != tier[j].live {
+				return tier[i].live < tier[j].live
+			}
+			return tier[i].name < tier[j].name
+		})
+
+		names := make([]string, 0, maxMergeAtOnce)
+		for _, s := range tier[:min(len(tier), maxMergeAtOnce)] {
+			names = append(names, s.name)
+		}
+		return names
+	}
+
+	if len(expunge) > 0 {
+		return expunge[:1]
+	}
+	return nil
+}
+
+// A merge in progress. Starting it is a command, so the merged segment holds the docs live
+// at that point of the log on every node, and it is built in the background while writes
+// keep being applied. Docs deleted in the meantime are tombstoned in the merged segment when
+// a second command swaps it in.
+type pendingMerge struct {
+	MergeMetadata
+
+	segs []*Segment
+	// set once done is closed
+	merged *Segment
+	done   chan struct{}
+}
+
+// for Raft snapshots of an index with a merge in progress
+type MergeMetadata struct {
+	Name     string   `json:"name"`
+	Segments []string `json:"segments"`
+	// tombstones of each of the segments when the merge started
+	Deleted [][]int `json:"deleted"`
+}
+
+// Starts merging the named immutable segments into a new one without their deleted docs,
+// and returns its name. Only called when applying to the FSM.
+func (idx *Index) StartMerge(segNames []string) (string, error) {
+
+	idx.Mutex.RLock()
+	merging := idx.merge != nil
+	idx.Mutex.RUnlock()
+
+	if merging {
+		return "", ErrMergeInProgress
+	}
+
+	md := MergeMetadata{Name: "seg_" + fmt.Sprint(idx.SegCount+1), Segments: segNames}
+	segs, err := idx.segmentsNamed(segNames)
+	if err != nil {
+		return "", err
+	}
+	for _, seg := range segs {
+		md.Deleted = append(md.Deleted, seg.tombstoneIDs())
+	}
+
+	idx.SegCount++
+	return md.Name, idx.beginMerge(md)
+}
+
+// Builds the merged segment of md in the background, also used to pick a merge back up
+// from a snapshot.
+func (idx *Index) beginMerge(md MergeMetadata) error {
+
+	segs, err := idx.segmentsNamed(md.Segments)
+	if err != nil {
+		return err
+	}
+
+	// the build reads the segments even if the index lets go of them meanwhile
+	for _, seg := range segs {
+		seg.incRef()
+	}
+
+	pm := &pendingMerge{MergeMetadata: md, segs: segs, done: make(chan struct{})}
+	go func() {
+		pm.merged = mergeSegments(md.Name, idx, segs, md.Deleted)
+		for _, seg := range segs {
+			seg.close()
+		}
+		close(pm.done)
+	}()
+
+	idx.Mutex.Lock()
+	idx.merge = pm
+	idx.Mutex.Unlock()
+	return nil
+}
+
+// Swaps the merged segment in for the segments it replaces, once it is built. Only called
+// when applying to the FSM, so the segments cannot change meanwhile, and searches keep
+// using the old ones until the swap. The leader commits once the nodes it reaches have built
+// it, so only the others wait here.
+func (idx *Index) CommitMerge(name string) error {
+
+	idx.Mutex.RLock()
+	pm := idx.merge
+	idx.Mutex.RUnlock()
+
+	if pm == nil || pm.Name != name {
+		return ErrMergeNotFound
+	}
+	<-pm.done
+
+	// docs deleted since the merge started
+	merged := pm.merged
+	for i, seg := range pm.segs {
+		before := make(map[int]struct{}, len(pm.Deleted[i]))
+		for _, docID := range pm.Deleted[i] {
+			before[docID] = struct{}{}
+		}
+		for _, docID := range seg.tombstoneIDs() {
+			if _, ok := before[docID]; !ok {
+				merged.Tombstone(docID)
+			}
+		}
+	}
+
+	wanted := make(map[string]bool, len(pm.Segments))
+	for _, segName := range pm.Segments {
+		wanted[segName] = true
+	}
+
+	idx.Mutex.Lock()
+	defer idx.Mutex.Unlock()
+
+	// the merged segment takes the place of the first one it replaces
+	kept := make([]*Segment, 0, len(idx.Segments)-len(pm.segs)+1)
+	for _, seg := range idx.Segments {
+		if !wanted[seg.Name] {
+			kept = append(kept, seg)
+		} else if seg == pm.segs[0] && merged.DocCount > 0 {
+			kept = append(kept, merged)
+		}
+	}
+	idx.Segments = kept
+	idx.merge = nil
+
+	// searches, views and snapshots still using the old segments keep them until they are done
+	for _, seg := range pm.segs {
+		if seg.TermDict.file != nil {
+			seg.TermDict.file.remove()
+		}
+		seg.close()
+	}
+
+	return nil
+}
+
+// Name of the merge in progress, "" if none.
+func (idx *Index) mergeInProgress() string {
+	idx.Mutex.RLock()
+	defer idx.Mutex.RUnlock()
+
+	if idx.merge == nil {
+		return ""
+	}
+	return idx.merge.Name
+}
+
+// Name of the merge in progress once its merged segment is built, "" until then.
+func (idx *Index) builtMerge() string {
+	idx.Mutex.RLock()
+	defer idx.Mutex.RUnlock()
+
+	if idx.merge == nil {
+		return ""
+	}
+	select {
+	case <-idx.merge.done:
+		return idx.merge.Name
+	default:
+		return ""
+	}
+}
+
+// The immutable segments with the names, in the order of the names.
+func (idx *Index) segmentsNamed(segNames []string) ([]*Segment, error) {
+	idx.Mutex.RLock()
+	defer idx.Mutex.RUnlock()
+
+	byName := make(map[string]*Segment, len(idx.Segments))
+	for _, seg := range idx.Segments {
+		byName[seg.Name] = seg
+	}
+
+	segs := make([]*Segment, 0, len(segNames))
+	for _, name := range segNames {
+		seg, ok := byName[name]
+		if !ok {
+			return nil, ErrSegmentNotFound
+		}
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// Copies the docs of the segments into a new segment, except the deleted ones of each.
+func mergeSegments(name string, idx *Index, segs []*Segment, deleted [][]int) *Segment {
+
+	lives := make([]map[int]struct{}, len(segs))
+	termSet := make(map[Term]struct{})
+	for i, seg := range segs {
+		docIDs := seg.docIDs()
+		live := make(map[int]struct{}, len(docIDs))
+		for _, docID := range docIDs {
+			live[docID] = struct{}{}
+		}
+		for _, docID := range deleted[i] {
+			delete(live, docID)
+		}
+		lives[i] = live
+
+		seg.TermDict.forEach(func(t Term, _ func() TermData) bool {
+			termSet[t] = struct{}{}
+			return true
+		})
+	}
+
+	docs := mergedColumns(segs, lives)
+	if len(docs.docIDs) == 0 {
+		merged, _ := NewSegment(name, idx)
+		return merged
+	}
+
+	terms := make([]Term, 0, len(termSet))
+	for t := range termSet {
+		terms = append(terms, t)
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i] < terms[j] })
+
+	// postings are read from the merged segments a term at a time while the file is written
+	file := newSegmentFile(idx.Name, name, func(w io.Writer) error {
+		return writeSegmentFile(w, terms, func(t Term) TermData {
+			mtd := make(TermData)
+			for i, seg := range segs {
+				td, _ := seg.TermDict.postings(t)
+				for docID, positions := range td {
+					if _, ok := lives[i][docID]; ok {
+						mtd[docID] = positions
+					}
+				}
+			}
+			return mtd
+		}, docs)
+	})
+
+	return fileSegment(name, idx, file)
+}
+
+// Values of the live docs of the segments, which are immutable, as they are written.
+func mergedColumns(segs []*Segment, lives []map[int]struct{}) docColumns {
+
+	type mergedDoc struct {
+		docID int
+		fd    *fileDocs
+		ord   int
+	}
+
+	var docs []mergedDoc
+	for i, seg := range segs {
+		fd := seg.fileDocs()
+		if fd == nil {
+			continue
+		}
+		for ord := 0; ord < fd.count; ord++ {
+			if _, ok := lives[i][fd.docID(ord)]; ok {
+				docs = append(docs, mergedDoc{docID: fd.docID(ord), fd: fd, ord: ord})
+			}
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].docID < docs[j].docID })
+
+	dc := docColumns{
+		docIDs:  make([]int, len(docs)),
+		blobs:   make([]string, len(docs)),
+		lengths: make(map[string][]int),
+		stats:   make(map[string]FieldStats),
+		numeric: make(map[string]NumericValues),
+	}
+	for ord, d := range docs {
+		dc.docIDs[ord] = d.docID
+		dc.blobs[ord] = d.fd.blob(d.ord)
+
+		for field, c := range d.fd.lengths {
+			length := c.length(d.ord)
+			if length < 0 {
+				continue
+			}
+			column, ok := dc.lengths[field]
+			if !ok {
+				column = make([]int, len(docs))
+				for j := range column {
+					column[j] = -1
+				}
+				dc.lengths[field] = column
+			}
+			column[ord] = length
+
+			fs := dc.stats[field]
+			fs.DocCount++
+			fs.SumLength += length
+			dc.stats[field] = fs
+		}
+	}
+
+	for i, seg := range segs {
+		fd := seg.fileDocs()
+		if fd == nil {
+			continue
+		}
+		for field := range fd.numeric {
+			for _, p := range fd.numericValues(field) {
+				if _, ok := lives[i][p.DocID]; ok {
+					dc.numeric[field] = append(dc.numeric[field], p)
+				}
+			}
+		}
+	}
+	for _, nv := range dc.numeric {
+		sort.Slice(nv, func(i, j int) bool {
+			if nv[i].Key != nv[j].Key {
+				return nv[i].Key < nv[j].Key
+			}
+			return nv[i].DocID < nv[j].DocID
+		})
+	}
+
+	return dc
+}
+
+// Live docs and all the docs indexed into the segment.
+func (seg *Segment) liveDocCount() (live, docCount int) {
+	seg.tombMu.RLock()
+	defer seg.tombMu.RUnlock()
+
+	docCount = len(seg.DocIDs)
+	if fd := seg.fileDocs(); fd != nil {
+		docCount = fd.count
+	}
+	return docCount - len(seg.Tombstones), docCount
+}
+
+// Runs on every node, only the leader merges. One merge per index at a time, committed on a
+// later tick than it started, and a merge a previous leader started is committed before
+// planning the next one.
+func (s *Store) mergeLoop() {
+	tick := time.NewTicker(config.MergeInterval)
+	defer tick.Stop()
+
+	for range tick.C {
+		if s.Raft.State() != raft.Leader {
+			continue
+		}
+
+		for _, idxName := range s.IndexNames() {
+			idx, ok := s.GetIndex(idxName)
+			if !ok {
+				continue
+			}
+
+			if name := idx.mergeInProgress(); name != "" {
+				if err := s.commitMerge(idx); err != nil {
+					log.Printf("could not commit merge %s of index %s, err: %v\n", name, idxName, err)
+				}
+				continue
+			}
+
+			segNames := idx.planMerge()
+			if segNames == nil {
+				continue
+			}
+
+			if err := s.StartMerge(idxName, segNames); err != nil {
+				log.Printf("could not merge segments %v of index %s, err: %v\n", segNames, idxName, err)
+			}
+		}
+	}
+}
+
+// Replicates starting a merge of the index's segments, which every node then builds in the
+// background.
+func (s *Store) StartMerge(idxName string, segNames []string) error {
+
+	if _, ok := s.GetIndex(idxName); !ok {
+		return ErrIdxDoesNotExist
+	}
+
+	c := Command{
+		CmdId:    CmdStartMerge,
+		IdxName:  idxName,
+		Segments: segNames,
+	}
+	return s.applyMergeCommand(c)
+}
+
+// Replicates swapping in the index's merge in progress once every node that answers has
+// built it, and does nothing until then. A node that does not answer finishes building it
+// when applying the commit, holding back its later entries until then.
+func (s *Store) commitMerge(idx *Index) error {
+
+	name := idx.builtMerge()
+	if name == "" {
+		return nil
+	}
+
+	progress, failed, err := s.clusterProgress()
+	if err != nil {
+		return err
+	}
+	for _, err := range failed {
+		log.Printf("could not get the progress of a node, committing merge %s of index %s without it, err: %v\n", name, idx.Name, err)
+	}
+	for _, p := range progress {
+		if p.Merges[idx.Name] != name {
+			return nil
+		}
+	}
+
+	c := Command{
+		CmdId:   CmdCommitMerge,
+		IdxName: idx.Name,
+		Segment: name,
+	}
+	return s.applyMergeCommand(c)
+}
+
+func (s *Store) applyMergeCommand(c Command) error {
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	if s.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f := s.Raft.Apply(b, config.RaftTimeout)
+	if f.Error() != nil {
+		return f.Error()
+	}
+
+	if resp := f.Response(); resp != nil {
+		if ferr, ok := resp.(error); ok {
+			return ferr
+		}
+	}
+
+	return nil
+}
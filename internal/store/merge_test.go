@@ -0,0 +1,238 @@
+package store
+
+import (
+	"gocene/config"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPlanMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		// doc count of each segment, and how many of its docs are deleted
+		sizes, deleted []int
+		// the segments to merge, by their place in the index
+		want []int
+	}{
+		{"nine segments of a tier", []int{1, 1, 1, 1, 1, 1, 1, 1, 1}, nil, nil},
+		{"a full tier", []int{1, 2, 1, 3, 1, 1, 1, 1, 1, 1}, nil, []int{0, 2, 4, 5, 6, 7, 8, 9, 1, 3}},
+		{"the smallest of a tier", []int{5, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, nil, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		// ties go by name, and seg_10 sorts before seg_9
+		{"deleted docs count out", []int{5, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, []int{4}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 10}},
+		{"segments of two tiers", []int{1, 1, 1, 1, 1, 10, 10, 10, 10, 10}, nil, nil},
+		{"mostly deleted", []int{4, 4, 4}, []int{1, 3, 2}, []int{1}},
+		{"half deleted", []int{4, 4}, []int{2, 2}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, idx := newTestFSM(t)
+
+			docID := 0
+			for i, size := range tt.sizes {
+				for j := 0; j < size; j++ {
+					if _, err := idx.AddDocument(&Document{ID: docID + j}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := idx.Refresh(); err != nil {
+					t.Fatal(err)
+				}
+				for j := 0; i < len(tt.deleted) && j < tt.deleted[i]; j++ {
+					if err := idx.DeleteDocument(docID + j); err != nil {
+						t.Fatal(err)
+					}
+				}
+				docID += size
+			}
+
+			var want []string
+			for _, i := range tt.want {
+				want = append(want, idx.Segments[i].Name)
+			}
+			// tiers start at a single doc
+			config.ActiveSegmentCount = 1
+			got := idx.planMerge()
+			sort.Strings(got)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCommitMerge(t *testing.T) {
+	f, idx := newTestFSM(t)
+
+	// docs 0 to 3 and 4 to 7 are in two segments that get merged, 8 and 9 stay active
+	titles := []string{"iron sword", "steel sword", "wooden sword", "steel axe", "bronze sword", "old sword", "steel shield", "sword", "long sword", "axe"}
+	for docID, title := range titles {
+		applyTestAdd(t, f, docID, `{"title": "`+title+`"}`, uint64(docID+1))
+		if docID == 3 || docID == 7 {
+			if err := idx.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	logIndex := uint64(len(titles))
+	apply := func(cmd func(logIndex uint64) error) {
+		logIndex++
+		if err := cmd(logIndex); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleteDoc := func(docID int) func(uint64) error {
+		return func(logIndex uint64) error { return f.ApplyDeleteDocument("test", docID, logIndex) }
+	}
+
+	// deleted before the merge starts, so left out of the merged segment
+	apply(deleteDoc(1))
+
+	old := []*Segment{idx.Segments[0], idx.Segments[1]}
+	name, err := idx.StartMerge([]string{old[0].Name, old[1].Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deleted and modified while the merged segment is built
+	apply(deleteDoc(2))
+	apply(deleteDoc(8))
+	apply(func(logIndex uint64) error {
+		if err, ok := f.ApplyModifyDocument("test", 5, testPayload(`{"title": "old shield"}`), logIndex).(error); ok {
+			return err
+		}
+		return nil
+	})
+
+	queries := []struct {
+		word string
+		want []int
+	}{
+		{"sword", []int{0, 4, 7}},
+		{"shield", []int{5, 6}},
+		{"steel", []int{3, 6}},
+		{"axe", []int{3, 9}},
+	}
+	check := func(when string) {
+		for _, q := range queries {
+			if got := searchIDs(t, idx, titleQuery(q.word), SearchOptions{}); !reflect.DeepEqual(got, q.want) {
+				t.Errorf("%s committing: %s matches %v, want %v", when, q.word, got, q.want)
+			}
+		}
+	}
+
+	check("before")
+	if err := idx.CommitMerge(name); err != nil {
+		t.Fatal(err)
+	}
+	check("after")
+
+	if len(idx.Segments) != 1 || idx.Segments[0].Name != name {
+		t.Fatalf("got %d segments after committing, want %s alone", len(idx.Segments), name)
+	}
+	merged := idx.Segments[0]
+
+	docs := []struct {
+		docID         int
+		merged, alive bool
+	}{
+		{0, true, true},
+		{1, false, false},
+		{2, true, false},
+		{3, true, true},
+		{5, true, false},
+		{7, true, true},
+	}
+	for _, d := range docs {
+		merged.tombMu.RLock()
+		has := merged.hasDoc(d.docID)
+		merged.tombMu.RUnlock()
+		if has != d.merged {
+			t.Errorf("doc %d in the merged segment: %v, want %v", d.docID, has, d.merged)
+		}
+		if alive := merged.HasLiveDocument(d.docID); alive != d.alive {
+			t.Errorf("doc %d live in the merged segment: %v, want %v", d.docID, alive, d.alive)
+		}
+	}
+
+	if idx.mergeInProgress() != "" {
+		t.Errorf("merge %s still in progress", idx.mergeInProgress())
+	}
+	for _, seg := range old {
+		if _, err := os.Stat(segmentFilePath(idx.Name, seg.Name)); !os.IsNotExist(err) {
+			t.Errorf("file of merged away segment %s: %v, want it removed", seg.Name, err)
+		}
+	}
+}
+
+func TestCommitMergePointInTime(t *testing.T) {
+	f, idx := newTestFSM(t)
+
+	titles := []string{"iron sword", "steel sword", "wooden sword", "steel axe"}
+	for docID, title := range titles {
+		applyTestAdd(t, f, docID, `{"title": "`+title+`"}`, uint64(docID+1))
+		if docID == 1 || docID == 3 {
+			if err := idx.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	old := []*Segment{idx.Segments[0], idx.Segments[1]}
+
+	pit, err := idx.OpenPointInTime(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := idx.StartMerge([]string{old[0].Name, old[1].Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.ApplyDeleteDocument("test", 0, uint64(len(titles)+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.CommitMerge(name); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(seg *Segment) bool {
+		_, err := os.Stat(segmentFilePath(idx.Name, seg.Name))
+		return err == nil
+	}
+
+	tests := []struct {
+		name string
+		opts SearchOptions
+		want []int
+	}{
+		{"the index", SearchOptions{}, []int{1, 2}},
+		{"the view", SearchOptions{PIT: pit}, []int{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		if got := searchIDs(t, idx, titleQuery("sword"), tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sword matches %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the view keeps the old files until it is closed
+	for _, seg := range old {
+		if !exists(seg) {
+			t.Errorf("file of segment %s removed while a view uses it", seg.Name)
+		}
+	}
+	if !idx.ClosePointInTime(pit) {
+		t.Fatal("view already closed")
+	}
+	for _, seg := range old {
+		if exists(seg) {
+			t.Errorf("file of segment %s still there once no view uses it", seg.Name)
+		}
+	}
+	if !exists(idx.Segments[0]) {
+		t.Errorf("file of merged segment %s missing", name)
+	}
+}
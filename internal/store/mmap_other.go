@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package store
+
+import (
+	"io"
+	"os"
+)
+
+// No mmap here, the file is read into memory instead.
+func mmapFile(f *os.File, size int) (data []byte, unmap func([]byte) error, err error) {
+	data = make([]byte, size)
+	if _, err = io.ReadFull(f, data); err != nil {
+		return nil, nil, err
+	}
+	return data, nil, nil
+}
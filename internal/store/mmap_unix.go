@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+// Maps the file read only. The mapping stays valid after the file is closed or removed.
+func mmapFile(f *os.File, size int) (data []byte, unmap func([]byte) error, err error) {
+	if size < segmentHeaderSize+segmentFooterSize {
+		return nil, nil, ErrCorruptSegment
+	}
+
+	data, err = syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, syscall.Munmap, nil
+}
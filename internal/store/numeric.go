@@ -0,0 +1,196 @@
+package store
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Values of integer, float and date fields are also kept per segment as sorted doc values,
+// so range queries binary search them instead of going through the term dictionary.
+// Every value is a sortable int64 key: integers as is, dates as milliseconds since the
+// epoch, and floats by their bits, flipped like Lucene's NumericUtils so they sort as int64s.
+
+type NumericPoint struct {
+	Key   int64 `json:"k"`
+	DocID int   `json:"d"`
+}
+
+// A field's points sorted by key, then doc ID.
+type NumericValues []NumericPoint
+
+func (nv NumericValues) insert(p NumericPoint) NumericValues {
+	i := sort.Search(len(nv), func(i int) bool {
+		return nv[i].Key > p.Key || (nv[i].Key == p.Key && nv[i].DocID >= p.DocID)
+	})
+	nv = append(nv, NumericPoint{})
+	copy(nv[i+1:], nv[i:])
+	nv[i] = p
+	return nv
+}
+
+func (nv NumericValues) remove(docID int) NumericValues {
+	kept := nv[:0]
+	for _, p := range nv {
+		if p.DocID != docID {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// Docs with a value between min and max, both included.
+func (nv NumericValues) docsInRange(min, max int64) []int {
+	start := sort.Search(len(nv), func(i int) bool { return nv[i].Key >= min })
+
+	var docIDs []int
+	for i := start; i < len(nv) && nv[i].Key <= max; i++ {
+		docIDs = append(docIDs, nv[i].DocID)
+	}
+	return docIDs
+}
+
+func isNumericField(ft FieldType) bool {
+	return ft == IntegerField || ft == FloatField || ft == DateField
+}
+
+// Key of a field value, in the canonical form of its type.
+func numericKey(ft FieldType, value string) (int64, bool) {
+	switch ft {
+	case IntegerField:
+		n, err := strconv.ParseInt(value, 10, 64)
+		return n, err == nil
+	case FloatField:
+		f, err := strconv.ParseFloat(value, 64)
+		return sortableFloat(f), err == nil
+	case DateField:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		return t.UnixMilli(), err == nil
+	}
+	return 0, false
+}
+
+func sortableFloat(f float64) int64 {
+	bits := int64(math.Float64bits(f))
+	return bits ^ (bits>>63)&math.MaxInt64
+}
+
+// Key of a range bound, the smallest or largest key the range includes. ok is false when
+// nothing can be on that side of the bound, like above the largest integer.
+func rangeBoundKey(ft FieldType, bound string, upper, inclusive bool) (key int64, ok bool, err error) {
+
+	switch ft {
+	case IntegerField:
+		if n, perr := strconv.ParseInt(bound, 10, 64); perr == nil {
+			key = n
+			break
+		}
+		// like 5.0 or 1e3, a fractional bound falls between two integers, which decides inclusion
+		f, perr := strconv.ParseFloat(bound, 64)
+		if perr != nil || math.IsNaN(f) {
+			return 0, false, &QueryError{Reason: strconv.Quote(bound) + " is not a number"}
+		}
+		if f != math.Trunc(f) {
+			inclusive = true
+		}
+		if upper {
+			f = math.Floor(f)
+		} else {
+			f = math.Ceil(f)
+		}
+		if f < math.MinInt64 || f >= math.MaxInt64 {
+			// out of the int64 range, everything or nothing is on the right side
+			return clampedBound(f > 0, upper)
+		}
+		key = int64(f)
+
+	case FloatField:
+		f, perr := strconv.ParseFloat(bound, 64)
+		if perr != nil || math.IsNaN(f) {
+			return 0, false, &QueryError{Reason: strconv.Quote(bound) + " is not a number"}
+		}
+		key = sortableFloat(f)
+
+	case DateField:
+		t, perr := parseDate(bound)
+		if perr != nil {
+			return 0, false, &QueryError{Reason: strconv.Quote(bound) + " is not a date"}
+		}
+		key = t.UnixMilli()
+
+	default:
+		return 0, false, &QueryError{Reason: "range queries need an integer, float or date field"}
+	}
+
+	if inclusive {
+		return key, true, nil
+	}
+	if upper {
+		return key - 1, key != math.MinInt64, nil
+	}
+	return key + 1, key != math.MaxInt64, nil
+}
+
+func clampedBound(above, upper bool) (int64, bool, error) {
+	if upper {
+		return math.MaxInt64, above, nil
+	}
+	return math.MinInt64, !above, nil
+}
+
+// Matches docs with a value of an integer, float or date field between Min and Max,
+// both included. All of them score 1, like Elasticsearch's range query.
+type RangeQuery struct {
+	Field    string
+	Min, Max int64
+}
+
+// Builds a range query from its bounds, "" for an unbounded side. The bounds are of the
+// field's type, so the analyzer of the field decides how they are read.
+func NewRangeQuery(analyzers FieldAnalyzers, field, from, to string, includeFrom, includeTo bool) (Query, error) {
+
+	typed, ok := analyzers.FieldAnalyzer(field).(typedAnalyzer)
+	if !ok {
+		return nil, &QueryError{Reason: "range query on " + field + " needs an integer, float or date field"}
+	}
+	ft := fieldTypes[typed.fieldType]
+
+	q := &RangeQuery{Field: field, Min: math.MinInt64, Max: math.MaxInt64}
+	var err error
+
+	if from != "" {
+		if q.Min, ok, err = rangeBoundKey(ft, from, false, includeFrom); err != nil {
+			return nil, err
+		} else if !ok {
+			return NewMatchQuery(nil), nil
+		}
+	}
+	if to != "" {
+		if q.Max, ok, err = rangeBoundKey(ft, to, true, includeTo); err != nil {
+			return nil, err
+		} else if !ok {
+			return NewMatchQuery(nil), nil
+		}
+	}
+
+	return q, nil
+}
+
+func (q *RangeQuery) ScoringTerms() []Term {
+	return nil
+}
+
+func (q *RangeQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+	hits := make(map[int]float64)
+	if q.Min > q.Max {
+		return hits, nil
+	}
+
+	for _, docID := range seg.docsInRange(q.Field, q.Min, q.Max) {
+		if !seg.isDeleted(docID) {
+			hits[docID] = 1
+		}
+	}
+	return hits, nil
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRangeBoundsOnIntegerField(t *testing.T) {
+	idx := newQueryTestIndex()
+
+	tests := []struct {
+		op, bound string
+		min, max  int64
+	}{
+		{"gt", "5", 6, math.MaxInt64},
+		{"gt", "5.0", 6, math.MaxInt64},
+		{"gt", "5.5", 6, math.MaxInt64},
+		{"gte", "5", 5, math.MaxInt64},
+		{"gte", "5.0", 5, math.MaxInt64},
+		{"gte", "5.5", 6, math.MaxInt64},
+		{"lt", "5", math.MinInt64, 4},
+		{"lt", "5.0", math.MinInt64, 4},
+		{"lt", "5.5", math.MinInt64, 5},
+		{"lte", "5", math.MinInt64, 5},
+		{"lte", "5.0", math.MinInt64, 5},
+		{"lte", "5.5", math.MinInt64, 5},
+		{"lt", "1e3", math.MinInt64, 999},
+		{"gt", "-5.5", -5, math.MaxInt64},
+	}
+
+	for _, tt := range tests {
+		body := `{"price": {"` + tt.op + `": ` + tt.bound + `}}`
+		q, err := parseRangeDSL([]byte(body), idx)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.op, tt.bound, err)
+			continue
+		}
+		rq, ok := q.(*RangeQuery)
+		if !ok {
+			t.Errorf("%s %s: got %#v, want a range query", tt.op, tt.bound, q)
+			continue
+		}
+		if rq.Min != tt.min || rq.Max != tt.max {
+			t.Errorf("%s %s: got [%d, %d], want [%d, %d]", tt.op, tt.bound, rq.Min, rq.Max, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gocene/config"
+	"gocene/internal/utils"
+)
+
+// A doc as carried in the Raft log. Every body is stored in Minio under the SHA-256 of its
+// bytes, which always refers to the same body however the doc changes later, and docs are
+// read from there. Bodies up to config.MaxInlineDocSize bytes are in the entry itself too, so
+// applying it does not depend on Minio returning what the leader stored. Larger ones are read
+// back before the entry is stored in a node's log, see prefetch.go. Either way the body is
+// checked against its SHA-256.
+type DocumentPayload struct {
+	Data   json.RawMessage `json:",omitempty"`
+	SHA256 string
+}
+
+// JSON of the doc as stored in Minio, under the blob the applied state has for it. Docs added
+// before bodies were stored by their SHA-256 have none, and are read from under their ID.
+func (idx *Index) DocumentJSON(docID int) (string, error) {
+	sha := idx.docBlob(docID)
+
+	if sha == "" {
+		return utils.GetDocumentFromMinio(idx.mc, docID, idx.Name)
+	}
+	data, err := utils.GetBlobFromMinio(idx.mc, sha, idx.Name)
+	return string(data), err
+}
+
+// Stores the JSON of a doc in Minio under its SHA-256, and returns the payload the Raft log
+// carries for it.
+func (s *Store) newDocumentPayload(idxName string, data []byte) (DocumentPayload, error) {
+	sum := sha256.Sum256(data)
+	p := DocumentPayload{SHA256: hex.EncodeToString(sum[:])}
+
+	if err := utils.StoreBlobToMinio(s.mc, p.SHA256, data, idxName); err != nil {
+		return p, err
+	}
+
+	if len(data) <= config.MaxInlineDocSize {
+		p.Data = data
+		return p, nil
+	}
+	return p, s.bodies.put(p.SHA256, data, 0)
+}
+
+// JSON of the doc, checked against its SHA-256. A body carried by reference is read from the
+// cache it was read into before the entry was stored.
+func (p DocumentPayload) body(bodies *bodyCache) (data []byte, err error) {
+
+	data = p.Data
+	if data == nil {
+		if data, err = bodies.read(p.SHA256); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != p.SHA256 {
+		return nil, ErrDocumentChecksum
+	}
+	return data, nil
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Point in time views of an index, so paging through results stays consistent while docs
+// keep being indexed and deleted. A view holds a reference on the immutable segments of the
+// moment it was opened with a copy of their tombstones, released when it is closed or
+// expires, and a frozen copy of the active segment.
+// Views are kept by the node that opened them, and dropped once their keep alive passes
+// without a search using them. Only matching and scoring are pinned: doc bodies are read
+// from Minio as they are when a page is fetched, so a doc modified since the view was opened
+// comes back in its current version, and one deleted since is left out of the page.
+
+const (
+	DefaultPITKeepAlive = time.Minute
+	MaxPITKeepAlive     = 24 * time.Hour
+)
+
+type pointInTime struct {
+	segs    []*Segment
+	expires time.Time
+}
+
+// Opens a view of the index as it is now, and returns its ID.
+func (idx *Index) OpenPointInTime(keepAlive time.Duration) (id string, err error) {
+
+	if keepAlive <= 0 || keepAlive > MaxPITKeepAlive {
+		return "", ErrInvalidKeepAlive
+	}
+
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	id = hex.EncodeToString(b)
+
+	idx.Mutex.RLock()
+	segs := make([]*Segment, 0, len(idx.Segments)+1)
+	for _, seg := range idx.Segments {
+		segs = append(segs, seg.pinned())
+	}
+	idx.As.Mutex.RLock()
+	segs = append(segs, idx.As.Seg.frozen())
+	idx.As.Mutex.RUnlock()
+	idx.Mutex.RUnlock()
+
+	idx.pitMu.Lock()
+	defer idx.pitMu.Unlock()
+
+	idx.dropExpiredPITs()
+	if idx.pits == nil {
+		idx.pits = make(map[string]*pointInTime)
+	}
+	idx.pits[id] = &pointInTime{segs: segs, expires: time.Now().Add(keepAlive)}
+	return id, nil
+}
+
+// Returns false if there is no open view with the ID.
+func (idx *Index) ClosePointInTime(id string) bool {
+	idx.pitMu.Lock()
+	defer idx.pitMu.Unlock()
+
+	idx.dropExpiredPITs()
+	pit, ok := idx.pits[id]
+	if !ok {
+		return false
+	}
+	pit.close()
+	delete(idx.pits, id)
+	return true
+}
+
+// Segments of an open view, which is kept alive for another keepAlive. The caller releases
+// them with close once it is done searching them, since the view can be closed meanwhile.
+func (idx *Index) pointInTimeSegments(id string, keepAlive time.Duration) ([]*Segment, error) {
+
+	if keepAlive < 0 || keepAlive > MaxPITKeepAlive {
+		return nil, ErrInvalidKeepAlive
+	}
+
+	idx.pitMu.Lock()
+	defer idx.pitMu.Unlock()
+
+	idx.dropExpiredPITs()
+	pit, ok := idx.pits[id]
+	if !ok {
+		return nil, ErrPITNotFound
+	}
+	if keepAlive > 0 {
+		pit.expires = time.Now().Add(keepAlive)
+	}
+	for _, seg := range pit.segs {
+		seg.incRef()
+	}
+	return append([]*Segment(nil), pit.segs...), nil
+}
+
+func (pit *pointInTime) close() {
+	for _, seg := range pit.segs {
+		seg.close()
+	}
+}
+
+// Needs pitMu.
+func (idx *Index) dropExpiredPITs() {
+	now := time.Now()
+	for id, pit := range idx.pits {
+		if now.After(pit.expires) {
+			pit.close()
+			delete(idx.pits, id)
+		}
+	}
+}
+
+// An immutable segment as it is now, holding a reference on its file. Only its tombstones
+// change later on, so the rest is shared.
+func (seg *Segment) pinned() *Segment {
+	seg.tombMu.RLock()
+	defer seg.tombMu.RUnlock()
+
+	tombstones := make(map[int]struct{}, len(seg.Tombstones))
+	for id := range seg.Tombstones {
+		tombstones[id] = struct{}{}
+	}
+	seg.incRef()
+
+	return &Segment{
+		Name:       seg.Name,
+		TermDict:   seg.TermDict,
+		ParentIdx:  seg.ParentIdx,
+		Tombstones: tombstones,
+		FieldStats: seg.FieldStats,
+		DocCount:   seg.DocCount,
+		ByteSize:   seg.ByteSize,
+	}
+}
+
+// A copy of the active segment, which keeps changing. Needs the active segment's lock.
+func (seg *Segment) frozen() *Segment {
+	c, _ := NewSegment(seg.Name, seg.ParentIdx)
+	c.TermDict = seg.TermDict.copy()
+	seg.tombMu.RLock()
+	for id := range seg.DocIDs {
+		c.DocIDs[id] = struct{}{}
+	}
+	seg.tombMu.RUnlock()
+	c.loadTombstones(seg.tombstoneIDs())
+	c.FieldLengths = seg.copyFieldLengths()
+	for field, fs := range seg.FieldStats {
+		c.FieldStats[field] = fs
+	}
+	c.Numeric = seg.copyNumeric()
+	c.DocCount = seg.DocCount
+	c.ByteSize = seg.ByteSize
+	return c
+}
+
+// Where the next page of a search starts, after the last hit of the previous one.
+// Clients get it as an opaque string.
+type SearchCursor struct {
+	Score float64 `json:"s"`
+	DocID int     `json:"d"`
+}
+
+func (c SearchCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func ParseSearchCursor(s string) (*SearchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &QueryError{Reason: "invalid search_after cursor"}
+	}
+
+	var c SearchCursor
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, &QueryError{Reason: "invalid search_after cursor"}
+	}
+	return &c, nil
+}
+
+// Hits after the cursor, in ranking order.
+func (c *SearchCursor) before(d RankedDoc) bool {
+	return rankedBefore(RankedDoc{Score: c.Score, DocID: c.DocID}, d)
+}
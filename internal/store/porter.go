@@ -0,0 +1,269 @@
+package store
+
+// Porter stemming algorithm (M.F. Porter, 1980), following the reference implementation
+// like Lucene's PorterStemmer does. Works on lowercase words, so it goes after the lowercase
+// filter. Words of up to 2 letters are left alone.
+
+type porterStemmer struct {
+	b []byte
+	// end of the word, and the end of the stem when a suffix matched
+	k, j int
+}
+
+func porterStem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+
+	z := &porterStemmer{b: []byte(word), k: len(word) - 1}
+	z.step1ab()
+	if z.k > 0 {
+		z.step1c()
+		z.step2()
+		z.step3()
+		z.step4()
+		z.step5()
+	}
+
+	return string(z.b[:z.k+1])
+}
+
+// b[i] is a consonant. y is one unless it follows a consonant.
+func (z *porterStemmer) cons(i int) bool {
+	switch z.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !z.cons(i-1)
+	}
+	return true
+}
+
+// Number of vowel consonant sequences in b[0..j], the m in [C](VC)^m[V].
+func (z *porterStemmer) m() int {
+	n, i := 0, 0
+	for {
+		if i > z.j {
+			return n
+		}
+		if !z.cons(i) {
+			break
+		}
+		i++
+	}
+	i++
+
+	for {
+		for {
+			if i > z.j {
+				return n
+			}
+			if z.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+		n++
+
+		for {
+			if i > z.j {
+				return n
+			}
+			if !z.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+	}
+}
+
+// b[0..j] contains a vowel.
+func (z *porterStemmer) vowelInStem() bool {
+	for i := 0; i <= z.j; i++ {
+		if !z.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// b[i-1..i] is a double consonant.
+func (z *porterStemmer) doubleC(i int) bool {
+	if i < 1 || z.b[i] != z.b[i-1] {
+		return false
+	}
+	return z.cons(i)
+}
+
+// b[i-2..i] is consonant vowel consonant and the last one is not w, x or y,
+// like in hop, but not in snow or box.
+func (z *porterStemmer) cvc(i int) bool {
+	if i < 2 || !z.cons(i) || z.cons(i-1) || !z.cons(i-2) {
+		return false
+	}
+	switch z.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// b[0..k] ends with s, sets j to the end of the stem if it does.
+func (z *porterStemmer) ends(s string) bool {
+	l := len(s)
+	if l > z.k+1 || string(z.b[z.k-l+1:z.k+1]) != s {
+		return false
+	}
+	z.j = z.k - l
+	return true
+}
+
+// Replaces b[j+1..k] with s.
+func (z *porterStemmer) setTo(s string) {
+	z.b = append(z.b[:z.j+1], s...)
+	z.k = z.j + len(s)
+}
+
+func (z *porterStemmer) r(s string) {
+	if z.m() > 0 {
+		z.setTo(s)
+	}
+}
+
+// Plurals and -ed or -ing: caresses -> caress, ponies -> poni, meetings -> meet.
+func (z *porterStemmer) step1ab() {
+	if z.b[z.k] == 's' {
+		if z.ends("sses") {
+			z.k -= 2
+		} else if z.ends("ies") {
+			z.setTo("i")
+		} else if z.b[z.k-1] != 's' {
+			z.k--
+		}
+	}
+
+	if z.ends("eed") {
+		if z.m() > 0 {
+			z.k--
+		}
+	} else if (z.ends("ed") || z.ends("ing")) && z.vowelInStem() {
+		z.k = z.j
+		if z.ends("at") {
+			z.setTo("ate")
+		} else if z.ends("bl") {
+			z.setTo("ble")
+		} else if z.ends("iz") {
+			z.setTo("ize")
+		} else if z.doubleC(z.k) {
+			z.k--
+			switch z.b[z.k] {
+			case 'l', 's', 'z':
+				z.k++
+			}
+		} else if z.j = z.k; z.m() == 1 && z.cvc(z.k) {
+			z.setTo("e")
+		}
+	}
+}
+
+// Turns a final y into i when there is another vowel in the stem.
+func (z *porterStemmer) step1c() {
+	if z.ends("y") && z.vowelInStem() {
+		z.b[z.k] = 'i'
+	}
+}
+
+// Suffix replacements tried in order, the first matching suffix decides.
+type porterRule struct {
+	suffix, replacement string
+}
+
+func (z *porterStemmer) replaceFirst(rules []porterRule) {
+	for _, rule := range rules {
+		if z.ends(rule.suffix) {
+			z.r(rule.replacement)
+			return
+		}
+	}
+}
+
+var porterStep2 = map[byte][]porterRule{
+	'a': {{"ational", "ate"}, {"tional", "tion"}},
+	'c': {{"enci", "ence"}, {"anci", "ance"}},
+	'e': {{"izer", "ize"}},
+	'l': {{"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"}},
+	'o': {{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}},
+	's': {{"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"}, {"ousness", "ous"}},
+	't': {{"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"}},
+	'g': {{"logi", "log"}},
+}
+
+// Double suffixes to single ones: relational -> relate, hopefulness -> hopeful.
+func (z *porterStemmer) step2() {
+	z.replaceFirst(porterStep2[z.b[z.k-1]])
+}
+
+var porterStep3 = map[byte][]porterRule{
+	'e': {{"icate", "ic"}, {"ative", ""}, {"alize", "al"}},
+	'i': {{"iciti", "ic"}},
+	'l': {{"ical", "ic"}, {"ful", ""}},
+	's': {{"ness", ""}},
+}
+
+// -ic-, -full, -ness and the like: electrical -> electric, goodness -> good.
+func (z *porterStemmer) step3() {
+	z.replaceFirst(porterStep3[z.b[z.k]])
+}
+
+var porterStep4 = map[byte][]string{
+	'a': {"al"},
+	'c': {"ance", "ence"},
+	'e': {"er"},
+	'i': {"ic"},
+	'l': {"able", "ible"},
+	'n': {"ant", "ement", "ment", "ent"},
+	'o': {"ion", "ou"},
+	's': {"ism"},
+	't': {"ate", "iti"},
+	'u': {"ous"},
+	'v': {"ive"},
+	'z': {"ize"},
+}
+
+// Takes off -ant, -ence and the like when the stem is long enough: adjustment -> adjust.
+func (z *porterStemmer) step4() {
+	if z.k < 1 {
+		return
+	}
+
+	for _, suffix := range porterStep4[z.b[z.k-1]] {
+		if !z.ends(suffix) {
+			continue
+		}
+		// -ion only after s or t
+		if suffix == "ion" && (z.j < 0 || (z.b[z.j] != 's' && z.b[z.j] != 't')) {
+			continue
+		}
+
+		if z.m() > 1 {
+			z.k = z.j
+		}
+		return
+	}
+}
+
+// Removes a final -e and turns -ll into -l when the stem is long enough.
+func (z *porterStemmer) step5() {
+	z.j = z.k
+	if z.b[z.k] == 'e' {
+		a := z.m()
+		if a > 1 || a == 1 && !z.cvc(z.k-1) {
+			z.k--
+		}
+	}
+	if z.b[z.k] == 'l' && z.doubleC(z.k) && z.m() > 1 {
+		z.k--
+	}
+}
@@ -0,0 +1,134 @@
+package store
+
+import "testing"
+
+// Pairs of words and their stems from the voc.txt and output.txt of the reference
+// implementation, and the examples of Porter's paper.
+func TestPorterStem(t *testing.T) {
+	tests := []struct {
+		word, stem string
+	}{
+		// step 1a
+		{"caresses", "caress"},
+		{"ponies", "poni"},
+		{"ties", "ti"},
+		{"caress", "caress"},
+		{"cats", "cat"},
+
+		// step 1b
+		{"feed", "feed"},
+		{"agreed", "agre"},
+		{"plastered", "plaster"},
+		{"bled", "bled"},
+		{"motoring", "motor"},
+		{"sing", "sing"},
+		{"conflated", "conflat"},
+		{"troubled", "troubl"},
+		{"sized", "size"},
+		{"hopping", "hop"},
+		{"tanned", "tan"},
+		{"falling", "fall"},
+		{"hissing", "hiss"},
+		{"fizzed", "fizz"},
+		{"failing", "fail"},
+		{"filing", "file"},
+
+		// step 1c
+		{"happy", "happi"},
+		{"sky", "sky"},
+
+		// step 2
+		{"relational", "relat"},
+		{"conditional", "condit"},
+		{"rational", "ration"},
+		{"valenci", "valenc"},
+		{"hesitanci", "hesit"},
+		{"digitizer", "digit"},
+		{"conformabli", "conform"},
+		{"radicalli", "radic"},
+		{"differentli", "differ"},
+		{"vileli", "vile"},
+		{"analogousli", "analog"},
+		{"vietnamization", "vietnam"},
+		{"predication", "predic"},
+		{"operator", "oper"},
+		{"feudalism", "feudal"},
+		{"decisiveness", "decis"},
+		{"hopefulness", "hope"},
+		{"callousness", "callous"},
+		{"formaliti", "formal"},
+		{"sensitiviti", "sensit"},
+		{"sensibiliti", "sensibl"},
+
+		// step 3
+		{"triplicate", "triplic"},
+		{"formative", "form"},
+		{"formalize", "formal"},
+		{"electriciti", "electr"},
+		{"electrical", "electr"},
+		{"hopeful", "hope"},
+		{"goodness", "good"},
+
+		// step 4
+		{"revival", "reviv"},
+		{"allowance", "allow"},
+		{"inference", "infer"},
+		{"airliner", "airlin"},
+		{"gyroscopic", "gyroscop"},
+		{"adjustable", "adjust"},
+		{"defensible", "defens"},
+		{"irritant", "irrit"},
+		{"replacement", "replac"},
+		{"adjustment", "adjust"},
+		{"dependent", "depend"},
+		{"adoption", "adopt"},
+		{"homologou", "homolog"},
+		{"communism", "commun"},
+		{"activate", "activ"},
+		{"angulariti", "angular"},
+		{"homologous", "homolog"},
+		{"effective", "effect"},
+		{"bowdlerize", "bowdler"},
+
+		// step 5
+		{"probate", "probat"},
+		{"rate", "rate"},
+		{"cease", "ceas"},
+		{"controll", "control"},
+		{"roll", "roll"},
+
+		// voc.txt
+		{"consign", "consign"},
+		{"consigned", "consign"},
+		{"consignment", "consign"},
+		{"consistency", "consist"},
+		{"consistently", "consist"},
+		{"consolation", "consol"},
+		{"consolatory", "consolatori"},
+		{"consolidating", "consolid"},
+		{"consolingly", "consolingli"},
+		{"conspicuously", "conspicu"},
+		{"conspiracy", "conspiraci"},
+		{"conspirators", "conspir"},
+		{"constable", "constabl"},
+		{"constancy", "constanc"},
+		{"generalizations", "gener"},
+		{"oscillators", "oscil"},
+		{"knackeries", "knackeri"},
+		{"kneeled", "kneel"},
+		{"knightly", "knightli"},
+		{"knitting", "knit"},
+		{"knives", "knive"},
+		{"knocker", "knocker"},
+
+		// words of up to 2 letters are left alone
+		{"as", "as"},
+		{"is", "is"},
+	}
+
+	for _, tt := range tests {
+		if got := porterStem(tt.word); got != tt.stem {
+			t.Errorf("porterStem(%q) = %q, want %q", tt.word, got, tt.stem)
+		}
+	}
+}
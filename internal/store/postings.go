@@ -0,0 +1,360 @@
+package store
+
+import (
+	"encoding/binary"
+	"slices"
+	"sort"
+)
+
+// Postings of a term in a segment file. Doc IDs are delta encoded in blocks of
+// postingsBlockSize docs, and freqs and positions are kept in streams of their own, so
+// walking the docs of a term does not decode positions nobody asks for:
+//
+//	header     docs length, freqs length (uvarints)
+//	skips      per block when there is more than one: last doc ID delta, docs, freqs
+//	           and positions lengths of the block (uvarints)
+//	docs       doc ID deltas, the first doc of a block from the last doc of the one before
+//	freqs      freq of each doc
+//	positions  position deltas of each doc, from 0 for its first position
+//
+// The skips let a conjunction jump straight to the block that can hold the doc it looks
+// for, like Lucene's skip lists.
+
+const postingsBlockSize = 128
+
+// Walks the docs of a term in ascending order, like Lucene's PostingsEnum.
+type postingsIterator interface {
+	// moves to the next doc, false past the last one
+	nextDoc() bool
+	// moves to the first doc not before target, false if there is none
+	advance(target int) bool
+	// current doc, -1 before the first one
+	doc() int
+	freq() int
+	positions() []int
+	// number of docs of the term
+	cost() int
+}
+
+// Appends the postings of a term in the segment file layout.
+func appendPostings(b []byte, td TermData) []byte {
+
+	docIDs := make([]int, 0, len(td))
+	for docID := range td {
+		docIDs = append(docIDs, docID)
+	}
+	sort.Ints(docIDs)
+
+	var skips, docs, freqs, positions []byte
+	prevDoc := 0
+	for start := 0; start < len(docIDs); start += postingsBlockSize {
+		blockStart, docsStart, freqsStart, positionsStart := prevDoc, len(docs), len(freqs), len(positions)
+
+		for _, docID := range docIDs[start:min(start+postingsBlockSize, len(docIDs))] {
+			docs = binary.AppendUvarint(docs, uint64(docID-prevDoc))
+			prevDoc = docID
+
+			ps := td[docID]
+			freqs = binary.AppendUvarint(freqs, uint64(len(ps)))
+			prevPos := 0
+			for _, p := range ps {
+				positions = binary.AppendUvarint(positions, uint64(p-prevPos))
+				prevPos = p
+			}
+		}
+
+		skips = binary.AppendUvarint(skips, uint64(prevDoc-blockStart))
+		skips = binary.AppendUvarint(skips, uint64(len(docs)-docsStart))
+		skips = binary.AppendUvarint(skips, uint64(len(freqs)-freqsStart))
+		skips = binary.AppendUvarint(skips, uint64(len(positions)-positionsStart))
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(docs)))
+	b = binary.AppendUvarint(b, uint64(len(freqs)))
+	if len(docIDs) > postingsBlockSize {
+		b = append(b, skips...)
+	}
+	b = append(b, docs...)
+	b = append(b, freqs...)
+	return append(b, positions...)
+}
+
+// Where a block of postings starts, offsets are from the start of each stream.
+type postingsSkip struct {
+	// last doc of the block
+	lastDoc                   int
+	docsOff, freqsOff, posOff int
+}
+
+// Reads the postings of a term, from a segment file or an in memory dict.
+type blockPostings struct {
+	// the streams, in a segment file or an in memory dict
+	docs, freqs, pos []byte
+	df               int
+	skips            []postingsSkip
+
+	// ordinal of the current doc, and offsets of what comes after it in each stream
+	i                         int
+	cur, curFreq              int
+	docsOff, freqsOff, posOff int
+	// doc the next doc ID delta is from
+	base int
+	// positions of the docs passed over without reading them, skipped before reading more
+	pendingPos int
+	curPos     []int
+	posRead    bool
+}
+
+func (sf *segmentFile) blockPostings(e termEntry) *blockPostings {
+	end := sf.termsOffset
+	off := e.postings
+	docsLen, _ := sf.uvarint(&off, end)
+	freqsLen, _ := sf.uvarint(&off, end)
+
+	p := &blockPostings{df: e.docFreq, i: -1, cur: -1, posRead: true}
+
+	if blocks := (e.docFreq + postingsBlockSize - 1) / postingsBlockSize; blocks > 1 {
+		lens := make([][4]uint64, blocks)
+		for b := range lens {
+			for j := range lens[b] {
+				lens[b][j], _ = sf.uvarint(&off, end)
+			}
+		}
+
+		p.skips = make([]postingsSkip, blocks)
+		var s postingsSkip
+		for b, l := range lens {
+			s.lastDoc += int(l[0])
+			p.skips[b] = s
+			s.docsOff, s.freqsOff, s.posOff = s.docsOff+int(l[1]), s.freqsOff+int(l[2]), s.posOff+int(l[3])
+		}
+	}
+
+	// the positions run up to the postings of the next term at most
+	freqsOff := off + int(docsLen)
+	posOff := freqsOff + int(freqsLen)
+	p.docs, p.freqs, p.pos = sf.data[off:freqsOff], sf.data[freqsOff:posOff], sf.data[posOff:end]
+	return p
+}
+
+// Reads the uvarint at *off and moves past it, 0 past the end of b.
+func readUvarint(b []byte, off *int) int {
+	if *off >= len(b) {
+		return 0
+	}
+	v, n := binary.Uvarint(b[*off:])
+	if n <= 0 {
+		return 0
+	}
+	*off += n
+	return int(v)
+}
+
+func (p *blockPostings) nextDoc() bool {
+	if p.i+1 >= p.df {
+		p.i, p.cur = p.df, noMoreDocs
+		return false
+	}
+	if !p.posRead {
+		p.pendingPos += p.curFreq
+	}
+
+	p.base += readUvarint(p.docs, &p.docsOff)
+	freq := readUvarint(p.freqs, &p.freqsOff)
+	p.i, p.cur, p.curFreq, p.posRead = p.i+1, p.base, freq, false
+	return true
+}
+
+func (p *blockPostings) advance(target int) bool {
+	if p.cur >= target {
+		return p.cur != noMoreDocs
+	}
+
+	if p.skips != nil {
+		b := sort.Search(len(p.skips), func(b int) bool { return p.skips[b].lastDoc >= target })
+		if b == len(p.skips) {
+			p.i, p.cur = p.df, noMoreDocs
+			return false
+		}
+
+		// jump to the block when it is past the current one, the docs in between are skipped
+		// without decoding them
+		if b > max(p.i, 0)/postingsBlockSize {
+			s := p.skips[b]
+			p.i = b*postingsBlockSize - 1
+			p.base = p.skips[b-1].lastDoc
+			p.docsOff, p.freqsOff, p.posOff = s.docsOff, s.freqsOff, s.posOff
+			p.pendingPos, p.curFreq, p.posRead = 0, 0, true
+		}
+	}
+
+	for p.nextDoc() {
+		if p.cur >= target {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *blockPostings) doc() int {
+	return p.cur
+}
+
+func (p *blockPostings) freq() int {
+	return p.curFreq
+}
+
+func (p *blockPostings) positions() []int {
+	if p.posRead {
+		return p.curPos
+	}
+
+	for ; p.pendingPos > 0; p.pendingPos-- {
+		readUvarint(p.pos, &p.posOff)
+	}
+
+	p.curPos = make([]int, p.curFreq)
+	pos := 0
+	for j := range p.curPos {
+		pos += readUvarint(p.pos, &p.posOff)
+		p.curPos[j] = pos
+	}
+	p.posRead = true
+	return p.curPos
+}
+
+func (p *blockPostings) cost() int {
+	return p.df
+}
+
+// Postings of a term of an in memory dict, in the same streams as in a segment file but
+// growing as docs are added, with the skip of each block of postingsBlockSize docs. Docs
+// are mostly added in ascending order and appended, the others rebuild the streams, like
+// removing a doc does.
+type memPostings struct {
+	docs, freqs, pos []byte
+	skips            []postingsSkip
+	df               int
+}
+
+func newMemPostings(td TermData) *memPostings {
+	docIDs := make([]int, 0, len(td))
+	for docID := range td {
+		docIDs = append(docIDs, docID)
+	}
+	sort.Ints(docIDs)
+
+	mp := &memPostings{}
+	for _, docID := range docIDs {
+		mp.append(docID, td[docID])
+	}
+	return mp
+}
+
+// Appends a doc after the last one.
+func (mp *memPostings) append(docID int, positions []int) {
+	base := 0
+	if mp.df > 0 {
+		base = mp.skips[len(mp.skips)-1].lastDoc
+	}
+	if mp.df%postingsBlockSize == 0 {
+		mp.skips = append(mp.skips, postingsSkip{docsOff: len(mp.docs), freqsOff: len(mp.freqs), posOff: len(mp.pos)})
+	}
+
+	mp.docs = binary.AppendUvarint(mp.docs, uint64(docID-base))
+	mp.freqs = binary.AppendUvarint(mp.freqs, uint64(len(positions)))
+	prev := 0
+	for _, p := range positions {
+		mp.pos = binary.AppendUvarint(mp.pos, uint64(p-prev))
+		prev = p
+	}
+
+	mp.skips[len(mp.skips)-1].lastDoc = docID
+	mp.df++
+}
+
+// Adds or replaces the positions of a doc.
+func (mp *memPostings) add(docID int, positions []int) {
+	if mp.df == 0 || docID > mp.skips[len(mp.skips)-1].lastDoc {
+		mp.append(docID, positions)
+		return
+	}
+
+	td := mp.termData()
+	td[docID] = positions
+	*mp = *newMemPostings(td)
+}
+
+// Drops the doc, and returns how many docs are left.
+func (mp *memPostings) remove(docID int) int {
+	td := mp.termData()
+	delete(td, docID)
+	*mp = *newMemPostings(td)
+	return mp.df
+}
+
+func (mp *memPostings) termData() TermData {
+	td := make(TermData, mp.df)
+	p := mp.iterator()
+	for p.nextDoc() {
+		td[p.doc()] = p.positions()
+	}
+	return td
+}
+
+func (mp *memPostings) iterator() *blockPostings {
+	return &blockPostings{docs: mp.docs, freqs: mp.freqs, pos: mp.pos, skips: mp.skips, df: mp.df, i: -1, cur: -1, posRead: true}
+}
+
+// Deep copy, the active segment keeps changing.
+func (mp *memPostings) clone() *memPostings {
+	return &memPostings{
+		docs:  slices.Clone(mp.docs),
+		freqs: slices.Clone(mp.freqs),
+		pos:   slices.Clone(mp.pos),
+		skips: slices.Clone(mp.skips),
+		df:    mp.df,
+	}
+}
+
+// Past the last doc of every iterator.
+const noMoreDocs = int(^uint(0) >> 1)
+
+// Calls fn with every doc all the iterators have, in ascending order. The iterator with the
+// fewest docs leads, and the others advance to its docs, skipping the blocks in between.
+func intersect(its []postingsIterator, fn func(docID int)) {
+	if len(its) == 0 {
+		return
+	}
+
+	its = append([]postingsIterator(nil), its...)
+	sort.SliceStable(its, func(i, j int) bool { return its[i].cost() < its[j].cost() })
+
+	lead := its[0]
+	if !lead.nextDoc() {
+		return
+	}
+
+	for target := lead.doc(); ; {
+		agreed := true
+		for _, it := range its[1:] {
+			if !it.advance(target) {
+				return
+			}
+			if it.doc() > target {
+				target, agreed = it.doc(), false
+				break
+			}
+		}
+
+		if agreed {
+			fn(target)
+			if !lead.nextDoc() {
+				return
+			}
+		} else if !lead.advance(target) {
+			return
+		}
+		target = lead.doc()
+	}
+}
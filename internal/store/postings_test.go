@@ -0,0 +1,189 @@
+package store
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Postings of n docs out of the first maxDoc, each with a few positions.
+func randomTermData(r *rand.Rand, n, maxDoc int) TermData {
+	td := make(TermData, n)
+	for len(td) < n {
+		positions := make([]int, 1+r.Intn(4))
+		p := 0
+		for i := range positions {
+			p += 1 + r.Intn(10)
+			positions[i] = p
+		}
+		td[r.Intn(maxDoc)] = positions
+	}
+	return td
+}
+
+// Block postings of the term data, read back from a segment file.
+func encodedPostings(t *testing.T, td TermData) postingsIterator {
+	var buf bytes.Buffer
+	if err := writeSegmentFile(&buf, []Term{"f:x"}, func(Term) TermData { return td }, docColumns{}); err != nil {
+		t.Fatal(err)
+	}
+	sf, err := parseSegmentFile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := sf.lookup("f:x")
+	return sf.blockPostings(e)
+}
+
+// The same postings in memory, built like the active segment builds them: mostly in
+// ascending order, a few docs out of order, and a doc that is removed again.
+func memPostingsOf(r *rand.Rand, td TermData) *memPostings {
+	var late []int
+	mp := &memPostings{}
+	for _, docID := range sortedDocs(td) {
+		if r.Intn(20) == 0 {
+			late = append(late, docID)
+		} else {
+			mp.add(docID, td[docID])
+		}
+	}
+	for _, docID := range late {
+		mp.add(docID, td[docID])
+	}
+
+	removed := r.Intn(2 * len(td))
+	if _, ok := td[removed]; !ok {
+		mp.add(removed, []int{1})
+		mp.remove(removed)
+	}
+	return mp
+}
+
+func sortedDocs(td TermData) []int {
+	docIDs := make([]int, 0, len(td))
+	for docID := range td {
+		docIDs = append(docIDs, docID)
+	}
+	sort.Ints(docIDs)
+	return docIDs
+}
+
+func TestBlockPostingsAdvance(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		docs, maxDoc int
+	}{
+		{1, 10},
+		{postingsBlockSize - 1, 1000},
+		{postingsBlockSize, postingsBlockSize},
+		{postingsBlockSize + 1, 1000},
+		{3 * postingsBlockSize, 3 * postingsBlockSize},
+		{1000, 50000},
+		{5000, 6000},
+	}
+
+	for _, tt := range tests {
+		td := randomTermData(r, tt.docs, tt.maxDoc)
+		docIDs := sortedDocs(td)
+		mp := memPostingsOf(r, td)
+
+		for rep := 0; rep < 50; rep++ {
+			// the active segment's postings are read the same way
+			it := encodedPostings(t, td)
+			if rep%2 == 1 {
+				it = mp.iterator()
+			}
+			if it.cost() != len(docIDs) {
+				t.Fatalf("%d docs: cost %d", tt.docs, it.cost())
+			}
+			if it.doc() != -1 {
+				t.Fatalf("%d docs: doc %d before the first one", tt.docs, it.doc())
+			}
+
+			// the naive walk is an index into the sorted doc IDs
+			i := -1
+			for {
+				var ok bool
+				if r.Intn(2) == 0 {
+					ok = it.nextDoc()
+					i++
+				} else {
+					target := max(it.doc(), 0) + r.Intn(3*postingsBlockSize)
+					ok = it.advance(target)
+					if i < 0 || docIDs[i] < target {
+						i = sort.SearchInts(docIDs, target)
+					}
+				}
+
+				if i >= len(docIDs) {
+					if ok || it.doc() != noMoreDocs {
+						t.Fatalf("%d docs: got doc %d past the last one", tt.docs, it.doc())
+					}
+					break
+				}
+				if !ok || it.doc() != docIDs[i] {
+					t.Fatalf("%d docs: got doc %d (%v), want %d", tt.docs, it.doc(), ok, docIDs[i])
+				}
+				if it.freq() != len(td[docIDs[i]]) {
+					t.Fatalf("%d docs: doc %d has freq %d, want %d", tt.docs, docIDs[i], it.freq(), len(td[docIDs[i]]))
+				}
+				// positions are only read for some docs, the rest are skipped over
+				if r.Intn(3) == 0 && !reflect.DeepEqual(it.positions(), td[docIDs[i]]) {
+					t.Fatalf("%d docs: doc %d has positions %v, want %v", tt.docs, docIDs[i], it.positions(), td[docIDs[i]])
+				}
+			}
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+
+	tests := []struct {
+		docs   []int
+		maxDoc int
+	}{
+		{[]int{10, 10}, 20},
+		{[]int{5, 3000}, 5000},
+		{[]int{3000, 2000, 4000}, 5000},
+		{[]int{200, 200}, 100000},
+		{[]int{postingsBlockSize + 1, 1000, 1}, 2000},
+		{[]int{1000, 1000, 1000, 1000}, 1500},
+	}
+
+	for _, tt := range tests {
+		for rep := 0; rep < 20; rep++ {
+			var its []postingsIterator
+			count := make(map[int]int)
+			for j, n := range tt.docs {
+				td := randomTermData(r, n, tt.maxDoc)
+				for docID := range td {
+					count[docID]++
+				}
+				// in memory postings take part in conjunctions too
+				if j == 0 && rep%2 == 1 {
+					its = append(its, memPostingsOf(r, td).iterator())
+				} else {
+					its = append(its, encodedPostings(t, td))
+				}
+			}
+
+			var want []int
+			for docID, c := range count {
+				if c == len(tt.docs) {
+					want = append(want, docID)
+				}
+			}
+			sort.Ints(want)
+
+			var got []int
+			intersect(its, func(docID int) { got = append(got, docID) })
+			if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("%v docs: got %v, want %v", tt.docs, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gocene/config"
+	"gocene/internal/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/minio/minio-go/v7"
+)
+
+// Bodies carried by reference are read from Minio before the log entries referring to them
+// are stored in this node's Raft log, and kept in the Raft directory until those entries are
+// compacted into a snapshot. Applying an entry, or replaying it after a restart, reads them
+// from disk and never waits on Minio. A follower that cannot read a body fails the
+// AppendEntries without storing the entries, and the leader sends them again. The leader
+// keeps the bodies it stores before committing them, since it steps down when it cannot
+// store its own entries.
+
+// how long a node waits at first to read a body again, how long at most, and how many times
+// it tries before giving up on the entries
+const (
+	blobReadBackoff    = 100 * time.Millisecond
+	blobReadMaxBackoff = time.Second
+	blobReadAttempts   = 5
+)
+
+type bodyCache struct {
+	dir string
+
+	// bodies on disk, guarded by mu
+	bodies map[string]*cachedBody
+	mu     sync.Mutex
+}
+
+type cachedBody struct {
+	// last log entry referring to the body, 0 while none is stored yet
+	logIndex uint64
+	// when the leader stored the body for an entry it is committing
+	kept time.Time
+}
+
+// Opens the cache in dir, with the bodies already there referred to by no entry until the
+// log is read again.
+func newBodyCache(dir string) (*bodyCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &bodyCache{dir: dir, bodies: make(map[string]*cachedBody)}
+	for _, e := range entries {
+		if sha, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			c.bodies[sha] = &cachedBody{}
+		} else {
+			// left behind by a crash while writing
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return c, nil
+}
+
+func (c *bodyCache) path(sha string) string {
+	return filepath.Join(c.dir, sha+".json")
+}
+
+// Notes that the log entry at logIndex refers to the body, false if it is not on disk.
+func (c *bodyCache) refer(sha string, logIndex uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.bodies[sha]
+	if ok {
+		b.logIndex = max(b.logIndex, logIndex)
+	}
+	return ok
+}
+
+// Writes the body to disk, for the log entry at logIndex or for one the leader is committing
+// when 0. It is renamed into place, so a crash never leaves a partial body under its name.
+func (c *bodyCache) put(sha string, data []byte, logIndex uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.bodies[sha]
+	if !ok {
+		tmp, err := os.CreateTemp(c.dir, sha+".*.tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+
+		_, err = tmp.Write(data)
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), c.path(sha))
+		}
+		if err != nil {
+			return err
+		}
+
+		b = &cachedBody{}
+		c.bodies[sha] = b
+	}
+
+	b.logIndex = max(b.logIndex, logIndex)
+	if logIndex == 0 {
+		b.kept = time.Now()
+	}
+	return nil
+}
+
+// Body as written by put.
+func (c *bodyCache) read(sha string) ([]byte, error) {
+	return os.ReadFile(c.path(sha))
+}
+
+// Removes the bodies only referred to by entries up to the snapshot, which are never applied
+// again. Bodies the leader kept for an entry not stored yet stay for the Raft timeout.
+func (c *bodyCache) prune(snapshotIndex uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for sha, b := range c.bodies {
+		if b.logIndex > snapshotIndex || time.Since(b.kept) < config.RaftTimeout {
+			continue
+		}
+		if err := os.Remove(c.path(sha)); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not remove cached body %s, err: %v\n", sha, err)
+			continue
+		}
+		delete(c.bodies, sha)
+	}
+}
+
+// The node's log store, reading the bodies the entries carry by reference before storing them.
+type prefetchLogStore struct {
+	raft.LogStore
+	s *Store
+}
+
+func (ls prefetchLogStore) StoreLog(l *raft.Log) error {
+	return ls.StoreLogs([]*raft.Log{l})
+}
+
+func (ls prefetchLogStore) StoreLogs(logs []*raft.Log) error {
+	for _, l := range logs {
+		if err := ls.s.prefetchBodies(l); err != nil {
+			log.Printf("could not read the bodies of log entry %d, not storing it, err: %v\n", l.Index, err)
+			return err
+		}
+	}
+	return ls.LogStore.StoreLogs(logs)
+}
+
+// Reads the bodies the entry carries by reference into the cache, unless they are there already.
+func (s *Store) prefetchBodies(l *raft.Log) error {
+	if l.Type != raft.LogCommand {
+		return nil
+	}
+
+	var c Command
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		// applying it fails the same way
+		return nil
+	}
+
+	for _, p := range c.Docs {
+		if p.Data != nil || s.bodies.refer(p.SHA256, l.Index) {
+			continue
+		}
+
+		data, err := readBlob(s.mc, c.IdxName, p.SHA256)
+		if err != nil {
+			return err
+		}
+		if err = s.bodies.put(p.SHA256, data, l.Index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a body from Minio and checks it against its SHA-256, trying again a few times while
+// Minio does not answer.
+func readBlob(mc *minio.Client, idxName, sha string) (data []byte, err error) {
+	backoff := blobReadBackoff
+	for attempt := 1; ; attempt++ {
+		data, err = utils.GetBlobFromMinio(mc, sha, idxName)
+		if err == nil || err == utils.ErrObjectNotFound || attempt == blobReadAttempts {
+			break
+		}
+		log.Printf("could not read doc body %s, attempt %d, err: %v\n", sha, attempt, err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, blobReadMaxBackoff)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != sha {
+		return nil, ErrDocumentChecksum
+	}
+	return data, nil
+}
+
+// Reads the bodies of the entries stored after the latest snapshot, which are applied again
+// once Raft starts, and drops the ones no entry needs anymore.
+func (s *Store) prefetchStoredBodies(logs raft.LogStore, snapshots raft.SnapshotStore) error {
+
+	snapshotIndex, err := latestSnapshotIndex(snapshots)
+	if err != nil {
+		return err
+	}
+
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	for i := max(first, snapshotIndex+1); i <= last && i > 0; i++ {
+		var l raft.Log
+		if err = logs.GetLog(i, &l); err == raft.ErrLogNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = s.prefetchBodies(&l); err != nil {
+			return err
+		}
+	}
+
+	s.bodies.prune(snapshotIndex)
+	return nil
+}
+
+// Index of the last entry of the latest snapshot, 0 without one.
+func latestSnapshotIndex(snapshots raft.SnapshotStore) (uint64, error) {
+	metas, err := snapshots.List()
+	if err != nil || len(metas) == 0 {
+		return 0, err
+	}
+	return metas[0].Index, nil
+}
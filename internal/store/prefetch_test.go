@@ -0,0 +1,91 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestBodyCachePrune(t *testing.T) {
+	c, err := newBodyCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(sha string, logIndex uint64) {
+		if err := c.put(sha, []byte(`{"sha":"`+sha+`"}`), logIndex); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a is referred to by entries 3 and 8, b by 5, c is kept by the leader for an entry not
+	// stored yet, and d was kept long enough ago for that entry to have failed
+	put("a", 3)
+	put("b", 5)
+	put("c", 0)
+	put("d", 0)
+	c.bodies["d"].kept = time.Now().Add(-2 * time.Hour)
+	if !c.refer("a", 8) {
+		t.Fatal("a is not in the cache")
+	}
+	if c.refer("e", 8) {
+		t.Fatal("e is in the cache without being put")
+	}
+
+	c.prune(5)
+
+	tests := []struct {
+		sha  string
+		kept bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+		{"d", false},
+	}
+	for _, tt := range tests {
+		data, err := c.read(tt.sha)
+		if tt.kept && (err != nil || string(data) != `{"sha":"`+tt.sha+`"}`) {
+			t.Errorf("%s: got %q, %v, want it kept", tt.sha, data, err)
+		} else if !tt.kept && err == nil {
+			t.Errorf("%s: still cached after pruning", tt.sha)
+		}
+	}
+
+	// the bodies on disk are found again after a restart
+	reopened, err := newBodyCache(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.refer("a", 9) || !reopened.refer("c", 9) || reopened.refer("b", 9) {
+		t.Errorf("got %v cached after reopening, want a and c", reopened.bodies)
+	}
+}
+
+func TestPrefetchInlineBodies(t *testing.T) {
+	c, err := newBodyCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Store{bodies: c}
+
+	// inline bodies and bodies already cached need no Minio, which this store has none of
+	if err = c.put("b", []byte(`{}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	l := &raft.Log{
+		Index: 7,
+		Type:  raft.LogCommand,
+		Data:  []byte(`{"CmdId":5,"IdxName":"test","DocIDs":[1,2],"Docs":[{"Data":{},"SHA256":"a"},{"SHA256":"b"}]}`),
+	}
+	if err = s.prefetchBodies(l); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.bodies["b"].logIndex; got != 7 {
+		t.Errorf("got b referred to by entry %d, want 7", got)
+	}
+	if _, ok := c.bodies["a"]; ok {
+		t.Error("inline body a was cached")
+	}
+}
@@ -0,0 +1,474 @@
+package store
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Query is run against every segment of an index. The index-wide statistics of the
+// terms it scores with are collected first, so scores are comparable across segments.
+type Query interface {
+	// terms the query is scored with
+	ScoringTerms() []Term
+	// live docs of the segment matching the query, and their scores
+	Search(seg *Segment, stats *IndexStats) (map[int]float64, error)
+}
+
+// Matches docs containing any of the terms, scored by the sum of their BM25 scores.
+type MatchQuery struct {
+	Terms []Term
+	// docs need at least this many of the terms, 0 or 1 means any of them
+	MinimumShouldMatch int
+}
+
+func NewMatchQuery(terms []Term) *MatchQuery {
+	return &MatchQuery{Terms: terms}
+}
+
+func (q *MatchQuery) ScoringTerms() []Term {
+	return q.Terms
+}
+
+func (q *MatchQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+
+	if len(q.Terms) > 1 && q.MinimumShouldMatch == len(q.Terms) {
+		return q.searchAll(seg, stats), nil
+	}
+
+	hits := make(map[int]float64)
+	matched := make(map[int]int)
+	for _, term := range q.Terms {
+		tempRes, err := seg.SearchTerm(term, stats)
+		if err != nil && err != ErrTermNotFound {
+			return nil, err
+		}
+
+		for _, iter := range tempRes {
+			if seg.isDeleted(iter.DocID) {
+				continue
+			}
+			hits[iter.DocID] += iter.Score
+			matched[iter.DocID]++
+		}
+	}
+
+	if q.MinimumShouldMatch > 1 {
+		for docID, n := range matched {
+			if n < q.MinimumShouldMatch {
+				delete(hits, docID)
+			}
+		}
+	}
+
+	return hits, nil
+}
+
+// Docs having every term, found by intersecting the postings of the terms rather than
+// reading all of them.
+func (q *MatchQuery) searchAll(seg *Segment, stats *IndexStats) map[int]float64 {
+
+	hits := make(map[int]float64)
+	its := make([]postingsIterator, len(q.Terms))
+	lengths := make([]fieldLengths, len(q.Terms))
+	for i, t := range q.Terms {
+		it, found := seg.TermDict.postingsIterator(t)
+		if !found {
+			return hits
+		}
+		its[i] = it
+		lengths[i] = seg.fieldLengths(t.Field())
+	}
+
+	intersect(its, func(docID int) {
+		if seg.isDeleted(docID) {
+			return
+		}
+		for i, t := range q.Terms {
+			hits[docID] += stats.Score(t, its[i].freq(), lengths[i].get(docID))
+		}
+	})
+	return hits
+}
+
+// Matches every live doc with the same score.
+type MatchAllQuery struct{}
+
+func (q *MatchAllQuery) ScoringTerms() []Term {
+	return nil
+}
+
+func (q *MatchAllQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+	hits := make(map[int]float64)
+	for _, docID := range seg.liveDocs() {
+		hits[docID] = 1
+	}
+	return hits, nil
+}
+
+// Combines clauses like Lucene's BooleanQuery. Docs have to match every Must and Filter
+// clause and none of the MustNot ones. Should clauses add to the score, and at least
+// MinimumShouldMatch of them have to match. Only Must and Should clauses are scored.
+type BoolQuery struct {
+	Must    []Query
+	Should  []Query
+	MustNot []Query
+	Filter  []Query
+
+	MinimumShouldMatch int
+}
+
+func (q *BoolQuery) ScoringTerms() (terms []Term) {
+	for _, sub := range q.Must {
+		terms = append(terms, sub.ScoringTerms()...)
+	}
+	for _, sub := range q.Should {
+		terms = append(terms, sub.ScoringTerms()...)
+	}
+	return
+}
+
+func (q *BoolQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+
+	// nil until a required clause narrows down the candidates
+	var hits map[int]float64
+
+	required := append(append([]Query(nil), q.Must...), q.Filter...)
+	for i, sub := range required {
+		subHits, err := sub.Search(seg, stats)
+		if err != nil {
+			return nil, err
+		}
+		scoring := i < len(q.Must)
+
+		if hits == nil {
+			hits = make(map[int]float64, len(subHits))
+			for docID, score := range subHits {
+				if !scoring {
+					score = 0
+				}
+				hits[docID] = score
+			}
+			continue
+		}
+
+		for docID := range hits {
+			score, ok := subHits[docID]
+			if !ok {
+				delete(hits, docID)
+			} else if scoring {
+				hits[docID] += score
+			}
+		}
+	}
+
+	if len(q.Should) > 0 {
+		matched := make(map[int]int)
+		scores := make(map[int]float64)
+		for _, sub := range q.Should {
+			subHits, err := sub.Search(seg, stats)
+			if err != nil {
+				return nil, err
+			}
+			for docID, score := range subHits {
+				matched[docID]++
+				scores[docID] += score
+			}
+		}
+
+		minMatch := min(q.MinimumShouldMatch, len(q.Should))
+		if hits == nil {
+			// should clauses are the only ones deciding what matches
+			hits = make(map[int]float64, len(matched))
+			for docID, n := range matched {
+				if n >= max(minMatch, 1) {
+					hits[docID] = scores[docID]
+				}
+			}
+		} else {
+			for docID := range hits {
+				if matched[docID] < minMatch {
+					delete(hits, docID)
+				} else {
+					hits[docID] += scores[docID]
+				}
+			}
+		}
+	}
+
+	// only must_not clauses, exclude them from every doc
+	if hits == nil {
+		hits = make(map[int]float64)
+		for _, docID := range seg.liveDocs() {
+			hits[docID] = 0
+		}
+	}
+
+	for _, sub := range q.MustNot {
+		subHits, err := sub.Search(seg, stats)
+		if err != nil {
+			return nil, err
+		}
+		for docID := range subHits {
+			delete(hits, docID)
+		}
+	}
+
+	return hits, nil
+}
+
+// Matches docs containing the terms of a single field in order. With a slop, the terms
+// may be up to Slop position moves away from where the phrase puts them, so a slop of 2
+// also matches the two words of a phrase swapped.
+type PhraseQuery struct {
+	Terms []Term
+	// position of each term in the phrase, nil for consecutive terms
+	Positions []int
+	Slop      int
+}
+
+func NewPhraseQuery(terms []Term, positions []int, slop int) *PhraseQuery {
+	return &PhraseQuery{Terms: terms, Positions: positions, Slop: slop}
+}
+
+func (q *PhraseQuery) offsets() []int {
+	if q.Positions != nil {
+		return q.Positions
+	}
+	offsets := make([]int, len(q.Terms))
+	for i := range offsets {
+		offsets[i] = i
+	}
+	return offsets
+}
+
+func (q *PhraseQuery) ScoringTerms() []Term {
+	return q.Terms
+}
+
+// Scored like a single term with BM25, using how often the phrase occurs in the field
+// and the summed idf of its terms.
+func (q *PhraseQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+
+	hits := make(map[int]float64)
+	if len(q.Terms) == 0 {
+		return hits, nil
+	}
+
+	its := make([]postingsIterator, len(q.Terms))
+	for i, t := range q.Terms {
+		it, found := seg.TermDict.postingsIterator(t)
+		if !found {
+			// every term has to be present
+			return hits, nil
+		}
+		its[i] = it
+	}
+
+	idf := 0.0
+	for _, t := range q.Terms {
+		idf += stats.IDF(t)
+	}
+
+	field := q.Terms[0].Field()
+	lengths := seg.fieldLengths(field)
+
+	// positions are only read for the docs having every term
+	offsets := q.offsets()
+	positions := make([][]int, len(its))
+	intersect(its, func(docID int) {
+		if seg.isDeleted(docID) {
+			return
+		}
+		for i, it := range its {
+			positions[i] = it.positions()
+		}
+
+		var freq float64
+		if q.Slop == 0 {
+			freq = float64(exactPhraseFreq(positions, offsets))
+		} else {
+			freq = sloppyPhraseFreq(positions, offsets, q.Slop)
+		}
+
+		if freq > 0 {
+			hits[docID] = stats.scoreFreq(idf, field, freq, lengths.get(docID))
+		}
+	})
+
+	return hits, nil
+}
+
+// Counts the positions where every term of the phrase sits exactly its offset after the first.
+func exactPhraseFreq(positions [][]int, offsets []int) (freq int) {
+	for _, start := range positions[0] {
+		match := true
+		for i := 1; i < len(positions); i++ {
+			if !containsSorted(positions[i], start+offsets[i]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			freq++
+		}
+	}
+	return
+}
+
+// Finds the windows where every term is within slop moves of its place in the phrase.
+// Each term position is shifted back by the term's offset in the phrase, so an exact
+// match puts all of them on the same value and the spread of a window is the number of
+// moves needed. Closer matches count more, like Lucene's sloppy phrase frequency.
+func sloppyPhraseFreq(positions [][]int, offsets []int, slop int) (freq float64) {
+	ptrs := make([]int, len(positions))
+	for {
+		minTerm, lo, hi := 0, math.MaxInt, math.MinInt
+		for i, ps := range positions {
+			p := ps[ptrs[i]] - offsets[i]
+			if p < lo {
+				lo, minTerm = p, i
+			}
+			hi = max(hi, p)
+		}
+
+		if spread := hi - lo; spread <= slop {
+			freq += 1 / float64(1+spread)
+		}
+
+		ptrs[minTerm]++
+		if ptrs[minTerm] == len(positions[minTerm]) {
+			return
+		}
+	}
+}
+
+// Matches docs having a term of the field starting with Prefix. Every matching doc
+// scores 1, like Lucene's constant score rewrite of multi term queries.
+type PrefixQuery struct {
+	Field  string
+	Prefix string
+}
+
+func (q *PrefixQuery) ScoringTerms() []Term {
+	return nil
+}
+
+func (q *PrefixQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+	return searchTerms(seg, q.Field, q.Prefix, nil), nil
+}
+
+// Matches docs having a term of the field matching Pattern, where * stands for any number
+// of characters, ? for a single one, and \ escapes the character after it. Scores like a
+// prefix query.
+type WildcardQuery struct {
+	Field   string
+	Pattern string
+
+	prefix string
+	re     *regexp.Regexp
+}
+
+func NewWildcardQuery(field, pattern string) *WildcardQuery {
+	q := &WildcardQuery{Field: field, Pattern: pattern}
+
+	var expr, prefix strings.Builder
+	wildcard := false
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '*':
+			expr.WriteString(".*")
+			wildcard = true
+			continue
+		case c == '?':
+			expr.WriteString(".")
+			wildcard = true
+			continue
+		case c == '\\' && i+1 < len(runes):
+			i++
+			c = runes[i]
+		}
+
+		expr.WriteString(regexp.QuoteMeta(string(c)))
+		if !wildcard {
+			prefix.WriteRune(c)
+		}
+	}
+
+	q.prefix = prefix.String()
+	q.re = regexp.MustCompile(`^(?s:` + expr.String() + `)$`)
+	return q
+}
+
+func (q *WildcardQuery) ScoringTerms() []Term {
+	return nil
+}
+
+func (q *WildcardQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+	return searchTerms(seg, q.Field, q.prefix, q.re.MatchString), nil
+}
+
+// Matches docs having a term of the field that Pattern, a regular expression in Go's
+// RE2 syntax, matches as a whole. Scores like a prefix query.
+type RegexpQuery struct {
+	Field   string
+	Pattern string
+
+	prefix string
+	re     *regexp.Regexp
+}
+
+func NewRegexpQuery(field, pattern string) (*RegexpQuery, error) {
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, &QueryError{Reason: "invalid regular expression " + strconv.Quote(pattern)}
+	}
+
+	q := &RegexpQuery{Field: field, Pattern: pattern, re: re}
+	q.prefix, _ = re.LiteralPrefix()
+	return q, nil
+}
+
+func (q *RegexpQuery) ScoringTerms() []Term {
+	return nil
+}
+
+func (q *RegexpQuery) Search(seg *Segment, stats *IndexStats) (map[int]float64, error) {
+	return searchTerms(seg, q.Field, q.prefix, q.re.MatchString), nil
+}
+
+// Live docs having a term of the field that starts with prefix and that match accepts
+// (every one when nil), all scoring 1. Only the terms starting with the prefix are read
+// from the sorted term dictionary, a longer prefix makes for a faster query.
+func searchTerms(seg *Segment, field, prefix string, match func(value string) bool) map[int]float64 {
+	hits := make(map[int]float64)
+	from := NewTerm(field, prefix)
+	fieldPrefix := len(field) + 1
+
+	seg.TermDict.seek(from, func(t Term, postings func() TermData) bool {
+		if !strings.HasPrefix(string(t), string(from)) {
+			return false
+		}
+		if match != nil && !match(string(t[fieldPrefix:])) {
+			return true
+		}
+
+		for docID := range postings() {
+			if !seg.isDeleted(docID) {
+				hits[docID] = 1
+			}
+		}
+		return true
+	})
+
+	return hits
+}
+
+func containsSorted(ps []int, p int) bool {
+	i := sort.SearchInts(ps, p)
+	return i < len(ps) && ps[i] == p
+}
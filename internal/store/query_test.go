@@ -0,0 +1,54 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPhraseQuery(t *testing.T) {
+	f, idx := newTestFSM(t)
+
+	// docs 0 to 2 are read from a segment file, the others from the active segment
+	bodies := []string{
+		`{"title": "steel sword"}`,
+		`{"title": "sword of steel"}`,
+		`{"title": "steel long sword"}`,
+		`{"title": "long sword steel"}`,
+		`{"title": ["old steel", "sword maker"]}`,
+		`{"title": "steel sword steel sword"}`,
+	}
+	for docID, body := range bodies {
+		applyTestAdd(t, f, docID, body, uint64(docID+1))
+		if docID == 2 {
+			if err := idx.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		phrase string
+		slop   int
+		want   []int
+	}{
+		{"steel sword", 0, []int{0, 5}},
+		{"sword steel", 0, []int{3, 5}},
+		{"steel sword", 1, []int{0, 2, 5}},
+		{"steel sword", 2, []int{0, 2, 3, 5}},
+		{"steel sword", 3, []int{0, 1, 2, 3, 5}},
+		{"old steel", 0, []int{4}},
+		{"sword maker", 0, []int{4}},
+		// values of a multi-valued field are positionIncrementGap apart
+		{"steel sword", 50, []int{0, 1, 2, 3, 5}},
+		{"old steel sword", 0, []int{}},
+		{"steel shield", 5, []int{}},
+	}
+
+	for _, tt := range tests {
+		terms, positions := GetPhraseTerms(idx, "title", tt.phrase)
+		got := searchIDs(t, idx, NewPhraseQuery(terms, positions, tt.slop), SearchOptions{})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q~%d: got %v, want %v", tt.phrase, tt.slop, got, tt.want)
+		}
+	}
+}
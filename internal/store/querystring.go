@@ -0,0 +1,622 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Lucene query string syntax, parsed into the same queries as the JSON DSL:
+//
+//	title:sword AND content:"steel blade"
+//	+required -excluded NOT other
+//	(sword OR blade) AND title:(steel iron)
+//	title:pre*   prefix
+//	title:s?o*d  wildcard, ? is a single character and * any number of them
+//	code:/ab[0-9]+/   regular expression matching whole terms
+//	sword~2      fuzzy, up to 2 edits
+//	"steel blade"~1   phrase with a slop
+//	price:[10 TO 20}  range, [ ] include the bound and { } exclude it, * leaves it open
+//	price:>=10   range with one bound, also >, < and <=
+//	*:*          every document
+//
+// Like Lucene's classic query parser with the OR default operator, clauses are optional
+// unless marked with + or joined with AND, and - or NOT excludes them. Terms and phrases
+// are analyzed with the analyzer of their field, a term analyzed into several tokens
+// matches any of them, and one analyzed into none is left out of the query.
+
+type qsTokenKind int
+
+const (
+	qsEOF qsTokenKind = iota
+	qsTerm
+	qsPhrase
+	qsAnd
+	qsOr
+	qsNot
+	qsPlus
+	qsMinus
+	qsColon
+	qsLParen
+	qsRParen
+	qsTilde
+	qsRange
+	qsRegexp
+)
+
+type qsToken struct {
+	kind qsTokenKind
+	text string
+	// byte offset in the query string
+	pos int
+	// term ends in an unescaped *
+	prefix bool
+	// term has other unescaped wildcards, its text is a wildcard pattern
+	wildcard bool
+}
+
+type qsOccur int
+
+const (
+	qsShould qsOccur = iota
+	qsMust
+	qsMustNot
+)
+
+type qsClause struct {
+	occur qsOccur
+	q     Query
+}
+
+type qsParser struct {
+	src       string
+	toks      []qsToken
+	i         int
+	analyzers FieldAnalyzers
+}
+
+// Parses a Lucene style query string. Terms without a field: prefix search defaultField.
+func ParseQueryString(q, defaultField string, analyzers FieldAnalyzers) (Query, error) {
+
+	toks, err := lexQueryString(q)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &qsParser{src: q, toks: toks, analyzers: analyzers}
+
+	query, err := p.parseClauses(defaultField)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != qsEOF {
+		return nil, p.errorAt(tok.pos, "unexpected closing parenthesis")
+	}
+
+	// every term was analyzed away
+	if query == nil {
+		return NewMatchQuery(nil), nil
+	}
+
+	return query, nil
+}
+
+func (p *qsParser) errorAt(pos int, reason string) *QueryError {
+	return queryStringError(p.src, pos, reason)
+}
+
+// Positions are reported as 1 based columns, counting characters rather than bytes.
+func queryStringError(src string, pos int, reason string) *QueryError {
+	return &QueryError{
+		Reason:   reason,
+		Position: utf8.RuneCountInString(src[:pos]) + 1,
+	}
+}
+
+func (p *qsParser) peek() qsToken {
+	return p.toks[p.i]
+}
+
+func (p *qsParser) next() qsToken {
+	tok := p.toks[p.i]
+	if tok.kind != qsEOF {
+		p.i++
+	}
+	return tok
+}
+
+// Parses clauses up to the end of the query or of the current group. Returns a nil query
+// when there were clauses, but analysis left nothing of them.
+func (p *qsParser) parseClauses(field string) (Query, error) {
+
+	var clauses []qsClause
+	var conj qsTokenKind = qsEOF
+	var conjPos int
+	parsed := 0
+
+	for {
+		tok := p.peek()
+		if tok.kind == qsEOF || tok.kind == qsRParen {
+			break
+		}
+
+		if tok.kind == qsAnd || tok.kind == qsOr {
+			if parsed == 0 || conj != qsEOF {
+				return nil, p.errorAt(tok.pos, "AND and OR need a clause on both sides")
+			}
+			conj, conjPos = tok.kind, tok.pos
+			p.next()
+			continue
+		}
+
+		mod := qsEOF
+		if tok.kind == qsPlus || tok.kind == qsMinus || tok.kind == qsNot {
+			mod = tok.kind
+			p.next()
+		}
+
+		q, err := p.parseClause(field)
+		if err != nil {
+			return nil, err
+		}
+		parsed++
+
+		if q != nil {
+			clauses = addQueryStringClause(clauses, conj, mod, q)
+		}
+		conj = qsEOF
+	}
+
+	if conj != qsEOF {
+		return nil, p.errorAt(conjPos, "AND and OR need a clause on both sides")
+	}
+
+	if parsed == 0 {
+		return nil, p.errorAt(p.peek().pos, "expected a query")
+	}
+
+	if len(clauses) == 0 {
+		return nil, nil
+	}
+
+	return buildQueryStringBool(clauses), nil
+}
+
+// Same rules as Lucene's classic parser: AND makes both of its sides required,
+// + requires a clause, - and NOT exclude it, and anything else is optional.
+func addQueryStringClause(clauses []qsClause, conj, mod qsTokenKind, q Query) []qsClause {
+
+	if len(clauses) > 0 && conj == qsAnd {
+		last := &clauses[len(clauses)-1]
+		if last.occur != qsMustNot {
+			last.occur = qsMust
+		}
+	}
+
+	occur := qsShould
+	switch {
+	case mod == qsMinus || mod == qsNot:
+		occur = qsMustNot
+	case mod == qsPlus || conj == qsAnd:
+		occur = qsMust
+	}
+
+	return append(clauses, qsClause{occur: occur, q: q})
+}
+
+func buildQueryStringBool(clauses []qsClause) Query {
+
+	if len(clauses) == 1 && clauses[0].occur != qsMustNot {
+		return clauses[0].q
+	}
+
+	bq := &BoolQuery{}
+	for _, c := range clauses {
+		switch c.occur {
+		case qsMust:
+			bq.Must = append(bq.Must, c.q)
+		case qsShould:
+			bq.Should = append(bq.Should, c.q)
+		case qsMustNot:
+			bq.MustNot = append(bq.MustNot, c.q)
+		}
+	}
+
+	// optional clauses only decide what matches when nothing is required
+	if len(bq.Must) == 0 {
+		bq.MinimumShouldMatch = 1
+	}
+
+	return bq
+}
+
+// A term, a phrase or a group, with an optional field: in front.
+func (p *qsParser) parseClause(field string) (Query, error) {
+
+	tok := p.next()
+
+	switch tok.kind {
+	case qsTerm:
+		if p.peek().kind != qsColon {
+			return p.termQuery(field, tok)
+		}
+		p.next()
+
+		fieldTok := tok
+		tok = p.next()
+		matchAll := fieldTok.prefix && fieldTok.text == "" && tok.kind == qsTerm && tok.prefix && tok.text == ""
+		if matchAll {
+			return &MatchAllQuery{}, nil
+		}
+		if fieldTok.prefix || fieldTok.wildcard {
+			return nil, p.errorAt(fieldTok.pos, "wildcards are not supported in field names")
+		}
+
+		switch tok.kind {
+		case qsTerm:
+			return p.termQuery(fieldTok.text, tok)
+		case qsPhrase:
+			return p.phraseQuery(fieldTok.text, tok)
+		case qsLParen:
+			return p.group(fieldTok.text, tok)
+		case qsRange:
+			return p.rangeQuery(fieldTok.text, tok)
+		case qsRegexp:
+			return p.regexpQuery(fieldTok.text, tok)
+		default:
+			return nil, p.errorAt(tok.pos, "expected a term, phrase, range, regular expression or group after "+fieldTok.text+":")
+		}
+
+	case qsPhrase:
+		return p.phraseQuery(field, tok)
+
+	case qsRange:
+		return p.rangeQuery(field, tok)
+
+	case qsRegexp:
+		return p.regexpQuery(field, tok)
+
+	case qsLParen:
+		return p.group(field, tok)
+
+	case qsEOF:
+		return nil, p.errorAt(tok.pos, "unexpected end of query")
+
+	default:
+		return nil, p.errorAt(tok.pos, fmt.Sprintf("unexpected %q", tok.text))
+	}
+}
+
+// Parses the rest of a group opened by lparen. A field in front of it applies to every term inside.
+func (p *qsParser) group(field string, lparen qsToken) (Query, error) {
+
+	q, err := p.parseClauses(field)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.next().kind != qsRParen {
+		return nil, p.errorAt(lparen.pos, "missing closing parenthesis")
+	}
+
+	return q, nil
+}
+
+func (p *qsParser) termQuery(field string, tok qsToken) (Query, error) {
+
+	if field == "" {
+		return nil, p.errorAt(tok.pos, fmt.Sprintf("no field given for %q and no default_field set", tok.text))
+	}
+
+	if !tok.prefix && (strings.HasPrefix(tok.text, ">") || strings.HasPrefix(tok.text, "<")) {
+		return p.comparisonQuery(field, tok)
+	}
+
+	if tok.prefix {
+		if tok.text == "" {
+			return nil, p.errorAt(tok.pos, "a * wildcard needs a prefix in front of it")
+		}
+		if p.peek().kind == qsTilde {
+			return nil, p.errorAt(p.peek().pos, "a prefix query cannot be fuzzy")
+		}
+		return &PrefixQuery{Field: field, Prefix: p.analyzers.FieldAnalyzer(field).Normalize(tok.text)}, nil
+	}
+
+	if tok.wildcard {
+		if p.peek().kind == qsTilde {
+			return nil, p.errorAt(p.peek().pos, "a wildcard query cannot be fuzzy")
+		}
+		return NewWildcardQuery(field, p.analyzers.FieldAnalyzer(field).Normalize(tok.text)), nil
+	}
+
+	if p.peek().kind == qsTilde {
+		tilde := p.next()
+
+		edits := MaxFuzzyEdits
+		if tilde.text != "" {
+			n, err := strconv.Atoi(tilde.text)
+			if err != nil || n > MaxFuzzyEdits {
+				return nil, p.errorAt(tilde.pos, fmt.Sprintf("fuzzy edit distance must be between 0 and %d", MaxFuzzyEdits))
+			}
+			edits = n
+		}
+
+		return NewFuzzyQuery(field, p.analyzers.FieldAnalyzer(field).Normalize(tok.text), edits), nil
+	}
+
+	terms := GetTermsFromPhrase(p.analyzers, field, tok.text)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	return NewMatchQuery(terms), nil
+}
+
+// Regular expressions are not analyzed, they match the terms as indexed.
+func (p *qsParser) regexpQuery(field string, tok qsToken) (Query, error) {
+
+	if field == "" {
+		return nil, p.errorAt(tok.pos, fmt.Sprintf("no field given for /%s/ and no default_field set", tok.text))
+	}
+
+	q, err := NewRegexpQuery(field, tok.text)
+	if err != nil {
+		return nil, p.errorAt(tok.pos, err.(*QueryError).Reason)
+	}
+	return q, nil
+}
+
+func (p *qsParser) phraseQuery(field string, tok qsToken) (Query, error) {
+
+	if field == "" {
+		return nil, p.errorAt(tok.pos, fmt.Sprintf("no field given for %q and no default_field set", tok.text))
+	}
+
+	slop := 0
+	if p.peek().kind == qsTilde {
+		tilde := p.next()
+		n, err := strconv.Atoi(tilde.text)
+		if err != nil {
+			return nil, p.errorAt(tilde.pos, "phrase slop must be a number")
+		}
+		slop = n
+	}
+
+	if strings.TrimSpace(tok.text) == "" {
+		return nil, p.errorAt(tok.pos, "empty phrase")
+	}
+
+	terms, positions := GetPhraseTerms(p.analyzers, field, tok.text)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	return NewPhraseQuery(terms, positions, slop), nil
+}
+
+// [a TO b], {a TO b} or a mix of the two.
+func (p *qsParser) rangeQuery(field string, tok qsToken) (Query, error) {
+
+	if field == "" {
+		return nil, p.errorAt(tok.pos, "no field given for the range and no default_field set")
+	}
+
+	parts := strings.Fields(tok.text[1 : len(tok.text)-1])
+	if len(parts) != 3 || parts[1] != "TO" {
+		return nil, p.errorAt(tok.pos, "a range must look like [from TO to]")
+	}
+
+	from, to := parts[0], parts[2]
+	if from == "*" {
+		from = ""
+	}
+	if to == "*" {
+		to = ""
+	}
+
+	q, err := NewRangeQuery(p.analyzers, field, from, to, tok.text[0] == '[', tok.text[len(tok.text)-1] == ']')
+	if err != nil {
+		return nil, p.errorAt(tok.pos, err.(*QueryError).Reason)
+	}
+	return q, nil
+}
+
+// >10, >=10, <10 or <=10, a range open on one side.
+func (p *qsParser) comparisonQuery(field string, tok qsToken) (Query, error) {
+
+	op := tok.text[:1]
+	bound := tok.text[1:]
+	if strings.HasPrefix(bound, "=") {
+		op += "="
+		bound = bound[1:]
+	}
+	if bound == "" {
+		return nil, p.errorAt(tok.pos, "expected a value after "+op)
+	}
+
+	var q Query
+	var err error
+	if op[0] == '>' {
+		q, err = NewRangeQuery(p.analyzers, field, bound, "", op == ">=", false)
+	} else {
+		q, err = NewRangeQuery(p.analyzers, field, "", bound, false, op == "<=")
+	}
+	if err != nil {
+		return nil, p.errorAt(tok.pos, err.(*QueryError).Reason)
+	}
+	return q, nil
+}
+
+// Characters ending a term, unless escaped with a backslash.
+func isQueryStringSpecial(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`()":~^[]{}\`, r)
+}
+
+func lexQueryString(src string) (toks []qsToken, err error) {
+
+	i := 0
+	for i < len(src) {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		start := i
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == '(':
+			toks = append(toks, qsToken{kind: qsLParen, text: "(", pos: start})
+			i++
+		case r == ')':
+			toks = append(toks, qsToken{kind: qsRParen, text: ")", pos: start})
+			i++
+		case r == ':':
+			toks = append(toks, qsToken{kind: qsColon, text: ":", pos: start})
+			i++
+		case r == '+':
+			toks = append(toks, qsToken{kind: qsPlus, text: "+", pos: start})
+			i++
+		case r == '-':
+			toks = append(toks, qsToken{kind: qsMinus, text: "-", pos: start})
+			i++
+		case r == '!':
+			toks = append(toks, qsToken{kind: qsNot, text: "!", pos: start})
+			i++
+		case strings.HasPrefix(src[i:], "&&"):
+			toks = append(toks, qsToken{kind: qsAnd, text: "&&", pos: start})
+			i += 2
+		case strings.HasPrefix(src[i:], "||"):
+			toks = append(toks, qsToken{kind: qsOr, text: "||", pos: start})
+			i += 2
+
+		case r == '^':
+			return nil, queryStringError(src, start, "boosts are not supported")
+
+		case r == '[' || r == '{':
+			end := strings.IndexAny(src[i:], "]}")
+			if end < 0 {
+				return nil, queryStringError(src, start, "unterminated range, missing ] or }")
+			}
+			i += end + 1
+			toks = append(toks, qsToken{kind: qsRange, text: src[start:i], pos: start})
+		case r == ']' || r == '}':
+			return nil, queryStringError(src, start, fmt.Sprintf("unexpected %q", r))
+
+		case r == '~':
+			// fuzzy edit distance or phrase slop, the number is optional
+			i++
+			for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+				i++
+			}
+			toks = append(toks, qsToken{kind: qsTilde, text: src[start+1 : i], pos: start})
+
+		case r == '/':
+			// a regular expression, up to the next unescaped /
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(src) {
+				if strings.HasPrefix(src[i:], `\/`) {
+					sb.WriteByte('/')
+					i += 2
+					continue
+				}
+				if src[i] == '/' {
+					i++
+					closed = true
+					break
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if !closed {
+				return nil, queryStringError(src, start, "unterminated regular expression, missing closing /")
+			}
+			toks = append(toks, qsToken{kind: qsRegexp, text: sb.String(), pos: start})
+
+		case r == '"':
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(src) {
+				c, n := utf8.DecodeRuneInString(src[i:])
+				if c == '\\' && i+n < len(src) {
+					i += n
+					c, n = utf8.DecodeRuneInString(src[i:])
+				} else if c == '"' {
+					i += n
+					closed = true
+					break
+				}
+				sb.WriteRune(c)
+				i += n
+			}
+			if !closed {
+				return nil, queryStringError(src, start, "unterminated phrase, missing closing quote")
+			}
+			toks = append(toks, qsToken{kind: qsPhrase, text: sb.String(), pos: start})
+
+		default:
+			tok := qsToken{kind: qsTerm, pos: start}
+			// the term as is, and as a wildcard pattern with its escaped wildcards still escaped
+			var sb, pattern strings.Builder
+			wildcards, trailingStar := 0, false
+			for i < len(src) {
+				c, n := utf8.DecodeRuneInString(src[i:])
+				if c == '\\' {
+					trailingStar = false
+					if i+n >= len(src) {
+						return nil, queryStringError(src, i, "nothing to escape after backslash")
+					}
+					i += n
+					c, n = utf8.DecodeRuneInString(src[i:])
+					sb.WriteRune(c)
+					if c == '*' || c == '?' || c == '\\' {
+						pattern.WriteByte('\\')
+					}
+					pattern.WriteRune(c)
+					i += n
+					continue
+				}
+				if isQueryStringSpecial(c) {
+					break
+				}
+
+				if c == '*' || c == '?' {
+					wildcards++
+					trailingStar = c == '*'
+				} else {
+					sb.WriteRune(c)
+					trailingStar = false
+				}
+				pattern.WriteRune(c)
+				i += n
+			}
+
+			// a single trailing * is a prefix query, other wildcards make a wildcard query
+			tok.text = sb.String()
+			if wildcards == 1 && trailingStar {
+				tok.prefix = true
+			} else if wildcards > 0 {
+				tok.wildcard = true
+				tok.text = pattern.String()
+			}
+
+			// operators are only recognised in upper case, like Lucene
+			if !tok.prefix && !tok.wildcard && src[start:i] == tok.text {
+				switch tok.text {
+				case "AND":
+					tok.kind = qsAnd
+				case "OR":
+					tok.kind = qsOr
+				case "NOT":
+					tok.kind = qsNot
+				}
+			}
+
+			toks = append(toks, tok)
+		}
+	}
+
+	return append(toks, qsToken{kind: qsEOF, pos: len(src)}), nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Index with the default analyzer and an integer price field, for parsing queries.
+func newQueryTestIndex() *Index {
+	settings := DefaultIndexSettings()
+	settings.Mapping.Properties = map[string]FieldMapping{"price": {Type: TypeInteger}}
+	return NewIndex("test", false, settings, nil)
+}
+
+func TestParseQueryString(t *testing.T) {
+	idx := newQueryTestIndex()
+
+	match := func(field string, words ...string) Query {
+		var terms []Term
+		for _, w := range words {
+			terms = append(terms, NewTerm(field, w))
+		}
+		return NewMatchQuery(terms)
+	}
+	regexp := func(field, pattern string) Query {
+		q, err := NewRegexpQuery(field, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	tests := []struct {
+		q    string
+		want Query
+	}{
+		{`sword`, match("content", "sword")},
+		{`title:Sword`, match("title", "sword")},
+		{`sword blade`, &BoolQuery{Should: []Query{match("content", "sword"), match("content", "blade")}, MinimumShouldMatch: 1}},
+		{`sword AND blade`, &BoolQuery{Must: []Query{match("content", "sword"), match("content", "blade")}}},
+		{`sword && blade`, &BoolQuery{Must: []Query{match("content", "sword"), match("content", "blade")}}},
+		{`+sword blade`, &BoolQuery{Must: []Query{match("content", "sword")}, Should: []Query{match("content", "blade")}}},
+		{`sword -blade`, &BoolQuery{Should: []Query{match("content", "sword")}, MustNot: []Query{match("content", "blade")}, MinimumShouldMatch: 1}},
+		{`sword AND NOT blade`, &BoolQuery{Must: []Query{match("content", "sword")}, MustNot: []Query{match("content", "blade")}}},
+		{`title:(sword OR blade)`, &BoolQuery{Should: []Query{match("title", "sword"), match("title", "blade")}, MinimumShouldMatch: 1}},
+		{`"steel blade"~1`, NewPhraseQuery([]Term{NewTerm("content", "steel"), NewTerm("content", "blade")}, []int{0, 1}, 1)},
+		{`title:sw*`, &PrefixQuery{Field: "title", Prefix: "sw"}},
+		{`title:sw* AND blade`, &BoolQuery{Must: []Query{&PrefixQuery{Field: "title", Prefix: "sw"}, match("content", "blade")}}},
+		{`code:AB?1*`, NewWildcardQuery("code", "ab?1*")},
+		{`code:/ab[0-9]+/`, regexp("code", "ab[0-9]+")},
+		{`code:/a\/b/`, regexp("code", "a/b")},
+		{`price:[10 TO 100}`, &RangeQuery{Field: "price", Min: 10, Max: 99}},
+		{`price:{10 TO *]`, &RangeQuery{Field: "price", Min: 11, Max: math.MaxInt64}},
+		{`price:>=10`, &RangeQuery{Field: "price", Min: 10, Max: math.MaxInt64}},
+		{`price:<5`, &RangeQuery{Field: "price", Min: math.MinInt64, Max: 4}},
+		{`sword~1`, NewFuzzyQuery("content", "sword", 1)},
+		{`sword~`, NewFuzzyQuery("content", "sword", MaxFuzzyEdits)},
+		{`*:*`, &MatchAllQuery{}},
+		{`sword\:blade`, match("content", "sword", "blade")},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseQueryString(tt.q, "content", idx)
+		if err != nil {
+			t.Errorf("%s: %v", tt.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryStringErrors(t *testing.T) {
+	idx := newQueryTestIndex()
+
+	tests := []struct {
+		q        string
+		reason   string
+		position int
+	}{
+		{`title:"steel`, "unterminated phrase, missing closing quote", 7},
+		{`sword AND`, "AND and OR need a clause on both sides", 7},
+		{`AND sword`, "AND and OR need a clause on both sides", 1},
+		{`(sword`, "missing closing parenthesis", 1},
+		{`sword)`, "unexpected closing parenthesis", 6},
+		// positions count characters, not bytes
+		{`é sword)`, "unexpected closing parenthesis", 8},
+		{`sword~3`, "fuzzy edit distance must be between 0 and 2", 6},
+		{`ti*le:x`, "wildcards are not supported in field names", 1},
+		{`price:[1 TO]`, "a range must look like [from TO to]", 7},
+		{`title:`, "expected a term, phrase, range, regular expression or group after title:", 7},
+		{`code:/ab[/`, `invalid regular expression "ab["`, 6},
+		{`price:>`, "expected a value after >", 7},
+		{`title:sword^2`, "boosts are not supported", 12},
+		{`*`, "a * wildcard needs a prefix in front of it", 1},
+		{`content:[1 TO 2]`, "range query on content needs an integer, float or date field", 9},
+		{`"a" ~x`, "phrase slop must be a number", 5},
+		{`""`, "empty phrase", 1},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseQueryString(tt.q, "content", idx)
+		qerr, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("%s: got %v, want a query error", tt.q, err)
+			continue
+		}
+		if qerr.Reason != tt.reason || qerr.Position != tt.position {
+			t.Errorf("%s: got %q at %d, want %q at %d", tt.q, qerr.Reason, qerr.Position, tt.reason, tt.position)
+		}
+	}
+
+	if _, err := ParseQueryString("sword", "", idx); err == nil {
+		t.Error("a term without a field and no default field should fail")
+	}
+}
@@ -1,6 +1,9 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	cfg "gocene/config"
@@ -24,8 +27,21 @@ const SnapshotCount = 2
 type fsmSnapshot struct {
 	ActiveIndices []IndexMetadata   `json:"active_indices"`
 	PeerHTTP      map[string]string `json:"peer_http"`
+	// last log entry applied to the indices when the snapshot was taken
+	AppliedIndex uint64 `json:"applied_index,omitempty"`
+
+	// segment files streamed after the metadata, in its order
+	files []*segmentFile
 }
 
+// A snapshot is the metadata as JSON followed by the segment files, so each file goes from
+// its mapping straight into the sink, and from the snapshot straight to the data directory
+// when restoring, instead of through one JSON buffer:
+//
+//	header    magic "GSNP", metadata length uint64, metadata JSON
+//	files     per segment, in the order of the metadata: file length uint64, file bytes
+const snapshotMagic = "GSNP"
+
 // for Raft index snapshot loading
 type IndexMetadata struct {
 	Name              string            `json:"name"`
@@ -33,16 +49,19 @@ type IndexMetadata struct {
 	NextDocID         int               `json:"next_doc_id"`
 	SegCount          int               `json:"seg_count"`
 	CaseSensitivity   bool              `json:"case_sensitivity"`
+	Settings          *IndexSettings    `json:"settings,omitempty"`
 	ActiveSegmentName string            `json:"active_segment_name"`
+	Merge             *MergeMetadata    `json:"merge,omitempty"`
+	OrphanBlobs       map[string]uint64 `json:"orphan_blobs,omitempty"`
 }
 
 // for Raft Segment snapshot loading
 type SegmentMetadata struct {
 	IsActive      bool                `json:"is_active"`
 	Name          string              `json:"name"`
-	TermDict      TermDictionary      `json:"term_dict"`
 	ParentIdxName string              `json:"parent_idx_name"`
 	PostingsMap   map[int]docPosition `json:"postingsMap"`
+	Tombstones    []int               `json:"tombstones"`
 	DocCount      int                 `json:"doc_count"`
 	ByteSize      int                 `json:"byte_size"`
 }
@@ -85,8 +104,19 @@ func (s *Store) Open() error {
 	}
 	logStore = boltDB
 	stableStore = boltDB
+	s.logStore = logStore
 
-	ra, err := raft.NewRaft(config, (*fsm)(s), logStore, stableStore, snapshots, transport)
+	s.bodies, err = newBodyCache(filepath.Join(s.RaftDir, "bodies"))
+	if err != nil {
+		return fmt.Errorf("body cache: %s", err)
+	}
+	// entries stored before a restart are applied again, and Minio has to be there for them
+	if err = s.prefetchStoredBodies(logStore, snapshots); err != nil {
+		return fmt.Errorf("read bodies of stored log entries: %s", err)
+	}
+	s.snapshots = snapshots
+
+	ra, err := raft.NewRaft(config, (*fsm)(s), prefetchLogStore{LogStore: logStore, s: s}, stableStore, snapshots, transport)
 	if err != nil {
 		return fmt.Errorf("new raft: %s", err)
 	}
@@ -131,7 +161,7 @@ func (s *Store) Open() error {
 
 	} else if cfg.RaftJoinAddress != "" {
 		// join cluster at join address
-		err = JoinLeaderAsFollower(cfg.RaftSelfHTTPAddress, cfg.RaftJoinAddress, cfg.RaftAddress, cfg.RaftId)
+		err = JoinLeaderAsFollower(cfg.RaftSelfHTTPAddress, cfg.RaftJoinAddress, cfg.RaftAddress, cfg.RaftId, cfg.RaftNonvoter)
 		if err != nil {
 			log.Fatalln("could not join specified leader, err: ", err)
 		}
@@ -146,21 +176,63 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 	if err := json.Unmarshal(l.Data, &c); err != nil {
 		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
 	}
+	defer f.appliedIndex.Store(l.Index)
 
 	switch c.CmdId {
 	case CmdAddDocument:
-		return f.ApplyAddDocument(c.IdxName, c.Param)
+		return f.ApplyAddDocument(c.IdxName, c.Param, c.Docs, l.Index)
 	case CmdCreateIndex:
-		return f.ApplyCreateIndex(c.IdxName, c.Param)
+		return f.ApplyCreateIndex(c.IdxName, c.Param, c.Settings)
 	case CmdAddNode:
 		return f.ApplyAddNode(c.NodeAddress, c.NodeHTTPAddress)
+	case CmdDeleteDocument:
+		return f.ApplyDeleteDocument(c.IdxName, c.Param, l.Index)
+	case CmdModifyDocument:
+		return f.ApplyModifyDocument(c.IdxName, c.Param, c.Docs, l.Index)
+	case CmdBulkAddDocuments:
+		return f.ApplyBulkAddDocuments(c.IdxName, c.DocIDs, c.Docs, l.Index)
+	case CmdRemoveNode:
+		return f.ApplyRemoveNode(c.NodeAddress)
+	case CmdStartMerge:
+		return f.ApplyStartMerge(c.IdxName, c.Segments)
+	case CmdCommitMerge:
+		return f.ApplyCommitMerge(c.IdxName, c.Segment)
+	case CmdDropBlobs:
+		return f.ApplyDropBlobs(c.IdxName, c.Blobs)
 	default:
 		panic(fmt.Sprintf("unrecognized command op ID: %d", c.CmdId))
 	}
 }
 
+// JSON of the i-th doc of a command. Entries from before docs were carried in the log only
+// have its ID, and the doc is read from Minio like it used to be.
+func (f *fsm) documentJSON(idxName string, docID int, payloads []DocumentPayload, i int) (string, error) {
+	if i < len(payloads) {
+		data, err := payloads[i].body(f.bodies)
+		return string(data), err
+	}
+	return utils.GetDocumentFromMinio(f.mc, docID, idxName)
+}
+
+// The i-th doc of a command, parsed to be indexed under its ID.
+func (f *fsm) parseDocument(idx *Index, docID int, payloads []DocumentPayload, i int) (*Document, error) {
+	docStr, err := f.documentJSON(idx.Name, docID, payloads, i)
+	if err != nil {
+		log.Printf("could not read doc %d, err: %v\n", docID, err)
+		return nil, err
+	}
+
+	doc, err := idx.CreateDocumentFromJSON(docStr)
+	if err != nil {
+		return nil, err
+	}
+	doc.ID = docID
+	doc.Blob = payloadBlob(payloads, i)
+	return doc, nil
+}
+
 // Apply adding document to the FSM store
-func (f *fsm) ApplyAddDocument(idxName string, docID int) interface{} {
+func (f *fsm) ApplyAddDocument(idxName string, docID int, payloads []DocumentPayload, logIndex uint64) interface{} {
 
 	f.mu.RLock()
 	idx, ok := f.ActiveIndices[idxName]
@@ -170,28 +242,145 @@ func (f *fsm) ApplyAddDocument(idxName string, docID int) interface{} {
 		return ErrIdxDoesNotExist
 	}
 
-	// fetch doc from S3 bucket
-	docStr, err := utils.GetDocumentFromMinio(f.mc, docID, idxName)
+	sha := payloadBlob(payloads, 0)
+	doc, err := f.parseDocument(idx, docID, payloads, 0)
+	if err == nil {
+		_, err = idx.AddDocument(doc)
+	}
 	if err != nil {
-		log.Println("could not fetch doc from minio")
+		idx.referBlobs(logIndex, nil, []string{sha})
 		return err
 	}
+	idx.referBlobs(logIndex, []string{sha}, nil)
+
+	return docID
+}
+
+// Apply adding a batch of documents to the FSM store.
+// Returns one error per doc ID, nil for the docs that were indexed.
+func (f *fsm) ApplyBulkAddDocuments(idxName string, docIDs []int, payloads []DocumentPayload, logIndex uint64) interface{} {
+
+	f.mu.RLock()
+	idx, ok := f.ActiveIndices[idxName]
+	f.mu.RUnlock()
+
+	if !ok {
+		return ErrIdxDoesNotExist
+	}
+
+	errs := make([]error, len(docIDs))
+	var indexed, orphaned []string
+	for i, docID := range docIDs {
+		sha := payloadBlob(payloads, i)
+		doc, err := f.parseDocument(idx, docID, payloads, i)
+		if err == nil {
+			_, err = idx.AddDocument(doc)
+		}
+		if err != nil {
+			errs[i] = err
+			orphaned = append(orphaned, sha)
+			continue
+		}
+		indexed = append(indexed, sha)
+	}
+	idx.referBlobs(logIndex, indexed, orphaned)
+
+	return errs
+}
+
+// Apply modifying a document in the FSM store.
+// The leader stored the new version under its SHA-256 before committing it, and the doc is
+// read from there once it is applied.
+func (f *fsm) ApplyModifyDocument(idxName string, docID int, payloads []DocumentPayload, logIndex uint64) interface{} {
 
-	doc, err := CreateDocumentFromJSON(docStr)
+	f.mu.RLock()
+	idx, ok := f.ActiveIndices[idxName]
+	f.mu.RUnlock()
+
+	if !ok {
+		return ErrIdxDoesNotExist
+	}
+
+	sha, old := payloadBlob(payloads, 0), idx.docBlob(docID)
+	doc, err := f.parseDocument(idx, docID, payloads, 0)
+	if err == nil {
+		_, err = idx.ModifyDocument(doc)
+	}
 	if err != nil {
+		idx.referBlobs(logIndex, nil, []string{sha})
 		return err
 	}
+	idx.referBlobs(logIndex, []string{sha}, []string{old})
 
-	id, err := idx.AddDocument(doc)
-	if err != nil {
+	return docID
+}
+
+// Apply deleting a document from the FSM store.
+// The doc is tombstoned in its segment, the Minio object is removed by the leader.
+func (f *fsm) ApplyDeleteDocument(idxName string, docID int, logIndex uint64) error {
+
+	f.mu.RLock()
+	idx, ok := f.ActiveIndices[idxName]
+	f.mu.RUnlock()
+
+	if !ok {
+		return ErrIdxDoesNotExist
+	}
+
+	old := idx.docBlob(docID)
+	if err := idx.DeleteDocument(docID); err != nil {
 		return err
 	}
+	idx.referBlobs(logIndex, nil, []string{old})
+	return nil
+}
 
-	return id
+// Apply starting a merge, the merged segment is built in the background.
+func (f *fsm) ApplyStartMerge(idxName string, segNames []string) error {
+
+	f.mu.RLock()
+	idx, ok := f.ActiveIndices[idxName]
+	f.mu.RUnlock()
+
+	if !ok {
+		return ErrIdxDoesNotExist
+	}
+
+	_, err := idx.StartMerge(segNames)
+	return err
 }
 
-// Applying creating an index to the FSM Store
-func (f *fsm) ApplyCreateIndex(idxName string, cs int) error {
+// Apply swapping in a merged segment, waiting for this node to finish building it.
+func (f *fsm) ApplyCommitMerge(idxName, segName string) error {
+
+	f.mu.RLock()
+	idx, ok := f.ActiveIndices[idxName]
+	f.mu.RUnlock()
+
+	if !ok {
+		return ErrIdxDoesNotExist
+	}
+
+	return idx.CommitMerge(segName)
+}
+
+// Apply forgetting blobs nothing refers to anymore, returns the ones the leader can remove.
+func (f *fsm) ApplyDropBlobs(idxName string, blobs map[string]uint64) interface{} {
+
+	f.mu.RLock()
+	idx, ok := f.ActiveIndices[idxName]
+	f.mu.RUnlock()
+
+	if !ok {
+		return ErrIdxDoesNotExist
+	}
+
+	return idx.dropBlobs(blobs)
+}
+
+// Applying creating an index to the FSM Store.
+// Commands logged before settings existed get the defaults.
+func (f *fsm) ApplyCreateIndex(idxName string, cs int, settings *IndexSettings) error {
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -200,7 +389,12 @@ func (f *fsm) ApplyCreateIndex(idxName string, cs int) error {
 		return ErrIdxNameExists
 	}
 
-	f.ActiveIndices[idxName] = NewIndex(idxName, cs == 1, f.mc)
+	if settings == nil {
+		defaults := DefaultIndexSettings()
+		settings = &defaults
+	}
+
+	f.ActiveIndices[idxName] = NewIndex(idxName, cs == 1, *settings, f.mc)
 	return nil
 }
 
@@ -214,6 +408,16 @@ func (f *fsm) ApplyAddNode(nodeAddr, nodeHTTPAddr string) error {
 	return nil
 }
 
+func (f *fsm) ApplyRemoveNode(nodeAddr string) error {
+	log.Printf("-----applying remove node of %s\n", nodeAddr)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.PeerHTTP, nodeAddr)
+	return nil
+}
+
 // Raft FSM Snapshot implementation
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 
@@ -224,37 +428,59 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 
 	// get metadata for every segment of every index
 	for _, idx := range f.ActiveIndices {
+		settings := idx.settingsCopy()
 		idxMd := IndexMetadata{
 			Name:              idx.Name,
-			NextDocID:         idx.NextDocID,
+			NextDocID:         idx.GetNextDocID(),
 			SegCount:          idx.SegCount,
 			CaseSensitivity:   idx.CaseSensitivity,
+			Settings:          &settings,
 			ActiveSegmentName: idx.As.Seg.Name,
 		}
 
+		idxMd.OrphanBlobs = idx.orphanState()
+
+		// a merge in progress is built again by a node restoring the snapshot
+		idx.Mutex.RLock()
+		if idx.merge != nil {
+			md := idx.merge.MergeMetadata
+			idxMd.Merge = &md
+		}
+		idx.Mutex.RUnlock()
+
 		// add immutable segments metadata
 		for _, seg := range idx.Segments {
 			segMd := SegmentMetadata{
 				IsActive:      false,
 				Name:          seg.Name,
-				TermDict:      seg.TermDict,
 				ParentIdxName: idx.Name,
 				// PostingsMap:   seg.PostingsMap,
-				DocCount: seg.DocCount,
-				ByteSize: seg.ByteSize,
+				Tombstones: seg.tombstoneIDs(),
+				DocCount:   seg.DocCount,
+				ByteSize:   seg.ByteSize,
 			}
 
 			idxMd.SegmentList = append(idxMd.SegmentList, segMd)
+			seg.TermDict.file.incRef()
+			fSnap.files = append(fSnap.files, seg.TermDict.file)
+		}
+
+		active, err := idx.As.Seg.encoded()
+		if err != nil {
+			log.Printf("could not encode active segment of index %s for snapshot, err: %v\n", idx.Name, err)
+			fSnap.Release()
+			return nil, err
 		}
+		fSnap.files = append(fSnap.files, active)
 
 		idxMd.SegmentList = append(idxMd.SegmentList, SegmentMetadata{
 			IsActive:      true,
 			Name:          idx.As.Seg.Name,
-			TermDict:      idx.As.Seg.TermDict,
 			ParentIdxName: idx.Name,
 			// PostingsMap:   idx.As.Seg.PostingsMap,
-			DocCount: idx.As.DocCount,
-			ByteSize: idx.As.Seg.ByteSize,
+			Tombstones: idx.As.Seg.tombstoneIDs(),
+			DocCount:   idx.As.Seg.DocCount,
+			ByteSize:   idx.As.Seg.ByteSize,
 		})
 
 		fSnap.ActiveIndices = append(fSnap.ActiveIndices, idxMd)
@@ -264,6 +490,7 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 	for addr, httpAddr := range f.PeerHTTP {
 		fSnap.PeerHTTP[addr] = httpAddr
 	}
+	fSnap.AppliedIndex = f.appliedIndex.Load()
 
 	return fSnap, nil
 }
@@ -273,28 +500,37 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 func (f *fsm) Restore(rc io.ReadCloser) error {
 
 	var fSnap fsmSnapshot
-	if err := json.NewDecoder(rc).Decode(&fSnap); err != nil {
+	files, err := readSnapshotMetadata(rc, &fSnap)
+	if err != nil {
 		return err
 	}
 
 	newActiveIndices := make(map[string]*Index, len(fSnap.ActiveIndices))
 
 	for _, idxMd := range fSnap.ActiveIndices {
-		tempIdx := NewIndex(idxMd.Name, idxMd.CaseSensitivity, f.mc)
+		settings := DefaultIndexSettings()
+		if idxMd.Settings != nil {
+			settings = *idxMd.Settings
+		}
+
+		tempIdx := NewIndex(idxMd.Name, idxMd.CaseSensitivity, settings, f.mc)
 		tempIdx.SegCount = idxMd.SegCount
 		tempIdx.NextDocID = idxMd.NextDocID
+		tempIdx.loadOrphanState(idxMd.OrphanBlobs)
 
 		for _, segMd := range idxMd.SegmentList {
 
 			// if immutable segments, append to seg list
 			if !segMd.IsActive {
-				tempSeg, err := NewSegment(segMd.Name, tempIdx)
+				// written to the data directory as it is read
+				sf, err := readSnapshotFile(files, idxMd.Name, segMd.Name, true)
 				if err != nil {
-					log.Println("could not create new segment while restoring snapshot, err: ", err.Error())
+					log.Println("could not restore segment file while restoring snapshot, err: ", err.Error())
 					return err
 				}
-				tempSeg.TermDict = segMd.TermDict
+				tempSeg := fileSegment(segMd.Name, tempIdx, sf)
 				// tempSeg.PostingsMap = segMd.PostingsMap
+				tempSeg.loadTombstones(segMd.Tombstones)
 				tempSeg.DocCount = segMd.DocCount
 				tempSeg.ByteSize = segMd.ByteSize
 				tempIdx.Segments = append(tempIdx.Segments, tempSeg)
@@ -306,8 +542,15 @@ func (f *fsm) Restore(rc io.ReadCloser) error {
 					log.Println("could not create active segment while restoring snapshot, err: ", err.Error())
 					return err
 				}
-				activeSeg.TermDict = segMd.TermDict
+				sf, err := readSnapshotFile(files, idxMd.Name, segMd.Name, false)
+				if err != nil {
+					log.Println("could not restore active segment while restoring snapshot, err: ", err.Error())
+					return err
+				}
+				activeSeg.TermDict = sf.inMemory()
 				// activeSeg.PostingsMap = segMd.PostingsMap
+				activeSeg.loadDocs(&sf.docs)
+				activeSeg.loadTombstones(segMd.Tombstones)
 				activeSeg.DocCount = segMd.DocCount
 				activeSeg.ByteSize = segMd.ByteSize
 				tempIdx.As.Seg = activeSeg
@@ -315,6 +558,19 @@ func (f *fsm) Restore(rc io.ReadCloser) error {
 			}
 		}
 
+		segNames := make([]string, 0, len(tempIdx.Segments))
+		for _, seg := range tempIdx.Segments {
+			segNames = append(segNames, seg.Name)
+		}
+		removeStaleSegmentFiles(idxMd.Name, segNames)
+
+		if idxMd.Merge != nil {
+			if err := tempIdx.beginMerge(*idxMd.Merge); err != nil {
+				log.Println("could not pick up merge while restoring snapshot, err: ", err.Error())
+				return err
+			}
+		}
+
 		newActiveIndices[idxMd.Name] = tempIdx
 	}
 
@@ -323,7 +579,6 @@ func (f *fsm) Restore(rc io.ReadCloser) error {
 		newPeerHTTP[addr] = httpAddr
 	}
 
-	var err error
 	f.mc, err = utils.CreateMinioClient()
 	if err != nil {
 		log.Fatalln("could not create minio client, err: ", err.Error())
@@ -333,22 +588,35 @@ func (f *fsm) Restore(rc io.ReadCloser) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	for _, idx := range f.ActiveIndices {
+		idx.close()
+	}
 	f.ActiveIndices = newActiveIndices
 	f.PeerHTTP = newPeerHTTP
 
+	f.appliedIndex.Store(fSnap.AppliedIndex)
+
 	return nil
 }
 
 func (fs fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
-		// Encode data.
+		// Encode metadata.
 		b, err := json.Marshal(fs)
 		if err != nil {
 			return err
 		}
 
-		// Write data to sink.
-		if _, err := sink.Write(b); err != nil {
+		// Write metadata and files to sink.
+		w := bufio.NewWriter(sink)
+		w.WriteString(snapshotMagic)
+		binary.Write(w, binary.LittleEndian, uint64(len(b)))
+		w.Write(b)
+		for _, sf := range fs.files {
+			binary.Write(w, binary.LittleEndian, uint64(len(sf.data)))
+			w.Write(sf.data)
+		}
+		if err := w.Flush(); err != nil {
 			return err
 		}
 
@@ -363,4 +631,55 @@ func (fs fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	return err
 }
 
-func (fs fsmSnapshot) Release() {}
+// Releases the segment files the snapshot held on to while it was persisted.
+func (fs fsmSnapshot) Release() {
+	for _, sf := range fs.files {
+		sf.close()
+	}
+}
+
+// Decodes the metadata of a snapshot, and returns the reader of the files after it.
+func readSnapshotMetadata(r io.Reader, fSnap *fsmSnapshot) (files io.Reader, err error) {
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err = io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != snapshotMagic {
+		return nil, ErrCorruptSnapshot
+	}
+
+	var n uint64
+	if err = binary.Read(br, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if err = json.NewDecoder(io.LimitReader(br, int64(n))).Decode(fSnap); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// Reads the next file of a snapshot. An immutable segment's file is written to the data
+// directory as it is read and mapped, the active segment's is kept in memory.
+func readSnapshotFile(files io.Reader, idxName, segName string, toDisk bool) (*segmentFile, error) {
+
+	var n uint64
+	if err := binary.Read(files, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	copyFile := func(w io.Writer) error {
+		_, err := io.CopyN(w, files, int64(n))
+		return err
+	}
+
+	if toDisk && cfg.IndexDataDirectory != "" {
+		return createSegmentFile(segmentFilePath(idxName, segName), copyFile)
+	}
+
+	var buf bytes.Buffer
+	if err := copyFile(&buf); err != nil {
+		return nil, err
+	}
+	return parseSegmentFile(buf.Bytes())
+}
@@ -0,0 +1,119 @@
+package store
+
+import "math"
+
+// BM25 relevance scoring. Term statistics are summed over every segment of an index,
+// so a doc scores the same no matter which segment it ended up in.
+
+type BM25Params struct {
+	K1 float64 `json:"k1"`
+	B  float64 `json:"b"`
+}
+
+func DefaultBM25Params() BM25Params {
+	return BM25Params{
+		K1: 1.2,
+		B:  0.75,
+	}
+}
+
+// Per index settings, fixed at creation and replicated with the CreateIndex command.
+type IndexSettings struct {
+	BM25 BM25Params `json:"bm25"`
+	// analyzer of the fields without one of their own, at index and at query time
+	Analyzer string `json:"analyzer,omitempty"`
+	// analyzers of specific fields, by field name
+	FieldAnalyzers map[string]string `json:"field_analyzers,omitempty"`
+	// custom analyzers, usable by name like the built in ones
+	Analysis map[string]AnalyzerConfig `json:"analysis,omitempty"`
+	// field types, grows as dynamic mapping adds fields
+	Mapping Mapping `json:"mapping"`
+}
+
+func DefaultIndexSettings() IndexSettings {
+	return IndexSettings{
+		BM25:     DefaultBM25Params(),
+		Analyzer: DefaultAnalyzer,
+	}
+}
+
+// Checks the settings before they are replicated, every node has to be able to build the index.
+func (s IndexSettings) Validate() error {
+	if err := s.Mapping.validate(); err != nil {
+		return err
+	}
+	_, _, err := s.buildAnalyzers(false)
+	return err
+}
+
+// Number of docs having a field, and the total number of tokens in it.
+type FieldStats struct {
+	DocCount  int `json:"doc_count"`
+	SumLength int `json:"sum_length"`
+}
+
+// Index-wide statistics a search is scored with.
+type IndexStats struct {
+	Fields  map[string]FieldStats
+	DocFreq map[Term]int
+	Params  BM25Params
+}
+
+// Sums the field and term statistics of the given segments for the query terms.
+func collectStats(segs []*Segment, terms []Term, params BM25Params) *IndexStats {
+	st := &IndexStats{
+		Fields:  make(map[string]FieldStats),
+		DocFreq: make(map[Term]int, len(terms)),
+		Params:  params,
+	}
+
+	// a term repeated in the query must not be counted twice
+	fields := make(map[string]struct{})
+	for _, t := range terms {
+		st.DocFreq[t] = 0
+		fields[t.Field()] = struct{}{}
+	}
+
+	for _, seg := range segs {
+		for t := range st.DocFreq {
+			st.DocFreq[t] += seg.TermDict.docFreq(t)
+		}
+
+		for field := range fields {
+			fs := st.Fields[field]
+			segFs := seg.FieldStats[field]
+			fs.DocCount += segFs.DocCount
+			fs.SumLength += segFs.SumLength
+			st.Fields[field] = fs
+		}
+	}
+
+	return st
+}
+
+// Inverse document frequency of a term, the BM25 (Lucene) variant which never goes negative.
+func (st *IndexStats) IDF(t Term) float64 {
+	n := float64(st.Fields[t.Field()].DocCount)
+	df := float64(st.DocFreq[t])
+	return math.Log(1 + (n-df+0.5)/(df+0.5))
+}
+
+// BM25 score of a term occurring freq times in a field of fieldLen tokens.
+func (st *IndexStats) Score(t Term, freq, fieldLen int) float64 {
+	return st.scoreFreq(st.IDF(t), t.Field(), float64(freq), fieldLen)
+}
+
+// BM25 for a given idf, so phrases can be scored with the summed idf of their terms.
+func (st *IndexStats) scoreFreq(idf float64, field string, freq float64, fieldLen int) float64 {
+	fs := st.Fields[field]
+
+	avgLen := 1.0
+	if fs.DocCount > 0 {
+		avgLen = float64(fs.SumLength) / float64(fs.DocCount)
+	}
+
+	k1, b := st.Params.K1, st.Params.B
+	norm := k1 * (1 - b + b*float64(fieldLen)/avgLen)
+
+	return idf * freq * (k1 + 1) / (freq + norm)
+}
@@ -2,117 +2,179 @@ package store
 
 import (
 	"encoding/json"
+	"fmt"
+	"gocene/config"
 	"gocene/internal/utils"
 	"log"
-	"sort"
 	"sync"
+	"time"
+)
+
+// Default page size of a search, and how deep pages can go, like Elasticsearch's
+// index.max_result_window. Every segment keeps from + size hits while searching.
+const (
+	DefaultSearchSize = 10
+	MaxResultWindow   = 10000
 )
 
 type RankedResultDoc struct {
-	Score int             `json:"score"`
+	DocID int             `json:"doc_id"`
+	Score float64         `json:"score"`
 	Data  json.RawMessage `json:"data"`
 }
 
-type RankedDocData struct {
-	Score     int
-	ParentSeg *Segment
-
-	DocID int
+type segmentHits struct {
+	docs  []RankedDoc
+	total int
+	err   error
 }
 
-// Searches all the segments in the index concurrently.
-// Todo: Limit goroutine spawning
-func (idx *Index) SearchFullText(terms []Term) (results []RankedResultDoc, err error) {
+// Page of a search. From has to be 0 with a cursor, the page starts after it instead.
+type SearchOptions struct {
+	From, Size int
+	After      *SearchCursor
 
-	var res []RankedDocData
+	// searches a point in time view rather than the index as it is now, keeping it alive
+	// for another KeepAlive (when not 0)
+	PIT       string
+	KeepAlive time.Duration
+}
+
+// Searches all the segments in the index concurrently, and returns a page of hits with the
+// total number of hits. Only the docs of the page are fetched from Minio, and a hit whose
+// doc was deleted after the search ranked it is left out of the page.
+func (idx *Index) SearchFullText(q Query, opts SearchOptions) (results []RankedResultDoc, total int, err error) {
 
 	log.Println("inside store SearchFullText()")
 
-	resChan := make(chan []RankedDocData, len(idx.Segments)+1)
-	resErrs := make(chan error, len(idx.Segments)+1)
-	var wg sync.WaitGroup
+	from, size := opts.From, opts.Size
+	if from < 0 || size < 0 {
+		return nil, 0, &QueryError{Reason: "from and size must not be negative"}
+	}
+	if from+size > MaxResultWindow {
+		return nil, 0, &QueryError{Reason: fmt.Sprintf("from + size must be at most %d", MaxResultWindow)}
+	}
+	if opts.After != nil && from != 0 {
+		return nil, 0, &QueryError{Reason: "from must be 0 with search_after"}
+	}
+	ranked, total, err := idx.rank(q, opts, from+size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from >= len(ranked) {
+		return nil, total, nil
+	}
+
+	// get the json data for each doc of the page
+	for _, iter := range ranked[from:] {
 
-	// search segments concurrently
-	for _, seg := range idx.Segments {
+		jsonStr, err := idx.DocumentJSON(iter.DocID)
+		if err == utils.ErrObjectNotFound {
+			log.Println("doc deleted since it was ranked, skipping: ", iter.DocID)
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
 
+		results = append(results, RankedResultDoc{
+			DocID: iter.DocID,
+			Score: iter.Score,
+			Data:  json.RawMessage(idx.StoredSource([]byte(jsonStr))),
+		})
+	}
+	return results, total, nil
+}
+
+// The k best hits of the query across the segments, after opts.After when given, and the
+// total number of hits.
+func (idx *Index) rank(q Query, opts SearchOptions, k int) (ranked []RankedDoc, total int, err error) {
+
+	// a point in time view has no active segment, it was frozen with the rest
+	var segs []*Segment
+	var active *ActiveSegment
+	if opts.PIT != "" {
+		if segs, err = idx.pointInTimeSegments(opts.PIT, opts.KeepAlive); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		idx.Mutex.RLock()
+		segs = append([]*Segment(nil), idx.Segments...)
+		for _, seg := range segs {
+			seg.incRef()
+		}
+		active = &idx.As
+		idx.Mutex.RUnlock()
+	}
+
+	// BM25 needs term and field statistics of the whole index, not just one segment
+	var stats *IndexStats
+	if active != nil {
+		active.Mutex.RLock()
+		stats = collectStats(append(segs, active.Seg), q.ScoringTerms(), idx.Settings.BM25)
+		active.Mutex.RUnlock()
+	} else {
+		stats = collectStats(segs, q.ScoringTerms(), idx.Settings.BM25)
+	}
+	after := opts.After
+
+	// search segments with a bounded number of workers, each segment keeping its k best hits
+	jobs := make(chan *Segment)
+	resChan := make(chan segmentHits, len(segs)+1)
+	var wg sync.WaitGroup
+
+	for w := 0; w < min(max(config.SearchWorkers, 1), len(segs)); w++ {
 		wg.Add(1)
-		go func(s *Segment) {
+		go func() {
 			defer wg.Done()
-			sRes, err := s.SearchFullText(terms)
-
-			var resTemp []RankedDocData
-			for _, r := range sRes {
-				resTemp = append(resTemp, RankedDocData{
-					Score:     r.Score,
-					ParentSeg: s,
-					DocID:     r.DocID,
-				})
+			for seg := range jobs {
+				docs, total, err := seg.SearchFullText(q, stats, k, after)
+				resChan <- segmentHits{docs: docs, total: total, err: err}
 			}
+		}()
+	}
+
+	// search active segment too, needs a lock
+	if active != nil {
+		wg.Add(1)
+		go func(as *ActiveSegment) {
+			defer wg.Done()
 
-			resChan <- resTemp
-			resErrs <- err
+			as.Mutex.RLock()
+			defer as.Mutex.RUnlock()
 
-		}(seg)
+			docs, total, err := as.Seg.SearchFullText(q, stats, k, after)
+			resChan <- segmentHits{docs: docs, total: total, err: err}
+		}(active)
 	}
 
-	// search active segment too, needs a lock
-	wg.Add(1)
-	go func(as *ActiveSegment) {
-		defer wg.Done()
-
-		as.Mutex.RLock()
-		defer as.Mutex.RUnlock()
-
-		asRes, err := as.Seg.SearchFullText(terms)
-
-		var resTemp []RankedDocData
-		for _, r := range asRes {
-			resTemp = append(resTemp, RankedDocData{
-				Score:     r.Score,
-				ParentSeg: as.Seg,
-				DocID:     r.DocID,
-			})
+	go func() {
+		for _, seg := range segs {
+			jobs <- seg
 		}
+		close(jobs)
+	}()
 
-		resChan <- resTemp
-		resErrs <- err
-	}(&idx.As)
-
+	// the segments are released once every worker is done with them, also when returning early
 	go func() {
 		wg.Wait()
+		for _, seg := range segs {
+			seg.close()
+		}
 		close(resChan)
-		close(resErrs)
 	}()
 
-	// do merge algo for top k later, since all segments return sorted
-	// aggregate
-	for temp := range resChan {
-		res = append(res, temp...)
-	}
-
-	for tempErr := range resErrs {
-		if tempErr != nil {
-			log.Println("error searching an index")
+	// merge the segments' best hits into the index's k best
+	top := newTopDocs(k)
+	for hits := range resChan {
+		if hits.err != nil {
+			// the buffered channel lets the remaining segments finish without a reader
+			return nil, 0, hits.err
 		}
-	}
-
-	// score results
-	sort.SliceStable(res, func(i, j int) bool {
-		return res[i].Score > res[j].Score
-	})
-
-	// get the json data for each scored and ranked doc
-	for _, iter := range res {
-
-		jsonStr, err := utils.GetDocumentFromMinio(idx.mc, iter.DocID, idx.Name)
-		if err != nil {
-			log.Println("error getting document: ", err.Error())
+		total += hits.total
+		for _, d := range hits.docs {
+			top.offer(d)
 		}
-
-		results = append(results, RankedResultDoc{
-			Score: iter.Score,
-			Data:  json.RawMessage(jsonStr),
-		})
 	}
-	return
+
+	return top.sorted(), total, nil
 }
@@ -0,0 +1,466 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"gocene/config"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Immutable segments keep their term dictionary, postings and doc values in a segment file, memory
+// mapped for searching, so the OS pages in the parts a search reads instead of the whole
+// index living on the heap. Files are written under IDX_DATA_DIR, one directory per index,
+// or kept in memory in the same format when no data directory is set.
+//
+// Layout of a file, integers are little endian and uvarints are unsigned varints:
+//
+//	header    magic "GSEG", version uint32
+//	postings  per term, blocks of doc ID deltas with skips, and freq and position streams,
+//	          see postings.go
+//	terms     per term in ascending order: length, bytes, doc freq, postings offset (uvarints)
+//	docs      doc IDs, body blobs, field lengths and numeric values, see docvalues.go
+//	footer    terms offset uint64, term count uint64, docs offset uint64, CRC-32 (IEEE) of
+//	          everything before it uint32
+//
+// Only every termIndexInterval-th term is kept in memory, a lookup binary searches those and
+// scans the terms section from there.
+
+const (
+	segmentFileMagic   = "GSEG"
+	segmentFileVersion = 2
+
+	segmentHeaderSize = 8
+	segmentFooterSize = 28
+
+	termIndexInterval = 32
+)
+
+type segmentFile struct {
+	data []byte
+	path string
+
+	termsOffset int
+	termCount   int
+	index       []termIndexEntry
+
+	docsOffset int
+	docs       fileDocs
+
+	// unmaps the data, nil for files kept in memory
+	unmap func([]byte) error
+
+	// references held by the index, searches, point in time views, snapshots and merges,
+	// starting with the one of whoever opened the file, and whether the file is to be
+	// removed once the last one is released, guarded by refMu
+	refs    int
+	removed bool
+	refMu   sync.Mutex
+}
+
+type termIndexEntry struct {
+	term   Term
+	offset int
+}
+
+// Entry of the terms section.
+type termEntry struct {
+	term     Term
+	docFreq  int
+	postings int
+}
+
+// Writes the postings of the terms, which are sorted, and the values of the docs in the
+// segment file format.
+func writeSegmentFile(w io.Writer, terms []Term, postings func(Term) TermData, docs docColumns) error {
+
+	sw := &segmentWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+
+	header := append([]byte(segmentFileMagic), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(header[4:], segmentFileVersion)
+	sw.write(header)
+
+	entries := make([]termEntry, 0, len(terms))
+	var buf []byte
+	for _, t := range terms {
+		td := postings(t)
+		if len(td) == 0 {
+			continue
+		}
+		entries = append(entries, termEntry{term: t, docFreq: len(td), postings: sw.offset})
+
+		buf = appendPostings(buf[:0], td)
+		sw.write(buf)
+	}
+
+	termsOffset := sw.offset
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(e.term)))
+		buf = append(buf, e.term...)
+		buf = binary.AppendUvarint(buf, uint64(e.docFreq))
+		buf = binary.AppendUvarint(buf, uint64(e.postings))
+		sw.write(buf)
+	}
+
+	docsOffset := sw.offset
+	writeDocColumns(sw, docs)
+
+	footer := make([]byte, segmentFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(termsOffset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(entries)))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(docsOffset))
+	sw.write(footer[:24])
+	binary.LittleEndian.PutUint32(footer[24:], sw.crc.Sum32())
+	sw.write(footer[24:])
+
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// Keeps the offset and checksum of what was written, and the first error.
+type segmentWriter struct {
+	w      *bufio.Writer
+	crc    hash.Hash32
+	offset int
+	err    error
+}
+
+func (sw *segmentWriter) write(b []byte) {
+	if sw.err != nil {
+		return
+	}
+	_, sw.err = sw.w.Write(b)
+	sw.crc.Write(b)
+	sw.offset += len(b)
+}
+
+// Checks the header and footer of the data, and indexes its terms.
+func parseSegmentFile(data []byte) (*segmentFile, error) {
+
+	if len(data) < segmentHeaderSize+segmentFooterSize || string(data[:4]) != segmentFileMagic {
+		return nil, ErrCorruptSegment
+	}
+	version := binary.LittleEndian.Uint32(data[4:])
+	if version != segmentFileVersion {
+		return nil, ErrSegmentVersion
+	}
+
+	footer := data[len(data)-segmentFooterSize:]
+	if crc32.ChecksumIEEE(data[:len(data)-4]) != binary.LittleEndian.Uint32(footer[24:]) {
+		return nil, ErrCorruptSegment
+	}
+
+	sf := &segmentFile{
+		data:        data,
+		termsOffset: int(binary.LittleEndian.Uint64(footer)),
+		termCount:   int(binary.LittleEndian.Uint64(footer[8:])),
+		docsOffset:  int(binary.LittleEndian.Uint64(footer[16:])),
+		refs:        1,
+	}
+	if sf.termsOffset < segmentHeaderSize || sf.docsOffset < sf.termsOffset || sf.docsOffset > len(data)-segmentFooterSize {
+		return nil, ErrCorruptSegment
+	}
+
+	off := sf.termsOffset
+	for i := 0; i < sf.termCount; i++ {
+		term, _, next, ok := sf.readTermEntry(off)
+		if !ok {
+			return nil, ErrCorruptSegment
+		}
+		if i%termIndexInterval == 0 {
+			sf.index = append(sf.index, termIndexEntry{term: Term(term), offset: off})
+		}
+		off = next
+	}
+	if off != sf.docsOffset {
+		return nil, ErrCorruptSegment
+	}
+
+	var ok bool
+	if sf.docs, ok = parseDocs(data[sf.docsOffset : len(data)-segmentFooterSize]); !ok {
+		return nil, ErrCorruptSegment
+	}
+
+	return sf, nil
+}
+
+// Reads the terms section entry at off, and returns the offset of the next one. The term
+// is left in the file's bytes, so scanning past terms does not copy them.
+func (sf *segmentFile) readTermEntry(off int) (term []byte, e termEntry, next int, ok bool) {
+	end := sf.docsOffset
+
+	n, ok := sf.uvarint(&off, end)
+	if !ok || n > uint64(end-off) {
+		return nil, e, 0, false
+	}
+	term = sf.data[off : off+int(n)]
+	off += int(n)
+
+	df, ok := sf.uvarint(&off, end)
+	if !ok {
+		return nil, e, 0, false
+	}
+	p, ok := sf.uvarint(&off, end)
+	if !ok || p >= uint64(sf.termsOffset) {
+		return nil, e, 0, false
+	}
+
+	e.docFreq, e.postings = int(df), int(p)
+	return term, e, off, true
+}
+
+func (sf *segmentFile) uvarint(off *int, end int) (uint64, bool) {
+	v, n := binary.Uvarint(sf.data[*off:end])
+	if n <= 0 {
+		return 0, false
+	}
+	*off += n
+	return v, true
+}
+
+// Terms section entry of the term.
+func (sf *segmentFile) lookup(t Term) (termEntry, bool) {
+	// last indexed term not after t, t is within the termIndexInterval terms after it
+	i := sort.Search(len(sf.index), func(i int) bool { return sf.index[i].term > t }) - 1
+	if i < 0 {
+		return termEntry{}, false
+	}
+
+	off := sf.index[i].offset
+	for j := i * termIndexInterval; j < min((i+1)*termIndexInterval, sf.termCount); j++ {
+		term, e, next, _ := sf.readTermEntry(off)
+		if c := strings.Compare(string(term), string(t)); c >= 0 {
+			e.term = t
+			return e, c == 0
+		}
+		off = next
+	}
+	return termEntry{}, false
+}
+
+// Decodes the postings of a terms section entry.
+func (sf *segmentFile) postings(e termEntry) TermData {
+	td := make(TermData, e.docFreq)
+	p := sf.blockPostings(e)
+	for p.nextDoc() {
+		td[p.doc()] = p.positions()
+	}
+	return td
+}
+
+// Walks the terms section of a segment file.
+type fileTermsEnum struct {
+	sf *segmentFile
+	// ordinal of the current term, and offset of the entry after it
+	ord     int
+	nextOff int
+	cur     termEntry
+}
+
+func (it *fileTermsEnum) seekCeil(t Term) bool {
+	sf := it.sf
+	if len(sf.index) == 0 {
+		return false
+	}
+
+	i := max(sort.Search(len(sf.index), func(i int) bool { return sf.index[i].term > t })-1, 0)
+	it.ord, it.nextOff = i*termIndexInterval-1, sf.index[i].offset
+	for it.ord+1 < sf.termCount {
+		term, _, next, _ := sf.readTermEntry(it.nextOff)
+		if string(term) >= string(t) {
+			return it.next()
+		}
+		it.ord, it.nextOff = it.ord+1, next
+	}
+	return false
+}
+
+func (it *fileTermsEnum) next() bool {
+	if it.ord+1 >= it.sf.termCount {
+		return false
+	}
+
+	term, e, next, _ := it.sf.readTermEntry(it.nextOff)
+	e.term = Term(term)
+	it.ord, it.nextOff, it.cur = it.ord+1, next, e
+	return true
+}
+
+func (it *fileTermsEnum) current() (Term, func() TermData) {
+	sf, e := it.sf, it.cur
+	return e.term, func() TermData { return sf.postings(e) }
+}
+
+// Takes a reference, so the data stays mapped until it is released with close.
+func (sf *segmentFile) incRef() {
+	sf.refMu.Lock()
+	defer sf.refMu.Unlock()
+	sf.refs++
+}
+
+// Releases a reference. The last one unmaps the data, and removes the file from the data
+// directory if the segment was merged away.
+func (sf *segmentFile) close() {
+	sf.refMu.Lock()
+	defer sf.refMu.Unlock()
+
+	if sf.refs--; sf.refs > 0 {
+		return
+	}
+
+	if sf.unmap != nil {
+		if err := sf.unmap(sf.data); err != nil {
+			log.Printf("could not unmap segment file %s, err: %v\n", sf.path, err)
+		}
+	}
+	sf.data = nil
+
+	if sf.removed && sf.path != "" {
+		if err := os.Remove(sf.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not remove segment file %s, err: %v\n", sf.path, err)
+		}
+	}
+}
+
+// Removes the file from the data directory once the last reference is released. Searches
+// still using it keep reading it until then.
+func (sf *segmentFile) remove() {
+	sf.refMu.Lock()
+	defer sf.refMu.Unlock()
+	sf.removed = true
+}
+
+// Writes a segment file with write and maps it. Without a data directory, or when the file
+// cannot be written, it is kept in memory instead so every node still ends up with the same
+// segments.
+func newSegmentFile(idxName, segName string, write func(io.Writer) error) *segmentFile {
+
+	if config.IndexDataDirectory != "" {
+		sf, err := createSegmentFile(segmentFilePath(idxName, segName), write)
+		if err == nil {
+			return sf
+		}
+		log.Printf("could not write segment %s of index %s to disk, keeping it in memory, err: %v\n", segName, idxName, err)
+	}
+
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		log.Printf("could not encode segment %s of index %s, err: %v\n", segName, idxName, err)
+	}
+	sf, err := parseSegmentFile(buf.Bytes())
+	if err != nil {
+		// cannot happen with the file just written
+		log.Fatalf("segment %s of index %s is corrupt, err: %v\n", segName, idxName, err)
+	}
+	return sf
+}
+
+// Writes the file next to its final path and renames it into place, so a crash never
+// leaves a partial file behind under a segment's name.
+func createSegmentFile(path string, write func(io.Writer) error) (*segmentFile, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return openSegmentFile(path)
+}
+
+// Maps a segment file and checks it.
+func openSegmentFile(path string) (*segmentFile, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data, unmap, err := mmapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	sf, err := parseSegmentFile(data)
+	if err != nil {
+		if unmap != nil {
+			unmap(data)
+		}
+		return nil, err
+	}
+
+	sf.path, sf.unmap = path, unmap
+	return sf, nil
+}
+
+// Index names come from clients, so they are escaped into a single path element.
+func indexDataDir(idxName string) string {
+	name := url.PathEscape(idxName)
+	if strings.Trim(name, ".") == "" {
+		name = strings.ReplaceAll(name, ".", "%2E")
+	}
+	return filepath.Join(config.IndexDataDirectory, name)
+}
+
+func segmentFilePath(idxName, segName string) string {
+	return filepath.Join(indexDataDir(idxName), segName+".seg")
+}
+
+// Removes the files of the index's data directory that belong to none of the segments,
+// left behind by merges and snapshots from before a restore.
+func removeStaleSegmentFiles(idxName string, segNames []string) {
+
+	if config.IndexDataDirectory == "" {
+		return
+	}
+
+	keep := make(map[string]bool, len(segNames))
+	for _, name := range segNames {
+		keep[name+".seg"] = true
+	}
+
+	entries, err := os.ReadDir(indexDataDir(idxName))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".seg") && !keep[e.Name()] {
+			os.Remove(filepath.Join(indexDataDir(idxName), e.Name()))
+		}
+	}
+}
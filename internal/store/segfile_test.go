@@ -0,0 +1,182 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Postings of a few terms, one of them spanning several blocks.
+func testSegmentPostings() map[Term]TermData {
+	long := make(TermData)
+	for docID := 0; docID < 3*postingsBlockSize+17; docID++ {
+		long[docID*3] = []int{docID % 5, docID%5 + 2}
+	}
+	return map[Term]TermData{
+		"content:blade": {1: {0}, 7: {3, 9}},
+		"content:steel": long,
+		"content:sword": {0: {1}, 1: {2, 4, 8}, 1000: {0}},
+		"title:sword":   {42: {0}},
+	}
+}
+
+func sortedTestTerms(postings map[Term]TermData) []Term {
+	terms := make([]Term, 0, len(postings))
+	for t := range postings {
+		terms = append(terms, t)
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i] < terms[j] })
+	return terms
+}
+
+func encodeTestSegment(t *testing.T, postings map[Term]TermData) []byte {
+	var buf bytes.Buffer
+	if err := writeSegmentFile(&buf, sortedTestTerms(postings), func(t Term) TermData { return postings[t] }, docColumns{}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSegmentFileRoundTrip(t *testing.T) {
+	postings := testSegmentPostings()
+
+	sf, err := parseSegmentFile(encodeTestSegment(t, postings))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for term, want := range postings {
+		e, ok := sf.lookup(term)
+		if !ok {
+			t.Errorf("%s not found", term)
+			continue
+		}
+		if e.docFreq != len(want) {
+			t.Errorf("%s has doc freq %d, want %d", term, e.docFreq, len(want))
+		}
+		if got := sf.postings(e); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s postings differ", term)
+		}
+	}
+	for _, term := range []Term{"content:axe", "content:sworda", "zzz:sword", ""} {
+		if _, ok := sf.lookup(term); ok {
+			t.Errorf("%q should not be found", term)
+		}
+	}
+
+	var terms []Term
+	TermDictionary{file: sf}.forEach(func(t Term, _ func() TermData) bool {
+		terms = append(terms, t)
+		return true
+	})
+	if !reflect.DeepEqual(terms, sortedTestTerms(postings)) {
+		t.Errorf("got terms %v", terms)
+	}
+}
+
+func TestSegmentFileCorrupt(t *testing.T) {
+	data := encodeTestSegment(t, testSegmentPostings())
+
+	flipped := func(i int) []byte {
+		b := append([]byte(nil), data...)
+		b[i] ^= 0x40
+		return b
+	}
+	version := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(version[4:], segmentFileVersion+1)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"postings byte", flipped(segmentHeaderSize + 3), ErrCorruptSegment},
+		{"docs byte", flipped(len(data) - segmentFooterSize - 2), ErrCorruptSegment},
+		{"checksum", flipped(len(data) - 1), ErrCorruptSegment},
+		{"magic", flipped(0), ErrCorruptSegment},
+		{"truncated", data[:len(data)-1], ErrCorruptSegment},
+		{"too short", data[:segmentHeaderSize], ErrCorruptSegment},
+		{"version", version, ErrSegmentVersion},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseSegmentFile(tt.data); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSegmentFileDocValues(t *testing.T) {
+	idx := newQueryTestIndex()
+	blob := func(c string) string { return strings.Repeat(c, 64) }
+
+	docs := []struct {
+		id         int
+		json, blob string
+	}{
+		{4, `{"title": "iron sword", "price": 7}`, blob("a")},
+		{1, `{"title": "blade", "price": 12}`, blob("b")},
+		{9, `{"title": ["old", "rusty axe"], "price": 5}`, ""},
+		{6, `{"price": 7}`, blob("c")},
+	}
+	for _, d := range docs {
+		doc, err := idx.CreateDocumentFromJSON(d.json)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc.ID, doc.Blob = d.id, d.blob
+		if _, err = idx.As.AddDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.As.Seg.Tombstone(6)
+
+	active := idx.As.Seg
+	sealed := active.sealed()
+	restored, _ := NewSegment("seg_0", idx)
+	restored.loadDocs(sealed.fileDocs())
+
+	for _, seg := range []*Segment{active, sealed, restored} {
+		if got := seg.docIDs(); !reflect.DeepEqual(got, []int{1, 4, 6, 9}) {
+			t.Errorf("got doc IDs %v", got)
+		}
+		for _, d := range docs {
+			if got := seg.docBlob(d.id); got != d.blob {
+				t.Errorf("doc %d has blob %q, want %q", d.id, got, d.blob)
+			}
+		}
+
+		lengths := seg.fieldLengths("title")
+		for docID, want := range map[int]int{1: 1, 4: 2, 6: 0, 9: 3, 100: 0} {
+			if got := lengths.get(docID); got != want {
+				t.Errorf("doc %d has title length %d, want %d", docID, got, want)
+			}
+		}
+		if got, want := seg.FieldStats["title"], (FieldStats{DocCount: 3, SumLength: 6}); got != want {
+			t.Errorf("got title stats %+v, want %+v", got, want)
+		}
+
+		for _, tt := range []struct {
+			min, max int64
+			want     []int
+		}{
+			{5, 7, []int{9, 4, 6}},
+			{8, 100, []int{1}},
+			{13, 100, nil},
+		} {
+			if got := seg.docsInRange("price", tt.min, tt.max); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prices in [%d, %d]: got %v, want %v", tt.min, tt.max, got, tt.want)
+			}
+		}
+	}
+
+	if live, docCount := sealed.liveDocCount(); live != 3 || docCount != 4 {
+		t.Errorf("sealed segment has %d live docs of %d, want 3 of 4", live, docCount)
+	}
+	if !sealed.isDeleted(6) {
+		t.Errorf("doc 6 lost its tombstone when sealed")
+	}
+}
@@ -1,9 +1,11 @@
 package store
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"slices"
 	"sort"
-	"strings"
 	"sync"
 )
 
@@ -12,6 +14,24 @@ type Segment struct {
 	TermDict  TermDictionary
 	ParentIdx *Index
 
+	// IDs of the docs indexed into this segment, and the ones deleted since.
+	// Tombstoned docs stay in the term dictionary but are skipped while searching.
+	// DocIDs, FieldLengths, Numeric and Blobs are only kept for the active segment,
+	// immutable segments read them from their segment file, see docvalues.go.
+	DocIDs     map[int]struct{}
+	Tombstones map[int]struct{}
+	tombMu     sync.RWMutex
+
+	// token count of each field of each doc, and their totals per field, for BM25
+	FieldLengths map[string]map[int]int
+	FieldStats   map[string]FieldStats
+
+	// sorted values of the integer, float and date fields, for range queries
+	Numeric map[string]NumericValues
+
+	// blob of each doc's body, see blobs.go
+	Blobs map[int]string
+
 	// docID to byte offset and length map
 	// PostingsMap map[int]docPosition
 
@@ -41,22 +61,268 @@ type ActiveSegment struct {
 }
 
 // used for the full-text search
-// in memory for now, mmap to disk in the future
+// in memory for the active segment, immutable segments read theirs from a segment file
 type TermDictionary struct {
-	dict map[Term]TermData
+	dict map[Term]*memPostings
+	// the dict's terms in ascending order, for prefix, wildcard, regexp and fuzzy queries,
+	// but for the ones added since pending got long enough to be merged into them
+	terms   []Term
+	pending []Term
+	// terms of each doc of an in memory dict, so removing a doc only touches its own terms
+	docTerms map[int][]Term
+	file     *segmentFile
 }
 
+// Terms added to an in memory dict are merged into its sorted terms this many at a time,
+// rather than moving every term after them on each add. Removed terms are only dropped
+// from them then too, and are skipped until then.
+const pendingTerms = 1024
+
 func NewTermDictionary() TermDictionary {
 	return TermDictionary{
-		dict: make(map[Term]TermData),
+		dict:     make(map[Term]*memPostings),
+		docTerms: make(map[int][]Term),
+	}
+}
+
+// Lists the terms of each doc of an in memory dict loaded as a whole.
+func (td *TermDictionary) loadDocTerms() {
+	td.docTerms = make(map[int][]Term)
+	for t, mp := range td.dict {
+		p := mp.iterator()
+		for p.nextDoc() {
+			td.docTerms[p.doc()] = append(td.docTerms[p.doc()], t)
+		}
+	}
+}
+
+// Deep copy, the active segment keeps changing while a view of it is searched.
+func (td TermDictionary) copy() TermDictionary {
+	c := TermDictionary{
+		dict:    make(map[Term]*memPostings, len(td.dict)),
+		terms:   append([]Term(nil), td.terms...),
+		pending: append([]Term(nil), td.pending...),
+	}
+	for t, mp := range td.dict {
+		c.dict[t] = mp.clone()
 	}
+	return c
+}
+
+// Adds a term to the in memory dict. A term removed before is still in the sorted or the
+// pending terms, and is not added to them again.
+func (td *TermDictionary) insert(t Term, mp *memPostings) {
+	td.dict[t] = mp
+	if _, found := slices.BinarySearch(td.terms, t); found || slices.Contains(td.pending, t) {
+		return
+	}
+
+	td.pending = append(td.pending, t)
+	if len(td.pending) >= pendingTerms {
+		td.terms = td.sortedTerms()
+		td.pending = nil
+	}
+}
+
+// Drops a term from the in memory dict.
+func (td *TermDictionary) remove(t Term) {
+	delete(td.dict, t)
+}
+
+// Adds the positions of a term in a doc to the in memory dict, once per doc and term.
+func (td *TermDictionary) addDoc(t Term, docID int, positions []int) {
+	if mp, ok := td.dict[t]; ok {
+		mp.add(docID, positions)
+	} else {
+		td.insert(t, newMemPostings(TermData{docID: positions}))
+	}
+	td.docTerms[docID] = append(td.docTerms[docID], t)
+}
+
+// Drops every posting of the doc from the in memory dict.
+func (td *TermDictionary) removeDoc(docID int) {
+	for _, t := range td.docTerms[docID] {
+		if td.dict[t].remove(docID) == 0 {
+			td.remove(t)
+		}
+	}
+	delete(td.docTerms, docID)
+}
+
+// All the terms of an in memory dict in ascending order.
+func (td TermDictionary) sortedTerms() []Term {
+	pending := slices.Sorted(slices.Values(td.pending))
+	terms := make([]Term, 0, len(td.terms)+len(pending))
+	i, j := 0, 0
+	for i < len(td.terms) || j < len(pending) {
+		var t Term
+		if j == len(pending) || (i < len(td.terms) && td.terms[i] < pending[j]) {
+			t = td.terms[i]
+			i++
+		} else {
+			t = pending[j]
+			j++
+		}
+		if _, ok := td.dict[t]; ok {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// Postings of the term, false if no doc has it.
+func (td TermDictionary) postings(t Term) (TermData, bool) {
+	if td.file == nil {
+		mp, ok := td.dict[t]
+		if !ok {
+			return nil, false
+		}
+		return mp.termData(), true
+	}
+
+	e, ok := td.file.lookup(t)
+	if !ok {
+		return nil, false
+	}
+	return td.file.postings(e), true
+}
+
+// Iterator over the postings of the term, false if no doc has it.
+func (td TermDictionary) postingsIterator(t Term) (postingsIterator, bool) {
+	if td.file == nil {
+		mp, ok := td.dict[t]
+		if !ok {
+			return nil, false
+		}
+		return mp.iterator(), true
+	}
+
+	e, ok := td.file.lookup(t)
+	if !ok {
+		return nil, false
+	}
+	return td.file.blockPostings(e), true
+}
+
+// Number of docs having the term, without reading their postings.
+func (td TermDictionary) docFreq(t Term) int {
+	if td.file == nil {
+		if mp, ok := td.dict[t]; ok {
+			return mp.df
+		}
+		return 0
+	}
+
+	e, _ := td.file.lookup(t)
+	return e.docFreq
+}
+
+// Walks the terms of a dictionary in ascending order, like Lucene's TermsEnum.
+type termsEnum interface {
+	// moves to the first term not before t, false if there is none
+	seekCeil(t Term) bool
+	// moves to the term after the current one, false past the last term
+	next() bool
+	// the current term, and a function reading its postings
+	current() (Term, func() TermData)
+}
+
+func (td TermDictionary) iterator() termsEnum {
+	if td.file != nil {
+		return &fileTermsEnum{sf: td.file}
+	}
+	return &memTermsEnum{dict: td.dict, terms: td.terms, pending: slices.Sorted(slices.Values(td.pending))}
+}
+
+// Calls fn with the terms in ascending order from the first one not before from, until it
+// returns false. Postings are only read for the terms fn asks them for.
+func (td TermDictionary) seek(from Term, fn func(t Term, postings func() TermData) bool) {
+	it := td.iterator()
+	for ok := it.seekCeil(from); ok; ok = it.next() {
+		if !fn(it.current()) {
+			return
+		}
+	}
+}
+
+// Calls fn with every term in ascending order, until it returns false.
+func (td TermDictionary) forEach(fn func(t Term, postings func() TermData) bool) {
+	td.seek("", fn)
+}
+
+// Walks the sorted terms and the sorted pending terms of an in memory dict together.
+type memTermsEnum struct {
+	dict           map[Term]*memPostings
+	terms, pending []Term
+	i, j           int
+	cur            Term
+}
+
+func (it *memTermsEnum) seekCeil(t Term) bool {
+	it.i, _ = slices.BinarySearch(it.terms, t)
+	it.j, _ = slices.BinarySearch(it.pending, t)
+	return it.next()
+}
+
+func (it *memTermsEnum) next() bool {
+	for {
+		switch {
+		case it.j == len(it.pending) && it.i == len(it.terms):
+			return false
+		case it.j == len(it.pending) || (it.i < len(it.terms) && it.terms[it.i] < it.pending[it.j]):
+			it.cur = it.terms[it.i]
+			it.i++
+		default:
+			it.cur = it.pending[it.j]
+			it.j++
+		}
+
+		// removed terms are still in the sorted ones
+		if _, ok := it.dict[it.cur]; ok {
+			return true
+		}
+	}
+}
+
+func (it *memTermsEnum) current() (Term, func() TermData) {
+	mp := it.dict[it.cur]
+	return it.cur, func() TermData { return mp.termData() }
+}
+
+// Writes the active segment's dict and doc values in the segment file format. Only called
+// on a segment that no longer changes, or under the lock of the active segment.
+func (seg *Segment) writeFile(w io.Writer) error {
+	td := seg.TermDict
+	return writeSegmentFile(w, td.sortedTerms(), func(t Term) TermData { return td.dict[t].termData() }, seg.columns())
+}
+
+// The active segment in the segment file format, which snapshots carry for the active
+// segment too rather than its maps.
+func (seg *Segment) encoded() (*segmentFile, error) {
+	var buf bytes.Buffer
+	if err := seg.writeFile(&buf); err != nil {
+		return nil, err
+	}
+	return parseSegmentFile(buf.Bytes())
+}
+
+// The terms and postings of a segment file in an in memory dict, for the active segment
+// of a snapshot.
+func (sf *segmentFile) inMemory() TermDictionary {
+	td := NewTermDictionary()
+	TermDictionary{file: sf}.forEach(func(t Term, postings func() TermData) bool {
+		td.dict[t] = newMemPostings(postings())
+		td.terms = append(td.terms, t)
+		return true
+	})
+	td.loadDocTerms()
+	return td
 }
 
 // doc position in doc file
 type docPosition struct {
 	byteOffset int
 	length     int
-	tombstone  bool
 }
 
 // Returns a new segment with given name, or error if file open unsuccessful
@@ -67,8 +333,14 @@ func NewSegment(name string, parentIdx *Index) (*Segment, error) {
 		// Docs:        f,
 		ParentIdx: parentIdx,
 		// PostingsMap: make(map[int]docPosition),
-		DocCount: 0,
-		ByteSize: 0,
+		DocIDs:       make(map[int]struct{}),
+		Tombstones:   make(map[int]struct{}),
+		FieldLengths: make(map[string]map[int]int),
+		FieldStats:   make(map[string]FieldStats),
+		Numeric:      make(map[string]NumericValues),
+		Blobs:        make(map[int]string),
+		DocCount:     0,
+		ByteSize:     0,
 	}, nil
 }
 
@@ -98,114 +370,303 @@ func (as *ActiveSegment) AddDocument(doc *Document) (id int, err error) {
 		return 0, err
 	}
 
+	as.Seg.tombMu.Lock()
+	as.Seg.DocIDs[doc.ID] = struct{}{}
+	as.Seg.tombMu.Unlock()
+	if doc.Blob != "" {
+		as.Seg.Blobs[doc.ID] = doc.Blob
+	}
 	as.Seg.DocCount++
 	return as.Seg.DocCount, nil
 }
 
+// Returns true if the doc was indexed into this segment and has not been deleted.
+func (seg *Segment) HasLiveDocument(docID int) bool {
+	seg.tombMu.RLock()
+	defer seg.tombMu.RUnlock()
+
+	if !seg.hasDoc(docID) {
+		return false
+	}
+	_, deleted := seg.Tombstones[docID]
+	return !deleted
+}
+
+// Marks a doc in this segment as deleted. Returns false if the segment does not
+// hold a live copy of the doc.
+func (seg *Segment) Tombstone(docID int) bool {
+	seg.tombMu.Lock()
+	defer seg.tombMu.Unlock()
+
+	if !seg.hasDoc(docID) {
+		return false
+	}
+	if _, deleted := seg.Tombstones[docID]; deleted {
+		return false
+	}
+
+	seg.Tombstones[docID] = struct{}{}
+	return true
+}
+
+// Sorted IDs of the deleted docs.
+func (seg *Segment) tombstoneIDs() []int {
+	seg.tombMu.RLock()
+	defer seg.tombMu.RUnlock()
+	return sortedIDs(seg.Tombstones)
+}
+
+// Restores the segment's tombstones from a snapshot.
+func (seg *Segment) loadTombstones(tombstones []int) {
+	seg.tombMu.Lock()
+	defer seg.tombMu.Unlock()
+	for _, id := range tombstones {
+		seg.Tombstones[id] = struct{}{}
+	}
+}
+
+func sortedIDs(set map[int]struct{}) []int {
+	ids := make([]int, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// IDs of the docs in the segment that have not been deleted, in ascending order.
+func (seg *Segment) liveDocs() []int {
+	docIDs := seg.docIDs()
+
+	seg.tombMu.RLock()
+	defer seg.tombMu.RUnlock()
+
+	live := docIDs[:0]
+	for _, docID := range docIDs {
+		if _, deleted := seg.Tombstones[docID]; !deleted {
+			live = append(live, docID)
+		}
+	}
+	return live
+}
+
+func (seg *Segment) isDeleted(docID int) bool {
+	seg.tombMu.RLock()
+	defer seg.tombMu.RUnlock()
+	_, deleted := seg.Tombstones[docID]
+	return deleted
+}
+
+// Drops every posting of the doc from the active segment. The active segment is
+// still mutable, so a replaced doc can be removed outright instead of tombstoned.
+// Returns false if the segment does not hold a live copy of the doc.
+func (as *ActiveSegment) RemoveDocument(docID int) bool {
+
+	as.Mutex.Lock()
+	defer as.Mutex.Unlock()
+
+	if !as.Seg.HasLiveDocument(docID) {
+		return false
+	}
+
+	as.Seg.TermDict.removeDoc(docID)
+
+	for field, lengths := range as.Seg.FieldLengths {
+		length, ok := lengths[docID]
+		if !ok {
+			continue
+		}
+		delete(lengths, docID)
+
+		fs := as.Seg.FieldStats[field]
+		fs.DocCount--
+		fs.SumLength -= length
+		as.Seg.FieldStats[field] = fs
+	}
+
+	for field, nv := range as.Seg.Numeric {
+		as.Seg.Numeric[field] = nv.remove(docID)
+	}
+
+	as.Seg.tombMu.Lock()
+	delete(as.Seg.DocIDs, docID)
+	as.Seg.tombMu.Unlock()
+	delete(as.Seg.Blobs, docID)
+
+	as.Seg.DocCount--
+	return true
+}
+
+// Positions left between the values of a multi-valued field, like Lucene's
+// position_increment_gap, so phrases do not match across two values.
+const positionIncrementGap = 100
+
 // Update active segment's term dictionary
 func (as *ActiveSegment) UpdateTermDictionary(doc *Document) (err error) {
 
+	// first position of the next value of each field
+	nextPosition := make(map[string]int)
+
+	// positions of each term of the doc, added to the dict once all of them are known
+	positions := make(map[Term][]int)
+	var terms []Term
+
 	for _, f := range doc.Fields {
-		var tokens []string
-		if f.TokenizerString != "" {
-			tokens = strings.Split(f.Value, f.TokenizerString)
-		} else {
-			if as.Seg.ParentIdx.CaseSensitivity {
-				tokens = append(tokens, f.Value)
-			} else {
-				tokens = append(tokens, strings.ToLower(f.Value))
+		tokens := as.Seg.ParentIdx.FieldAnalyzer(f.Name).Analyze(f.Value)
+
+		base := nextPosition[f.Name]
+		if len(tokens) > 0 {
+			nextPosition[f.Name] = base + tokens[len(tokens)-1].Position + 1 + positionIncrementGap
+		}
+
+		as.Seg.addFieldLength(f.Name, doc.ID, len(tokens))
+
+		if isNumericField(f.Type) {
+			if key, ok := numericKey(f.Type, f.Value); ok {
+				as.Seg.Numeric[f.Name] = as.Seg.Numeric[f.Name].insert(NumericPoint{Key: key, DocID: doc.ID})
 			}
 		}
 
 		for _, token := range tokens {
-			t := NewTerm(f.Name, token)
-
-			// Check if TermData available for the given term
-			if _, exists := as.Seg.TermDict.dict[t]; !exists {
-				// create term data and add to map
-				var td TermData = make(map[int]int)
-				td[doc.ID] = 1
-				as.Seg.TermDict.dict[t] = td
-
-			} else {
-				// increment the frequency of current term
-				as.Seg.TermDict.dict[t][doc.ID] += 1
+			t := NewTerm(f.Name, token.Text)
+			if _, seen := positions[t]; !seen {
+				terms = append(terms, t)
 			}
+			positions[t] = append(positions[t], base+token.Position)
 		}
 	}
 
+	for _, t := range terms {
+		as.Seg.TermDict.addDoc(t, doc.ID, positions[t])
+	}
+
 	return nil
 }
 
-// Future - Use relative positions of terms to rank better.
-// Currently uses only total frequency of all words as score to rank results.
-func (seg *Segment) SearchFullText(terms []Term) (res []RankedDoc, err error) {
+// Records the token count of a doc's field. Multiple values of a field add up.
+func (seg *Segment) addFieldLength(field string, docID, length int) {
+	lengths, ok := seg.FieldLengths[field]
+	if !ok {
+		lengths = make(map[int]int)
+		seg.FieldLengths[field] = lengths
+	}
 
-	var allDocsMap map[int]RankedDoc = make(map[int]RankedDoc)
+	fs := seg.FieldStats[field]
+	if _, seen := lengths[docID]; !seen {
+		fs.DocCount++
+	}
+	fs.SumLength += length
+	seg.FieldStats[field] = fs
 
-	for _, term := range terms {
-		tempRes, err := seg.SearchTerm(term)
-		// fmt.Println("found results for term: ", term, " - ", tempRes)
-		if err != nil && err.Error() != "no documents contain given term" {
-			return nil, err
-		}
+	lengths[docID] += length
+}
 
-		for _, iter := range tempRes {
-			if _, exists := allDocsMap[iter.DocID]; exists {
-				temp := allDocsMap[iter.DocID]
-				temp.Score += iter.Score
-				allDocsMap[iter.DocID] = temp
-			} else {
-				allDocsMap[iter.DocID] = RankedDoc{
-					Score: iter.Score,
-					DocID: iter.DocID,
-				}
-			}
+// A point in time view keeps the active segment's values as they are, from a copy.
+func (seg *Segment) copyFieldLengths() map[string]map[int]int {
+	fieldLengths := make(map[string]map[int]int, len(seg.FieldLengths))
+	for field, lengths := range seg.FieldLengths {
+		fieldLengths[field] = make(map[int]int, len(lengths))
+		for docID, length := range lengths {
+			fieldLengths[field][docID] = length
 		}
 	}
+	return fieldLengths
+}
 
-	var scores []int
+func (seg *Segment) copyNumeric() map[string]NumericValues {
+	numeric := make(map[string]NumericValues, len(seg.Numeric))
+	for field, nv := range seg.Numeric {
+		numeric[field] = append(NumericValues(nil), nv...)
+	}
+	return numeric
+}
 
-	for _, doc := range allDocsMap {
-		scores = append(scores, doc.Score)
-		res = append(res, doc)
+// An immutable segment reading its term dictionary and doc values from the file.
+func fileSegment(name string, parentIdx *Index, sf *segmentFile) *Segment {
+	return &Segment{
+		Name:       name,
+		TermDict:   TermDictionary{file: sf},
+		ParentIdx:  parentIdx,
+		Tombstones: make(map[int]struct{}),
+		FieldStats: sf.docs.fieldStats(),
+		DocCount:   sf.docs.count,
 	}
+}
 
-	sort.SliceStable(res, func(i, j int) bool {
-		return scores[i] > scores[j]
-	})
+// Takes a reference on the segment's file, which anything reading an immutable segment
+// without holding the index's lock needs, and releases it with close. Segments kept in
+// memory have nothing to release.
+func (seg *Segment) incRef() {
+	if seg.TermDict.file != nil {
+		seg.TermDict.file.incRef()
+	}
+}
 
-	return
+func (seg *Segment) close() {
+	if seg.TermDict.file != nil {
+		seg.TermDict.file.close()
+	}
 }
 
-// Search for a single term in a segment
-func (seg *Segment) SearchTerm(t Term) (res []RankedDoc, err error) {
+// The active segment made immutable, written to a segment file. The active segment
+// itself is left as is for the searches still running on it.
+func (seg *Segment) sealed() *Segment {
+	sf := newSegmentFile(seg.ParentIdx.Name, seg.Name, seg.writeFile)
 
-	td, found := seg.TermDict.dict[t]
-	if !found {
-		return nil, errors.New("no documents contain given term")
+	c := fileSegment(seg.Name, seg.ParentIdx, sf)
+	c.loadTombstones(seg.tombstoneIDs())
+	c.ByteSize = seg.ByteSize
+	return c
+}
+
+// Runs the query on the segment, using index-wide statistics for scoring. Returns the k best
+// live docs matching it after the cursor (when given) sorted by score, ties broken by doc ID,
+// and how many docs matched in all.
+func (seg *Segment) SearchFullText(q Query, stats *IndexStats, k int, after *SearchCursor) (res []RankedDoc, total int, err error) {
+
+	allDocsMap, err := q.Search(seg, stats)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	var freqs, docnos []int
-	for docno, freq := range td {
-		docnos = append(docnos, docno)
-		freqs = append(freqs, freq)
+	top := newTopDocs(k)
+	for docID, score := range allDocsMap {
+		d := RankedDoc{
+			Score: score,
+			DocID: docID,
+		}
+		if after == nil || after.before(d) {
+			top.offer(d)
+		}
 	}
 
-	sort.SliceStable(docnos, func(i, j int) bool {
-		return freqs[i] > freqs[j]
-	})
+	return top.sorted(), len(allDocsMap), nil
+}
 
-	sort.SliceStable(freqs, func(i, j int) bool {
-		return freqs[i] > freqs[j]
-	})
+// Search for a single term in a segment
+func (seg *Segment) SearchTerm(t Term, stats *IndexStats) (res []RankedDoc, err error) {
+
+	it, found := seg.TermDict.postingsIterator(t)
+	if !found {
+		return nil, ErrTermNotFound
+	}
 
-	for i, docID := range docnos {
+	// only the freqs are read, not the positions
+	lengths := seg.fieldLengths(t.Field())
+	for it.nextDoc() {
 		res = append(res, RankedDoc{
-			Score: freqs[i],
-			DocID: docID,
+			Score: stats.Score(t, it.freq(), lengths.get(it.doc())),
+			DocID: it.doc(),
 		})
 	}
 
+	sortRankedDocs(res)
 	return
 }
+
+// Sorts by descending score, then ascending doc ID so equal scores come out in a stable order.
+func sortRankedDocs(docs []RankedDoc) {
+	sort.Slice(docs, func(i, j int) bool {
+		return rankedBefore(docs[i], docs[j])
+	})
+}
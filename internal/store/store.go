@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"gocene/config"
 	"gocene/internal/utils"
+	"hash/fnv"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/minio/minio-go/v7"
@@ -24,9 +27,23 @@ type Store struct {
 	Raft     *raft.Raft
 	RaftDir  string
 	RaftBind string
+	// to tell which log entries have been compacted away
+	logStore  raft.LogStore
+	snapshots raft.SnapshotStore
+	// bodies carried by reference by the entries of the log, see prefetch.go
+	bodies *bodyCache
 
 	// for forwarding if not leader
 	PeerHTTP map[string]string
+
+	// held by the writes the leader is handling, a leadership transfer takes it to drain them
+	writeMu sync.RWMutex
+
+	// serialize the modifications of each doc, a PATCH merges into the version it read
+	docLocks [docLockStripes]sync.Mutex
+
+	// index of the last log entry applied to the indices, reads asking for a min_index wait on it
+	appliedIndex atomic.Uint64
 }
 
 type fsm Store
@@ -35,6 +52,111 @@ type Node struct {
 	NodeID      string `json:"node_id"`
 	Address     string `json:"address"`
 	HTTPAddress string `json:"http_address"`
+	Role        string `json:"role,omitempty"`
+}
+
+// Roles of the nodes of a cluster. Nonvoters get the replicated indices and serve searches,
+// but do not vote in elections or count towards the commit quorum, so adding them does not
+// make writes slower.
+const (
+	RoleVoter    = "voter"
+	RoleNonvoter = "nonvoter"
+)
+
+func nodeRole(suffrage raft.ServerSuffrage) string {
+	if suffrage == raft.Voter {
+		return RoleVoter
+	}
+	return RoleNonvoter
+}
+
+// True if the node is the only voter of the servers.
+func isLastVoter(servers []raft.Server, nodeID string) bool {
+	voters := 0
+	last := false
+	for _, srv := range servers {
+		if srv.Suffrage == raft.Voter {
+			voters++
+			last = srv.ID == raft.ServerID(nodeID)
+		}
+	}
+	return voters == 1 && last
+}
+
+// How far a node has got, reported to the leader. It only removes a blob once every node has
+// compacted away the entries referring to it, and only commits a merge once the nodes have
+// built it. Entries up to CompactedIndex are in a snapshot and gone from the log, so the node
+// never applies them again nor sends them to another node.
+type NodeProgress struct {
+	NodeID         string `json:"node_id"`
+	CompactedIndex uint64 `json:"compacted_index"`
+	// merges built on the node and waiting to be swapped in, by index
+	Merges map[string]string `json:"merges,omitempty"`
+}
+
+// This node's progress.
+func (s *Store) Progress() (NodeProgress, error) {
+	p := NodeProgress{NodeID: config.RaftId}
+
+	snapshotIndex, err := latestSnapshotIndex(s.snapshots)
+	if err != nil {
+		return p, err
+	}
+	firstIndex, err := s.logStore.FirstIndex()
+	if err != nil {
+		return p, err
+	}
+
+	// trailing entries are kept in the log after a snapshot, and still sent to followers
+	p.CompactedIndex = snapshotIndex
+	if firstIndex > 0 {
+		p.CompactedIndex = min(snapshotIndex, firstIndex-1)
+	}
+
+	for _, idxName := range s.IndexNames() {
+		idx, ok := s.GetIndex(idxName)
+		if !ok {
+			continue
+		}
+		if name := idx.builtMerge(); name != "" {
+			if p.Merges == nil {
+				p.Merges = make(map[string]string)
+			}
+			p.Merges[idxName] = name
+		}
+	}
+	return p, nil
+}
+
+// Progress of every voter and nonvoter of the cluster, asked over HTTP, and the errors of the
+// nodes that did not answer.
+func (s *Store) clusterProgress() (progress []NodeProgress, failed []error, err error) {
+
+	configFuture := s.Raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, srv := range configFuture.Configuration().Servers {
+		var p NodeProgress
+		var err error
+		if srv.ID == raft.ServerID(config.RaftId) {
+			p, err = s.Progress()
+		} else if httpAddr := s.PeerHTTPAddr(string(srv.Address)); httpAddr == "" {
+			err = fmt.Errorf("no HTTP address for node %s", srv.ID)
+		} else {
+			p, err = GetNodeProgress(httpAddr)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Errorf("node %s: %w", srv.ID, err))
+			continue
+		}
+		progress = append(progress, p)
+	}
+	if len(progress) == 0 && len(failed) == 0 {
+		return nil, nil, ErrNodeNotFound
+	}
+	return progress, failed, nil
 }
 
 type StatusResult struct {
@@ -65,6 +187,9 @@ func (s *Store) Init() {
 		log.Fatalln("could not create a new store, err: ", err.Error())
 	}
 
+	go s.mergeLoop()
+	go s.blobLoop()
+
 }
 
 // -- use these to be concurrent-safe
@@ -94,21 +219,31 @@ func (s *Store) PeerHTTPAddr(addr string) string {
 
 // -- actual store functions
 
-func (s *Store) AddDocument(idxName string, docData map[string]any) (docId int, err error) {
+// Adds a document, returning its ID and the Raft log index of the write.
+func (s *Store) AddDocument(idxName string, docData map[string]any) (docId int, index uint64, err error) {
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
 
 	if s.Raft.State() != raft.Leader {
-		return 0, ErrNotLeader
+		return 0, 0, ErrNotLeader
 	}
 
 	idx, ok := s.GetIndex(idxName)
 	if !ok {
-		return 0, ErrIdxDoesNotExist
+		return 0, 0, ErrIdxDoesNotExist
+	}
+
+	if err = idx.ValidateDocument(docData); err != nil {
+		return 0, 0, err
 	}
 
+	docId = idx.ReserveDocIDs(1)
+
 	// store docto S3
-	err = utils.StoreDocumentToMinio(s.mc, idx.NextDocID, docData, idxName)
+	payload, err := s.storeDocument(idxName, docData)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	// use Command.Param to store Document ID
@@ -117,7 +252,229 @@ func (s *Store) AddDocument(idxName string, docData map[string]any) (docId int,
 	c := Command{
 		CmdId:   CmdAddDocument,
 		IdxName: idxName,
-		Param:   idx.NextDocID,
+		Param:   docId,
+		Docs:    []DocumentPayload{payload},
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	f := s.Raft.Apply(b, config.RaftTimeout)
+
+	if f.Error() != nil {
+		return 0, 0, f.Error()
+	}
+
+	if resp := f.Response(); resp != nil {
+		if ferr, ok := resp.(error); ok {
+			return 0, 0, ferr
+		}
+
+		if docid, ok := resp.(int); ok {
+			return docid, f.Index(), nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("nil response from FSM")
+}
+
+// Writes the doc to Minio, and returns the payload the Raft log carries for it. A doc
+// rejected when applied, like when a doc committed just before it mapped one of its fields
+// to another type, leaves its body to the blob GC.
+func (s *Store) storeDocument(idxName string, docData map[string]any) (DocumentPayload, error) {
+
+	data, err := json.Marshal(docData)
+	if err != nil {
+		log.Println("could not JSON marshal doc for minio store, err: ", err.Error())
+		return DocumentPayload{}, err
+	}
+
+	return s.newDocumentPayload(idxName, data)
+}
+
+// Outcome of a single document of a bulk add.
+type BulkResult struct {
+	DocID int
+	Err   error
+}
+
+// number of concurrent Minio uploads per bulk request
+const bulkUploadWorkers = 16
+
+// Adds a batch of documents. Every doc is written to Minio, then the ones that were stored
+// are committed as a single Raft log entry. Returns one result per doc, in order, and the
+// log index of the entry, 0 when no doc was committed.
+func (s *Store) BulkAddDocuments(idxName string, docs []map[string]any) (res []BulkResult, index uint64, err error) {
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	if s.Raft.State() != raft.Leader {
+		return nil, 0, ErrNotLeader
+	}
+
+	idx, ok := s.GetIndex(idxName)
+	if !ok {
+		return nil, 0, ErrIdxDoesNotExist
+	}
+
+	res = make([]BulkResult, len(docs))
+	payloads := make([]DocumentPayload, len(docs))
+	start := idx.ReserveDocIDs(len(docs))
+
+	// docs not matching the mapping are reported without being stored
+	for i := range docs {
+		res[i].DocID = start + i
+		res[i].Err = idx.ValidateDocument(docs[i])
+	}
+
+	// store docs to S3 concurrently
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(bulkUploadWorkers, len(docs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				payloads[i], res[i].Err = s.storeDocument(idxName, docs[i])
+			}
+		}()
+	}
+	for i := range docs {
+		if res[i].Err == nil {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// only commit the docs that made it to S3
+	var docIDs []int
+	var docPayloads []DocumentPayload
+	var pos []int
+	for i := range res {
+		if res[i].Err == nil {
+			docIDs = append(docIDs, res[i].DocID)
+			docPayloads = append(docPayloads, payloads[i])
+			pos = append(pos, i)
+		}
+	}
+
+	if len(docIDs) == 0 {
+		return res, 0, nil
+	}
+
+	// raft apply
+	c := Command{
+		CmdId:   CmdBulkAddDocuments,
+		IdxName: idxName,
+		DocIDs:  docIDs,
+		Docs:    docPayloads,
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f := s.Raft.Apply(b, config.RaftTimeout)
+
+	if f.Error() != nil {
+		return nil, 0, f.Error()
+	}
+
+	resp := f.Response()
+	if ferr, ok := resp.(error); ok {
+		return nil, 0, ferr
+	}
+
+	errs, ok := resp.([]error)
+	if !ok || len(errs) != len(docIDs) {
+		return nil, 0, fmt.Errorf("unexpected response from FSM: %T", resp)
+	}
+
+	for i, ferr := range errs {
+		res[pos[i]].Err = ferr
+	}
+
+	return res, f.Index(), nil
+}
+
+// number of locks the docs being modified are spread over
+const docLockStripes = 256
+
+// Lock of the modifications of a doc, shared with the docs hashing to the same stripe.
+func (s *Store) docLock(idxName string, docID int) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(idxName))
+	return &s.docLocks[(h.Sum32()+uint32(docID))%docLockStripes]
+}
+
+// Replaces a document with the given data, or merges the data into it if partial is set.
+// The new version is stored in Minio under its SHA-256 before the change is committed, and
+// served once applying the change points the doc at it, so a version the index rejected is
+// never served and a committed one is never lost.
+func (s *Store) ModifyDocument(idxName string, docID int, docData map[string]any, partial bool) (index uint64, err error) {
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	if s.Raft.State() != raft.Leader {
+		return 0, ErrNotLeader
+	}
+
+	mu := s.docLock(idxName, docID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	idx, ok := s.GetIndex(idxName)
+	if !ok {
+		return 0, ErrIdxDoesNotExist
+	}
+
+	if docID < 0 || docID >= idx.GetNextDocID() || !idx.HasDocument(docID) {
+		return 0, ErrDocumentNotFound
+	}
+
+	if partial {
+		docStr, err := idx.DocumentJSON(docID)
+		if err != nil {
+			if err == utils.ErrObjectNotFound {
+				return 0, ErrDocumentNotFound
+			}
+			return 0, err
+		}
+
+		current, err := decodeDocument(docStr)
+		if err != nil {
+			return 0, err
+		}
+		docData = MergeDocuments(current, docData)
+	}
+
+	if err = idx.ValidateDocument(docData); err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(docData)
+	if err != nil {
+		return 0, err
+	}
+
+	payload, err := s.newDocumentPayload(idxName, data)
+	if err != nil {
+		return 0, err
+	}
+
+	// raft apply
+	// use Command.Param to store Document ID
+	c := Command{
+		CmdId:   CmdModifyDocument,
+		IdxName: idxName,
+		Param:   docID,
+		Docs:    []DocumentPayload{payload},
 	}
 
 	b, err := json.Marshal(c)
@@ -136,15 +493,82 @@ func (s *Store) AddDocument(idxName string, docData map[string]any) (docId int,
 			return 0, ferr
 		}
 
-		if docid, ok := resp.(int); ok {
-			return docid, nil
+		if _, ok := resp.(int); ok {
+			return f.Index(), nil
 		}
 	}
 
 	return 0, fmt.Errorf("nil response from FSM")
 }
 
-func (s *Store) CreateIndex(idxName string, cs bool) (err error) {
+// Deletes a document by committing the delete to the Raft log. Its body is left to the blob
+// GC, docs added before bodies were stored by their SHA-256 have their object removed from
+// Minio once every node will tombstone them.
+func (s *Store) DeleteDocument(idxName string, docID int) (index uint64, err error) {
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	if s.Raft.State() != raft.Leader {
+		return 0, ErrNotLeader
+	}
+
+	idx, ok := s.GetIndex(idxName)
+	if !ok {
+		return 0, ErrIdxDoesNotExist
+	}
+
+	if docID < 0 || docID >= idx.GetNextDocID() {
+		return 0, ErrDocumentNotFound
+	}
+
+	// raft apply
+	// use Command.Param to store Document ID
+	c := Command{
+		CmdId:   CmdDeleteDocument,
+		IdxName: idxName,
+		Param:   docID,
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return 0, err
+	}
+
+	f := s.Raft.Apply(b, config.RaftTimeout)
+
+	if f.Error() != nil {
+		return 0, f.Error()
+	}
+
+	var ferr error
+	if resp := f.Response(); resp != nil {
+		var ok bool
+		if ferr, ok = resp.(error); !ok {
+			return 0, fmt.Errorf("unexpected response from FSM: %T", resp)
+		}
+		if ferr != ErrDocumentNotFound {
+			return 0, ferr
+		}
+	}
+
+	// also remove the object when the doc was already tombstoned,
+	// so retrying a delete cleans up after a failed removal
+	if err = utils.DeleteDocumentFromMinio(s.mc, docID, idxName); err != nil {
+		return 0, err
+	}
+
+	return f.Index(), ferr
+}
+
+func (s *Store) CreateIndex(idxName string, cs bool, settings IndexSettings) (err error) {
+
+	if err = settings.Validate(); err != nil {
+		return err
+	}
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
 
 	if s.Raft.State() != raft.Leader {
 		return ErrNotLeader
@@ -159,9 +583,10 @@ func (s *Store) CreateIndex(idxName string, cs bool) (err error) {
 	}
 
 	c := Command{
-		CmdId:   CmdCreateIndex,
-		IdxName: idxName,
-		Param:   param,
+		CmdId:    CmdCreateIndex,
+		IdxName:  idxName,
+		Param:    param,
+		Settings: &settings,
 	}
 
 	b, err := json.Marshal(c)
@@ -200,6 +625,12 @@ func (s *Store) AddNode(addr, httpAddr string) (err error) {
 		NodeHTTPAddress: httpAddr,
 	}
 
+	return s.applyNodeCommand(c)
+}
+
+// Commits a command changing the cluster's peers, which the FSM answers with nil or an error.
+func (s *Store) applyNodeCommand(c Command) error {
+
 	b, err := json.Marshal(c)
 	if err != nil {
 		return err
@@ -221,12 +652,17 @@ func (s *Store) AddNode(addr, httpAddr string) (err error) {
 	return nil
 }
 
-// Join request
+// Join request, as a nonvoter if asked to.
 // Assumes the leader request redirection if not leader has been handled in the service.
-func (s *Store) Join(nodeID, addr, httpAddr string) (err error) {
+func (s *Store) Join(nodeID, addr, httpAddr string, nonvoter bool) (err error) {
 
 	log.Printf("received join request for remote node %s at %s", nodeID, addr)
 
+	role := RoleVoter
+	if nonvoter {
+		role = RoleNonvoter
+	}
+
 	configFuture := s.Raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		log.Printf("failed to get raft configuration: %v", err)
@@ -239,6 +675,9 @@ func (s *Store) Join(nodeID, addr, httpAddr string) (err error) {
 		if srv.ID == raft.ServerID(nodeID) || srv.Address == raft.ServerAddress(addr) {
 
 			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(nodeID) {
+				if nodeRole(srv.Suffrage) != role {
+					return s.SetNodeRole(nodeID, role)
+				}
 				log.Printf("node %s at %s already member of cluster, ignoring join request", nodeID, addr)
 				return nil
 			}
@@ -250,16 +689,240 @@ func (s *Store) Join(nodeID, addr, httpAddr string) (err error) {
 		}
 	}
 
-	f := s.Raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	var f raft.IndexFuture
+	if nonvoter {
+		f = s.Raft.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	} else {
+		f = s.Raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	}
 	if f.Error() != nil {
 		return f.Error()
 	}
-	log.Printf("node %s at %s joined successfully", nodeID, addr)
+	log.Printf("node %s at %s joined successfully as a %s", nodeID, addr, role)
 
 	// commit the join into the Raft logs
 	return s.AddNode(addr, httpAddr)
 }
 
+// Removes a node from the Raft configuration, and commits dropping its HTTP address.
+// A leader removing itself commits the drop first, as it steps down once it is removed.
+func (s *Store) RemoveNode(nodeID string) (err error) {
+
+	if s.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	configFuture := s.Raft.GetConfiguration()
+	if err = configFuture.Error(); err != nil {
+		return err
+	}
+
+	servers := configFuture.Configuration().Servers
+	var addr raft.ServerAddress
+	for _, srv := range servers {
+		if srv.ID == raft.ServerID(nodeID) {
+			addr = srv.Address
+		}
+	}
+	if addr == "" {
+		return ErrNodeNotFound
+	}
+	if isLastVoter(servers, nodeID) {
+		return ErrLastVoter
+	}
+
+	removeServer := func() error {
+		return s.Raft.RemoveServer(raft.ServerID(nodeID), 0, 0).Error()
+	}
+	commitRemoval := func() error {
+		return s.applyNodeCommand(Command{CmdId: CmdRemoveNode, NodeAddress: string(addr)})
+	}
+
+	steps := []func() error{removeServer, commitRemoval}
+	if nodeID == config.RaftId {
+		steps = []func() error{commitRemoval, removeServer}
+	}
+	for _, step := range steps {
+		if err = step(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("node %s at %s removed from the cluster", nodeID, addr)
+	return nil
+}
+
+// Promotes a nonvoter to a voter, or demotes a voter to a nonvoter. A leader demoting
+// itself steps down once it is demoted.
+func (s *Store) SetNodeRole(nodeID, role string) (err error) {
+
+	if role != RoleVoter && role != RoleNonvoter {
+		return ErrInvalidRole
+	}
+
+	if s.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	configFuture := s.Raft.GetConfiguration()
+	if err = configFuture.Error(); err != nil {
+		return err
+	}
+
+	servers := configFuture.Configuration().Servers
+	for _, srv := range servers {
+		if srv.ID != raft.ServerID(nodeID) {
+			continue
+		}
+
+		if role == RoleVoter {
+			err = s.Raft.AddVoter(srv.ID, srv.Address, 0, 0).Error()
+		} else if isLastVoter(servers, nodeID) {
+			err = ErrLastVoter
+		} else {
+			err = s.Raft.DemoteVoter(srv.ID, 0, 0).Error()
+		}
+		if err == nil {
+			log.Printf("node %s at %s is now a %s", nodeID, srv.Address, role)
+		}
+		return err
+	}
+
+	return ErrNodeNotFound
+}
+
+// Hands leadership over to the node, or to the most up to date voter when nodeID is empty.
+// The writes being handled finish first, and the ones coming in meanwhile wait for the
+// transfer, then find this node is no longer the leader and are forwarded to the new one.
+func (s *Store) TransferLeadership(nodeID string) (err error) {
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	if nodeID == "" {
+		err = s.Raft.LeadershipTransfer().Error()
+	} else if nodeID == config.RaftId {
+		return nil
+	} else {
+		configFuture := s.Raft.GetConfiguration()
+		if err = configFuture.Error(); err != nil {
+			return err
+		}
+
+		err = ErrNodeNotFound
+		for _, srv := range configFuture.Configuration().Servers {
+			if srv.ID != raft.ServerID(nodeID) {
+				continue
+			}
+			if srv.Suffrage != raft.Voter {
+				return ErrNotVoter
+			}
+			err = s.Raft.LeadershipTransferToServer(srv.ID, srv.Address).Error()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("leadership transferred")
+	return nil
+}
+
+// Raft address of the leader. While there is none, like during an election, waits up to
+// config.RaftTimeout for one.
+func (s *Store) WaitForLeader() raft.ServerAddress {
+	deadline := time.Now().Add(config.RaftTimeout)
+	for {
+		addr, _ := s.Raft.LeaderWithID()
+		if addr != "" || time.Now().After(deadline) {
+			return addr
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Waits up to config.RaftTimeout for this node to have applied the log entry at index, like
+// the one a write returned, so a read served after it sees that write.
+func (s *Store) WaitForIndex(index uint64) error {
+	deadline := time.Now().Add(config.RaftTimeout)
+	for s.appliedIndex.Load() < index {
+		if time.Now().After(deadline) {
+			return ErrIndexNotApplied
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// Lets the leader serve a linearizable read. It commits a barrier, which takes a quorum still
+// following this node and returns once every entry committed before it is applied, like the
+// read index of the Raft paper. A read served after it sees every write that completed
+// before it, on any node.
+func (s *Store) ReadBarrier() error {
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	if s.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	err := s.Raft.Barrier(config.RaftTimeout).Error()
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return ErrNotLeader
+	}
+	return err
+}
+
+// Takes the node out of the cluster before it stops, so the others do not keep it as a
+// dead peer. A leader hands leadership over first so writes go on, then like a follower
+// asks the leader to remove it. The last voter of a cluster stays in it.
+func (s *Store) Leave() (err error) {
+
+	configFuture := s.Raft.GetConfiguration()
+	if err = configFuture.Error(); err != nil {
+		return err
+	}
+
+	if !isLastVoter(configFuture.Configuration().Servers, config.RaftId) {
+		if s.Raft.State() == raft.Leader {
+			if terr := s.TransferLeadership(""); terr != nil {
+				log.Println("could not transfer leadership before leaving, err: ", terr.Error())
+			}
+		}
+
+		if s.Raft.State() == raft.Leader {
+			err = s.RemoveNode(config.RaftId)
+		} else if leaderAddr := s.WaitForLeader(); leaderAddr == "" {
+			err = ErrNoLeader
+		} else {
+			err = LeaveLeader(s.PeerHTTPAddr(string(leaderAddr)), config.RaftId)
+		}
+		if err != nil {
+			return err
+		}
+		log.Println("left the cluster")
+	}
+
+	return s.Raft.Shutdown().Error()
+}
+
+// Stops Raft before the process exits. The node stays in the cluster's configuration, so it
+// picks up where it left off when restarted. A leader hands leadership over first, so
+// restarting it does not fail writes.
+func (s *Store) Shutdown() error {
+	if s.Raft.State() == raft.Leader {
+		if err := s.TransferLeadership(""); err != nil {
+			log.Println("could not transfer leadership before shutting down, err: ", err.Error())
+		}
+	}
+	return s.Raft.Shutdown().Error()
+}
+
 // Status returns Raft information (id, address, and HTTP reachable address)
 // about the Store, who I am, who the leader is, and who the followers are.
 func (s *Store) Status() (StatusResult, error) {
@@ -269,6 +932,10 @@ func (s *Store) Status() (StatusResult, error) {
 		Address:     string(leaderServerAddr),
 		HTTPAddress: s.PeerHTTPAddr(string(leaderServerAddr)),
 	}
+	if leaderId != "" {
+		// only voters get elected
+		leader.Role = RoleVoter
+	}
 
 	servers := s.Raft.GetConfiguration().Configuration().Servers
 	followers := []Node{}
@@ -281,6 +948,7 @@ func (s *Store) Status() (StatusResult, error) {
 				NodeID:      string(server.ID),
 				Address:     string(server.Address),
 				HTTPAddress: s.PeerHTTPAddr(string(server.Address)),
+				Role:        nodeRole(server.Suffrage),
 			})
 		}
 
@@ -289,6 +957,7 @@ func (s *Store) Status() (StatusResult, error) {
 				NodeID:      string(server.ID),
 				Address:     string(server.Address),
 				HTTPAddress: s.PeerHTTPAddr(string(server.Address)),
+				Role:        nodeRole(server.Suffrage),
 			}
 		}
 	}
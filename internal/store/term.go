@@ -3,9 +3,15 @@ package store
 import "strings"
 
 type Term string
-type TermData map[int]int // Doc number to frequency mapping
+type TermData map[int][]int // Doc number to the (sorted) positions of the term in the field
 
 // Term - "field,value"
 func NewTerm(f, v string) Term {
 	return Term(strings.Join([]string{f, v}, ","))
 }
+
+// Field the term belongs to
+func (t Term) Field() string {
+	f, _, _ := strings.Cut(string(t), ",")
+	return f
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Keeps the k best ranked docs seen, in a min-heap with the worst of them at the root,
+// so a search only holds on to as many hits as the page it returns needs.
+type topDocs struct {
+	k    int
+	docs rankedDocHeap
+}
+
+func newTopDocs(k int) *topDocs {
+	return &topDocs{k: k}
+}
+
+func (t *topDocs) offer(d RankedDoc) {
+	if t.k <= 0 {
+		return
+	}
+	if len(t.docs) < t.k {
+		heap.Push(&t.docs, d)
+		return
+	}
+	if rankedBefore(d, t.docs[0]) {
+		t.docs[0] = d
+		heap.Fix(&t.docs, 0)
+	}
+}
+
+// The docs kept, best first.
+func (t *topDocs) sorted() []RankedDoc {
+	docs := append([]RankedDoc(nil), t.docs...)
+	sort.Slice(docs, func(i, j int) bool {
+		return rankedBefore(docs[i], docs[j])
+	})
+	return docs
+}
+
+// Higher scores first, then lower doc IDs so equal scores come out in a stable order.
+func rankedBefore(a, b RankedDoc) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.DocID < b.DocID
+}
+
+type rankedDocHeap []RankedDoc
+
+func (h rankedDocHeap) Len() int           { return len(h) }
+func (h rankedDocHeap) Less(i, j int) bool { return rankedBefore(h[j], h[i]) }
+func (h rankedDocHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *rankedDocHeap) Push(x any) {
+	*h = append(*h, x.(RankedDoc))
+}
+
+func (h *rankedDocHeap) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
@@ -4,78 +4,65 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"gocene/config"
 	"log"
 	"net/http"
-	"strings"
+	"net/url"
 )
 
-// Only parses JSONs of single level and type string at the moment, see how lucene does it for any JSON
-func CreateDocumentFromJSON(jsonString string) (doc *Document, err error) {
+// Merges patch into doc following JSON merge patch rules: nested objects are merged
+// key by key, a null value removes the key, and anything else replaces the old value.
+func MergeDocuments(doc, patch map[string]interface{}) map[string]interface{} {
 
-	var obj map[string]interface{}
-	err = json.Unmarshal([]byte(jsonString), &obj)
-	if err != nil {
-		return nil, err
+	if doc == nil {
+		doc = make(map[string]interface{}, len(patch))
 	}
 
-	var id int = 0
-	doc = NewDocument()
+	for key, val := range patch {
+		if val == nil {
+			delete(doc, key)
+			continue
+		}
 
-	for key := range obj {
-		field := Field{
-			ID:              id,
-			Name:            key,
-			Type:            StringField,
-			TokenizerString: " ",
-			Value:           fmt.Sprint(obj[key]),
+		if patchObj, isObj := val.(map[string]interface{}); isObj {
+			docObj, _ := doc[key].(map[string]interface{})
+			doc[key] = MergeDocuments(docObj, patchObj)
+			continue
 		}
-		doc.AddField(field)
-		id++
+
+		doc[key] = val
 	}
 
-	doc.DocMap = obj
-	return doc, nil
+	return doc
 }
 
-// Only parses map of a single level.
-func CreateDocumentFromMap(obj map[string]interface{}) (doc *Document, err error) {
-	log.Println("inside CreateDocumentFromMap()")
-
-	var id int = 0
-	doc = NewDocument()
+// Gets usable terms from field and search string input, analyzed like the field's values.
+func GetTermsFromPhrase(analyzers FieldAnalyzers, field, phrase string) (terms []Term) {
+	log.Println("inside GetTermsFromPhrase()")
 
-	for key := range obj {
-		field := Field{
-			ID:              id,
-			Name:            key,
-			Type:            StringField,
-			TokenizerString: " ",
-			Value:           fmt.Sprint(obj[key]),
-		}
-		doc.AddField(field)
-		id++
+	for _, token := range analyzers.FieldAnalyzer(field).Analyze(phrase) {
+		terms = append(terms, NewTerm(field, token.Text))
 	}
 
-	doc.DocMap = obj
-	return doc, nil
+	return terms
 }
 
-// Gets usable terms from field and search string input.
-func GetTermsFromPhrase(field, phrase string) (terms []Term) {
-	log.Println("inside GetTermsFromPhrase()")
+// Gets the terms of a phrase and their positions relative to the first, which are not
+// consecutive when the analyzer dropped stop words in between.
+func GetPhraseTerms(analyzers FieldAnalyzers, field, phrase string) (terms []Term, positions []int) {
 
-	strs := strings.Split(phrase, " ")
-	for _, str := range strs {
-		term := NewTerm(field, str)
-		terms = append(terms, term)
+	tokens := analyzers.FieldAnalyzer(field).Analyze(phrase)
+	for _, token := range tokens {
+		terms = append(terms, NewTerm(field, token.Text))
+		positions = append(positions, token.Position-tokens[0].Position)
 	}
 
-	return terms
+	return terms, positions
 }
 
-// Send a HTTP Raft Join request to the leader.
-func JoinLeaderAsFollower(httpAddr, joinAddr, raftAddr, nodeID string) error {
-	b, err := json.Marshal(map[string]string{"node_address": raftAddr, "node_id": nodeID, "http_address": httpAddr})
+// Send a HTTP Raft Join request to the leader, to join as a nonvoter if asked to.
+func JoinLeaderAsFollower(httpAddr, joinAddr, raftAddr, nodeID string, nonvoter bool) error {
+	b, err := json.Marshal(map[string]any{"node_address": raftAddr, "node_id": nodeID, "http_address": httpAddr, "nonvoter": nonvoter})
 	if err != nil {
 		return err
 	}
@@ -86,3 +73,39 @@ func JoinLeaderAsFollower(httpAddr, joinAddr, raftAddr, nodeID string) error {
 	defer resp.Body.Close()
 	return nil
 }
+
+// the leader asks every node for its progress in the background, and gives up on a node that hangs
+var progressClient = &http.Client{Timeout: config.RaftTimeout}
+
+// Asks a node how far it has got, see NodeProgress.
+func GetNodeProgress(httpAddr string) (p NodeProgress, err error) {
+	resp, err := progressClient.Get(fmt.Sprintf("http://%s/cluster/progress", httpAddr))
+	if err != nil {
+		return p, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return p, fmt.Errorf("node at %s could not report its progress, status: %s", httpAddr, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	return p, err
+}
+
+// Asks the leader to remove the node from the cluster.
+func LeaveLeader(leaderHTTPAddr, nodeID string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s/cluster/nodes/%s", leaderHTTPAddr, url.PathEscape(nodeID)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader could not remove node %s, status: %s", nodeID, resp.Status)
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package utils
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"gocene/config"
@@ -18,6 +17,16 @@ import (
 
 // All Minio/S3 APIs here
 
+var ErrObjectNotFound error = errors.New("object not found in minio store")
+
+// Maps Minio's NoSuchKey response to ErrObjectNotFound, other errors are returned as is.
+func mapMinioError(err error) error {
+	if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
 // Create new Minio Client
 func CreateMinioClient() (mc *minio.Client, err error) {
 
@@ -49,22 +58,23 @@ func CreateMinioClient() (mc *minio.Client, err error) {
 	return
 }
 
-// Store document to S3 bucket.
+// Store a document body under its SHA-256, so the key always refers to the same bytes.
 // Only leader writes, so no consistency issues.
-func StoreDocumentToMinio(mc *minio.Client, docID int, doc map[string]interface{}, indexName string) (err error) {
+func StoreBlobToMinio(mc *minio.Client, sha256 string, data []byte, indexName string) (err error) {
+	return putObject(mc, blobObjectName(sha256, indexName), data)
+}
+
+func blobObjectName(sha256, indexName string) string {
+	return strings.Join([]string{config.MinioBlobPathPrefix, indexName, sha256}, "/") + ".json"
+}
+
+func putObject(mc *minio.Client, objName string, data []byte) (err error) {
 
 	if mc == nil {
 		return errors.New("no minio client passed")
 	}
 
 	ctx := context.Background()
-	data, err := json.Marshal(doc)
-	if err != nil {
-		log.Println("could not JSON marshal doc for minio store, err: ", err.Error())
-		return err
-	}
-
-	objName := strings.Join([]string{config.MinioDocPathPrefix, indexName, strconv.Itoa(docID)}, "/") + ".json"
 
 	_, err = mc.PutObject(
 		ctx,
@@ -84,8 +94,19 @@ func StoreDocumentToMinio(mc *minio.Client, docID int, doc map[string]interface{
 	return
 }
 
-// Get document from S3 bucket.
+// Get a document stored under its ID, before bodies were stored by their SHA-256.
 func GetDocumentFromMinio(mc *minio.Client, docID int, indexName string) (docStr string, err error) {
+	objName := strings.Join([]string{config.MinioDocPathPrefix, indexName, strconv.Itoa(docID)}, "/") + ".json"
+	return getObject(mc, objName)
+}
+
+// Get a document body stored by StoreBlobToMinio.
+func GetBlobFromMinio(mc *minio.Client, sha256 string, indexName string) (data []byte, err error) {
+	docStr, err := getObject(mc, blobObjectName(sha256, indexName))
+	return []byte(docStr), err
+}
+
+func getObject(mc *minio.Client, objName string) (docStr string, err error) {
 
 	if mc == nil {
 		return "", fmt.Errorf("minio client nil")
@@ -93,8 +114,6 @@ func GetDocumentFromMinio(mc *minio.Client, docID int, indexName string) (docStr
 
 	ctx := context.Background()
 
-	objName := strings.Join([]string{config.MinioDocPathPrefix, indexName, strconv.Itoa(docID)}, "/") + ".json"
-
 	obj, err := mc.GetObject(
 		ctx,
 		config.MinioBucket,
@@ -102,18 +121,52 @@ func GetDocumentFromMinio(mc *minio.Client, docID int, indexName string) (docStr
 		minio.GetObjectOptions{},
 	)
 
-	defer obj.Close()
-
 	if err != nil {
 		log.Println("could not get doc from minio store, err: ", err.Error())
-		return
+		return "", mapMinioError(err)
 	}
 
+	defer obj.Close()
+
 	objBytes, err := io.ReadAll(obj)
 	if err != nil {
 		log.Println("could not read object stream from minio get, err: ", err.Error())
-		return
+		return "", mapMinioError(err)
 	}
 
 	return string(objBytes), nil
 }
+
+// Delete a document stored under its ID, before bodies were stored by their SHA-256.
+// Only leader deletes, after the delete has been committed to the Raft log.
+func DeleteDocumentFromMinio(mc *minio.Client, docID int, indexName string) (err error) {
+	objName := strings.Join([]string{config.MinioDocPathPrefix, indexName, strconv.Itoa(docID)}, "/") + ".json"
+	return removeObject(mc, objName)
+}
+
+// Delete a document body stored by StoreBlobToMinio, once nothing refers to it anymore.
+func DeleteBlobFromMinio(mc *minio.Client, sha256 string, indexName string) (err error) {
+	return removeObject(mc, blobObjectName(sha256, indexName))
+}
+
+func removeObject(mc *minio.Client, objName string) (err error) {
+
+	if mc == nil {
+		return errors.New("no minio client passed")
+	}
+
+	ctx := context.Background()
+
+	err = mc.RemoveObject(
+		ctx,
+		config.MinioBucket,
+		objName,
+		minio.RemoveObjectOptions{},
+	)
+
+	if err != nil {
+		log.Println("could not remove doc from minio store, err: ", err.Error())
+	}
+
+	return
+}
@@ -4,13 +4,12 @@ import json
 with open('sample_input.json', 'r') as file:
     data = json.load(file)
 
-endpoint_url = 'http://localhost:8080/idx1/add_document'
-i = 0
+# the whole file goes in one request and one Raft log entry
+endpoint_url = 'http://localhost:8080/idx1/bulk'
 
-for item in data:
-    print(i)
-    i+=1
-    d = dict()
-    d["data"] = item
-    response = requests.post(endpoint_url, json=d)
-    print(f"Status Code: {response.status_code}, Response: {response.text}")
\ No newline at end of file
+response = requests.post(endpoint_url, json=data)
+print(f"Status Code: {response.status_code}")
+
+for i, item in enumerate(response.json().get("items", [])):
+    if not item["success"]:
+        print(f"doc {i} failed: {item.get('error')}")